@@ -0,0 +1,9 @@
+// Package api embeds the OpenAPI specification of the Opal custom app connector API
+package api
+
+import _ "embed"
+
+// Spec is the contents of openapi.yaml
+//
+//go:embed openapi.yaml
+var Spec []byte
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func runAudit(args []string) int {
+	if len(args) < 1 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: audit verify [-after SEQUENCE:HASH] <file>...")
+		fmt.Fprintln(os.Stderr, "Pass rotated files before the active file, oldest first.")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	after := flags.String("after", "", "last entry of an earlier verification, as printed by it, when older files are no longer passed")
+	flags.Parse(args[1:])
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: audit verify [-after SEQUENCE:HASH] <file>...")
+		return 2
+	}
+
+	var anchor *sw.AuditAnchor
+	if *after != "" {
+		var err error
+		if anchor, err = sw.ParseAuditAnchor(*after); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	result, err := sw.VerifyAuditLog(flags.Args(), anchor)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Audit log verification FAILED after %d valid entries: %v\n", result.Entries, err)
+		return 1
+	}
+	if result.Partial {
+		fmt.Fprintf(os.Stderr, "Audit log verification PARTIAL: %d entries chain together, but the first is not the first entry ever written, so earlier entries may have been removed. Pass the older files, or -after with the head of the verification that covered them.\n", result.Entries)
+		return 1
+	}
+
+	if result.Head == nil {
+		fmt.Println("Audit log OK: no entries")
+		return 0
+	}
+	fmt.Printf("Audit log OK: %d entries verified, head %s\n", result.Entries, result.Head)
+	return 0
+}
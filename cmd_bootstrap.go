@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func runBootstrap(args []string) int {
+	flags := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	configPath := configFlag(flags)
+	// Read from the environment only when used, so the token is not shown as the default in -h
+	adminToken := flags.String("admin-token", "", "Authentik token of an admin, defaults to $"+sw.AuthentikAdminTokenEnvKey)
+	appID := flags.String("app", "", "app whose Authentik instance to bootstrap, required when several apps are configured")
+	serviceAccount := flags.String("service-account", sw.DefaultServiceAccountName, "username of the service account")
+	tokenIdentifier := flags.String("token-identifier", "", "identifier of the API token, defaults to <service account>-api-token")
+	revokeUnneeded := flags.Bool("revoke-unneeded", false, "revoke unneeded permissions even from an existing service account bootstrap did not create")
+	output := flags.String("output", "", "where to write the token: file:<path>, vault:<path>#<key> or - for stdout")
+	flags.Parse(args)
+
+	if *output == "" {
+		fmt.Fprintln(os.Stderr, "-output is required, e.g. -output file:/run/secrets/authentik_token")
+		return 2
+	}
+	if *adminToken == "" {
+		*adminToken = os.Getenv(sw.AuthentikAdminTokenEnvKey)
+	}
+	if *adminToken == "" {
+		fmt.Fprintf(os.Stderr, "-admin-token or %s is required\n", sw.AuthentikAdminTokenEnvKey)
+		return 2
+	}
+
+	config, err := sw.LoadConfigWithToken(*configPath, *adminToken)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	backend, err := selectBackend(config, *appID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	client, err := sw.NewAuthentikClientForBackend(backend)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	result, err := client.Bootstrap(context.Background(), sw.BootstrapOptions{
+		ServiceAccount:  *serviceAccount,
+		TokenIdentifier: *tokenIdentifier,
+		RevokeUnneeded:  *revokeUnneeded,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if result.CreatedAccount {
+		fmt.Fprintf(os.Stderr, "Created service account %s\n", result.Username)
+	} else {
+		fmt.Fprintf(os.Stderr, "Service account %s already exists\n", result.Username)
+	}
+	for _, permission := range result.Granted {
+		fmt.Fprintf(os.Stderr, "Granted %s\n", permission)
+	}
+	for _, permission := range result.Revoked {
+		fmt.Fprintf(os.Stderr, "Revoked %s, which the connector does not need\n", permission)
+	}
+	for _, permission := range result.Kept {
+		fmt.Fprintf(os.Stderr, "Kept %s, which the connector does not need, as bootstrap did not create the account; pass -revoke-unneeded to revoke it\n", permission)
+	}
+	if len(result.Granted) == 0 && len(result.Revoked) == 0 && len(result.Kept) == 0 {
+		fmt.Fprintln(os.Stderr, "Permissions are up to date")
+	}
+	if result.CreatedToken {
+		fmt.Fprintf(os.Stderr, "Created API token %s\n", result.TokenIdentifier)
+	} else {
+		fmt.Fprintf(os.Stderr, "API token %s already exists\n", result.TokenIdentifier)
+	}
+
+	if *output == "-" {
+		fmt.Println(result.Token)
+		return 0
+	}
+	if err := sw.StoreSecret(config.Secrets, *output, result.Token); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Wrote the token to %s, point %s at it\n", *output, sw.AuthentikTokenEnvKey)
+
+	return 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+const callUsage = "Usage: call [flags] METHOD PATH, e.g. call GET /groups/<id>/users -app-id my-app"
+
+func runCall(args []string) int {
+	flags := flag.NewFlagSet("call", flag.ExitOnError)
+	newClient := opalClientFlags(flags)
+	data := flags.String("d", "", "JSON request body, @file to read it from a file or - for stdin")
+	all := flags.Bool("all", false, "follow next_cursor and print every page merged into one response")
+	raw := flags.Bool("raw", false, "print the response body as received instead of pretty-printing it")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, callUsage)
+		flags.PrintDefaults()
+	}
+
+	// Flags may come before or after the method and path, e.g. "call GET /groups -app-id x"
+	var positional []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(positional) != 2 {
+		flags.Usage()
+		return 2
+	}
+	method, path := strings.ToUpper(positional[0]), positional[1]
+
+	client, err := newClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	body, err := readCallBody(*data, client.AppID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var resp *sw.OpalResponse
+	if *all {
+		resp, err = callAllPages(client, method, path, body)
+	} else {
+		resp, err = client.Do(context.Background(), method, path, nil, body)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "%d %s\n", resp.StatusCode, resp.Request.URL.Path)
+	printCallBody(resp.Body, *raw)
+
+	if resp.StatusCode >= 400 {
+		return 1
+	}
+	return 0
+}
+
+// readCallBody loads the request body. Opal includes the app_id in JSON bodies, so it is added to
+// objects that lack it.
+func readCallBody(data string, appID string) ([]byte, error) {
+	var body []byte
+	var err error
+	switch {
+	case data == "":
+		return nil, nil
+	case data == "-":
+		body, err = io.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		body, err = os.ReadFile(strings.TrimPrefix(data, "@"))
+	default:
+		body = []byte(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return body, nil
+	}
+	if _, ok := object["app_id"]; ok {
+		return body, nil
+	}
+	object["app_id"] = appID
+
+	return json.Marshal(object)
+}
+
+// callAllPages follows next_cursor to the last page and concatenates the lists of every page
+func callAllPages(client *sw.OpalClient, method string, path string, body []byte) (*sw.OpalResponse, error) {
+	var merged map[string]interface{}
+	var last *sw.OpalResponse
+	seen := make(map[string]bool)
+	cursor := ""
+
+	for page := 1; ; page++ {
+		var query url.Values
+		if cursor != "" {
+			query = url.Values{sw.PageQueryParam: {cursor}}
+		}
+		resp, err := client.Do(context.Background(), method, path, query, body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			return resp, nil
+		}
+		last = resp
+
+		var pageBody map[string]interface{}
+		if err := json.Unmarshal(resp.Body, &pageBody); err != nil {
+			return nil, fmt.Errorf("page %d is not a JSON object: %v", page, err)
+		}
+		if merged == nil {
+			merged = pageBody
+		} else {
+			for key, value := range pageBody {
+				if items, ok := value.([]interface{}); ok {
+					existing, _ := merged[key].([]interface{})
+					merged[key] = append(existing, items...)
+				}
+			}
+		}
+
+		next, _ := pageBody["next_cursor"].(string)
+		if next == "" {
+			break
+		}
+		if seen[next] {
+			return nil, fmt.Errorf("cursor %q was returned again on page %d, the connector's pagination loops", next, page)
+		}
+		seen[next] = true
+		cursor = next
+		fmt.Fprintf(os.Stderr, "Fetched page %d, next cursor %s\n", page, next)
+	}
+
+	merged["next_cursor"] = ""
+	mergedBody, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	last.Body = mergedBody
+
+	return last, nil
+}
+
+func printCallBody(body []byte, raw bool) {
+	if !raw {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err == nil {
+			fmt.Println(indented.String())
+			return
+		}
+	}
+
+	os.Stdout.Write(body)
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		fmt.Println()
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+const testCallSecret = "call-secret"
+
+// pagedConnector serves the pages keyed by cursor, the first under "", and rejects requests that
+// are not signed with testCallSecret. It records the cursors requested.
+func pagedConnector(t *testing.T, pages map[string]string) (*sw.OpalClient, *[]string) {
+	t.Helper()
+	var cursors []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signedBody := strings.TrimSpace(string(body))
+		if signedBody == "" {
+			signedBody = "{}"
+		}
+		signature, _ := sw.GenerateSignature(testCallSecret, r.Header.Get("X-Opal-Request-Timestamp"), []byte(signedBody))
+		if r.Header.Get("X-Opal-Signature") != signature || r.URL.Query().Get("app_id") != "my-app" {
+			http.Error(w, `{"code":401,"message":"invalid signature"}`, http.StatusUnauthorized)
+			return
+		}
+
+		cursor := r.URL.Query().Get(sw.PageQueryParam)
+		cursors = append(cursors, cursor)
+		page, ok := pages[cursor]
+		if !ok {
+			http.Error(w, `{"code":400,"message":"unknown cursor"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, page)
+	}))
+	t.Cleanup(server.Close)
+
+	return &sw.OpalClient{BaseURL: server.URL, AppID: "my-app", SigningSecret: testCallSecret}, &cursors
+}
+
+func TestCallAllPages(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		secret  string
+		pages   map[string]string
+		status  int
+		groups  []string
+		cursors []string
+		err     string
+	}{
+		{
+			name: "follows the cursor",
+			pages: map[string]string{
+				"":   `{"groups":[{"id":"eng"}],"next_cursor":"p2"}`,
+				"p2": `{"groups":[{"id":"platform"}],"next_cursor":"p3"}`,
+				"p3": `{"groups":[{"id":"payments"}]}`,
+			},
+			status:  http.StatusOK,
+			groups:  []string{"eng", "platform", "payments"},
+			cursors: []string{"", "p2", "p3"},
+		},
+		{
+			name:    "stops on an empty next_cursor",
+			pages:   map[string]string{"": `{"groups":[{"id":"eng"}],"next_cursor":""}`, "p2": `{"groups":[{"id":"platform"}]}`},
+			status:  http.StatusOK,
+			groups:  []string{"eng"},
+			cursors: []string{""},
+		},
+		{
+			name:    "detects a looping cursor",
+			pages:   map[string]string{"": `{"groups":[],"next_cursor":"p2"}`, "p2": `{"groups":[],"next_cursor":"p2"}`},
+			cursors: []string{"", "p2"},
+			err:     `cursor "p2" was returned again on page 2`,
+		},
+		{
+			name:    "returns a failed page",
+			pages:   map[string]string{"": `{"groups":[],"next_cursor":"missing"}`},
+			status:  http.StatusBadRequest,
+			cursors: []string{"", "missing"},
+		},
+		{
+			name:   "signs every request",
+			secret: "wrong-secret",
+			pages:  map[string]string{"": `{"groups":[]}`},
+			status: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, cursors := pagedConnector(t, test.pages)
+			if test.secret != "" {
+				client.SigningSecret = test.secret
+			}
+
+			resp, err := callAllPages(client, http.MethodGet, "/groups", nil)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, resp.StatusCode, resp.Body)
+			}
+			if strings.Join(*cursors, ",") != strings.Join(test.cursors, ",") {
+				t.Errorf("expected cursors %q, got %q", test.cursors, *cursors)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+
+			var merged struct {
+				Groups     []struct{ ID string }
+				NextCursor *string `json:"next_cursor"`
+			}
+			if err := json.Unmarshal(resp.Body, &merged); err != nil {
+				t.Fatal(err)
+			}
+			var groups []string
+			for _, group := range merged.Groups {
+				groups = append(groups, group.ID)
+			}
+			if strings.Join(groups, ",") != strings.Join(test.groups, ",") {
+				t.Errorf("expected groups %q, got %q", test.groups, groups)
+			}
+			if merged.NextCursor == nil || *merged.NextCursor != "" {
+				t.Errorf("expected the merged response to have no next cursor, got %s", resp.Body)
+			}
+		})
+	}
+}
+
+func TestReadCallBody(t *testing.T) {
+	dir := t.TempDir()
+	bodyFile := filepath.Join(dir, "body.json")
+	if err := os.WriteFile(bodyFile, []byte(`{"user_id":"2"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		data  string
+		stdin string
+		want  string
+		err   bool
+	}{
+		{name: "no body", data: "", want: ""},
+		{name: "inline", data: `{"user_id":"2"}`, want: `{"app_id":"my-app","user_id":"2"}`},
+		{name: "inline with app_id", data: `{"user_id":"2","app_id":"other"}`, want: `{"user_id":"2","app_id":"other"}`},
+		{name: "not an object", data: `["2"]`, want: `["2"]`},
+		{name: "file", data: "@" + bodyFile, want: `{"app_id":"my-app","user_id":"2"}`},
+		{name: "missing file", data: "@" + filepath.Join(dir, "missing.json"), err: true},
+		{name: "stdin", data: "-", stdin: `{"group_id":"eng"}`, want: `{"app_id":"my-app","group_id":"eng"}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.data == "-" {
+				stdinFile := filepath.Join(t.TempDir(), "stdin")
+				if err := os.WriteFile(stdinFile, []byte(test.stdin), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				stdin, err := os.Open(stdinFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer stdin.Close()
+				saved := os.Stdin
+				os.Stdin = stdin
+				defer func() { os.Stdin = saved }()
+			}
+
+			body, err := readCallBody(test.data, "my-app")
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %s", body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != test.want {
+				t.Errorf("expected %s, got %s", test.want, body)
+			}
+		})
+	}
+}
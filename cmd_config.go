@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func runConfig(args []string) int {
+	if len(args) < 1 || (args[0] != "validate" && args[0] != "print") {
+		fmt.Fprintln(os.Stderr, "Usage: config validate|print [-config file]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	configPath := configFlag(flags)
+	flags.Parse(args[1:])
+
+	config, err := sw.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if args[0] == "validate" {
+		fmt.Println("Configuration OK")
+		return 0
+	}
+
+	out, err := config.Redacted().YAML()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(out)
+	return 0
+}
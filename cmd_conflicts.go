@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func runConflicts(args []string) int {
+	flags := flag.NewFlagSet("conflicts", flag.ExitOnError)
+	configPath := configFlag(flags)
+	appID := flags.String("app", "", "app whose Authentik instance to check, required when several apps are configured")
+	flags.Parse(args)
+
+	config, err := sw.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(config.SeparationOfDuties) == 0 {
+		fmt.Fprintln(os.Stderr, "No separation_of_duties rules are configured")
+		return 2
+	}
+	backend, err := selectBackend(config, *appID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	client, err := sw.NewAuthentikClientForBackend(backend)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	violations, err := client.SeparationOfDutiesReport(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(violations) == 0 {
+		fmt.Printf("No conflicts, %d rules checked\n", len(config.SeparationOfDuties))
+		return 0
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "RULE\tUSER\tEMAIL\tGROUPS")
+	for _, violation := range violations {
+		user := violation.UserID
+		if violation.UserName != "" {
+			user += " (" + violation.UserName + ")"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", violation.Rule, user, violation.UserEmail, strings.Join(violation.Groups, ", "))
+	}
+	table.Flush()
+
+	fmt.Fprintf(os.Stderr, "%d conflicts found\n", len(violations))
+	return 1
+}
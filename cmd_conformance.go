@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func runConformance(args []string) int {
+	flags := flag.NewFlagSet("conformance", flag.ExitOnError)
+	newClient := opalClientFlags(flags)
+	testGroup := flags.String("test-group", "", "group to add and remove members on, round trips are skipped without it")
+	testUser := flags.String("test-user", "", "user to add to and remove from the test group")
+	testMemberGroup := flags.String("test-member-group", "", "group to nest into and remove from the test group")
+	sampleSize := flags.Int("sample", sw.DefaultConformanceSampleSize, "number of groups and resources to fetch by ID")
+	maxPages := flags.Int("max-pages", sw.DefaultConformanceMaxPages, "pages after which pagination is reported as endless")
+	flags.Parse(args)
+
+	client, err := newClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	report, err := sw.RunConformance(context.Background(), sw.ConformanceOptions{
+		Client:            client,
+		TestGroupID:       *testGroup,
+		TestUserID:        *testUser,
+		TestMemberGroupID: *testMemberGroup,
+		SampleSize:        *sampleSize,
+		MaxPages:          *maxPages,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, result := range report.Results {
+		status := "PASS"
+		if result.Skipped {
+			status = "SKIP"
+		} else if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Printf("%s  %s\n", status, result.Check)
+		for _, detail := range result.Details {
+			fmt.Printf("      %s\n", detail)
+		}
+	}
+
+	if failed := report.Failed(); failed > 0 {
+		fmt.Printf("\n%d of %d checks failed\n", failed, len(report.Results))
+		return 1
+	}
+	fmt.Printf("\nAll %d checks passed\n", len(report.Results))
+	return 0
+}
+
+// opalClientFlags registers the flags needed to talk to a connector the way Opal does. The signing
+// secret may be given directly or as a file: or exec: reference.
+func opalClientFlags(flags *flag.FlagSet) func() (*sw.OpalClient, error) {
+	baseURL := flags.String("url", "http://localhost:8080", "base URL of the connector")
+	appID := flags.String("app-id", "", "Opal app ID to send with every request")
+	// Read from the environment only when used, so the secret is not shown as the default in -h
+	secret := flags.String("secret", "", "signing secret, defaults to $"+sw.OpalSigningSecretEnvKey)
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout of each request")
+
+	return func() (*sw.OpalClient, error) {
+		if *appID == "" {
+			return nil, fmt.Errorf("-app-id is required")
+		}
+		if *secret == "" {
+			*secret = os.Getenv(sw.OpalSigningSecretEnvKey)
+		}
+		if *secret == "" {
+			return nil, fmt.Errorf("-secret or %s is required", sw.OpalSigningSecretEnvKey)
+		}
+
+		signingSecret, err := sw.NewSecretResolver(sw.SecretsConfig{}).Resolve(*secret)
+		if err != nil {
+			return nil, err
+		}
+
+		return &sw.OpalClient{
+			BaseURL:       *baseURL,
+			AppID:         *appID,
+			SigningSecret: signingSecret,
+			HTTPClient:    &http.Client{Timeout: *timeout},
+		}, nil
+	}
+}
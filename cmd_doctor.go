@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func runDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := configFlag(flags)
+	flags.Parse(args)
+
+	report := &sw.DoctorReport{}
+	config, err := sw.LoadConfig(*configPath)
+	if err != nil {
+		report.Results = append(report.Results, sw.DoctorResult{
+			Check:  "configuration",
+			Status: sw.DoctorFail,
+			Detail: err.Error(),
+			Hint:   "fix the settings above, `config print` shows the effective configuration",
+		})
+	} else {
+		source := "environment"
+		if *configPath != "" {
+			source = *configPath + " and environment"
+		}
+		report.Results = append(report.Results, sw.DoctorResult{Check: "configuration", Status: sw.DoctorPass, Detail: "loaded from " + source})
+		report.Results = append(report.Results, sw.RunDoctor(context.Background(), config).Results...)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "CHECK\tSTATUS\tDETAIL")
+	for _, result := range report.Results {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", result.Check, result.Status, result.Detail)
+	}
+	table.Flush()
+
+	printedHeader := false
+	for _, result := range report.Results {
+		if result.Hint == "" || (result.Status != sw.DoctorFail && result.Status != sw.DoctorWarn) {
+			continue
+		}
+		if !printedHeader {
+			fmt.Println("\nTo fix:")
+			printedHeader = true
+		}
+		fmt.Printf("  %s: %s\n", result.Check, result.Hint)
+	}
+
+	fmt.Printf("\n%s\n", doctorSummary(report))
+	if report.Failed() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// doctorSummary counts the results by status, as a warning or a skipped check is not a pass
+func doctorSummary(report *sw.DoctorReport) string {
+	passed := report.Count(sw.DoctorPass)
+	if passed == len(report.Results) {
+		return fmt.Sprintf("All %d checks passed", passed)
+	}
+
+	summary := fmt.Sprintf("%d passed, %d warnings, %d skipped", passed, report.Count(sw.DoctorWarn), report.Count(sw.DoctorSkip))
+	if failed := report.Failed(); failed > 0 {
+		summary = fmt.Sprintf("%d of %d checks failed: %s", failed, len(report.Results), summary)
+	}
+	return summary
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func TestDoctorSummary(t *testing.T) {
+	for _, test := range []struct {
+		statuses []string
+		want     string
+	}{
+		{[]string{sw.DoctorPass, sw.DoctorPass}, "All 2 checks passed"},
+		{[]string{sw.DoctorPass, sw.DoctorWarn, sw.DoctorSkip, sw.DoctorSkip}, "1 passed, 1 warnings, 2 skipped"},
+		{[]string{sw.DoctorPass, sw.DoctorFail, sw.DoctorSkip}, "1 of 3 checks failed: 1 passed, 0 warnings, 1 skipped"},
+	} {
+		report := &sw.DoctorReport{}
+		for _, status := range test.statuses {
+			report.Results = append(report.Results, sw.DoctorResult{Check: "check", Status: status})
+		}
+		if got := doctorSummary(report); got != test.want {
+			t.Errorf("expected %q for %v, got %q", test.want, test.statuses, got)
+		}
+	}
+}
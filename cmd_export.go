@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := configFlag(flags)
+	appID := flags.String("app", "", "app whose Authentik instance to export, required when several apps are configured")
+	format := flags.String("format", sw.ExportFormatJSON, "json for one inventory.json, csv for one file per table")
+	out := flags.String("out", "", "directory to write the export and its manifest to")
+	flags.Parse(args)
+
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "-out is required")
+		return 2
+	}
+	if *format != sw.ExportFormatJSON && *format != sw.ExportFormatCSV {
+		fmt.Fprintf(os.Stderr, "-format must be %s or %s\n", sw.ExportFormatJSON, sw.ExportFormatCSV)
+		return 2
+	}
+
+	config, err := sw.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	backend, err := selectBackend(config, *appID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	client, err := sw.NewAuthentikClientForBackend(backend)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	manifest := &sw.ExportManifest{
+		AuthentikHost: backend.Authentik.Host,
+		App:           *appID,
+		StartedAt:     time.Now().UTC(),
+		Format:        *format,
+	}
+	inventory, err := client.ExportInventory(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	manifest.FinishedAt = time.Now().UTC()
+
+	if err := sw.WriteInventory(*out, inventory, manifest); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d users, %d groups, %d memberships and %d nested groups to %s\n",
+		len(inventory.Users), len(inventory.Groups), len(inventory.Memberships), len(inventory.Nesting), *out)
+	return 0
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func runPolicy(args []string) int {
+	if len(args) < 1 || args[0] != "test" {
+		fmt.Fprintln(os.Stderr, "Usage: policy test [-config file] [path...]")
+		fmt.Fprintln(os.Stderr, "Paths default to policies.paths of the configuration.")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("policy test", flag.ExitOnError)
+	configPath := configFlag(flags)
+	flags.Parse(args[1:])
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		config, err := sw.LoadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		paths = config.Policies.Paths
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "No policies are configured")
+		return 2
+	}
+
+	results, err := sw.RunPolicyTests(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Passed {
+			fmt.Printf("PASS  %s: %s\n", result.File, result.Name)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %s: %s\n      %s\n", result.File, result.Name, result.Problem)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d policy tests failed\n", failed, len(results))
+		return 1
+	}
+	fmt.Printf("%d policy tests passed\n", len(results))
+	return 0
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func runReconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	configPath := configFlag(flags)
+	appID := flags.String("app", "", "app whose Authentik instance to reconcile, required when several apps are configured")
+	statePath := flags.String("f", "", "YAML file declaring the members of the managed groups")
+	planOnly := flags.Bool("plan", false, "print the plan without applying it")
+	yes := flags.Bool("yes", false, "apply the plan without asking for confirmation")
+	interval := flags.Duration("interval", 0, "keep running and reconcile at this interval, requires -yes")
+	flags.Parse(args)
+
+	if *statePath == "" {
+		fmt.Fprintln(os.Stderr, "-f is required")
+		return 2
+	}
+	if *interval > 0 && !*yes {
+		fmt.Fprintln(os.Stderr, "-interval applies changes unattended and requires -yes")
+		return 2
+	}
+
+	config, err := sw.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	backend, err := selectBackend(config, *appID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	client, err := sw.NewAuthentikClientForBackend(backend)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// Changes are audited like those requested by Opal
+	auditLogger, err := sw.NewAuditLoggerFromConfig(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	sw.SetAuditLogger(auditLogger)
+	if auditLogger != nil {
+		defer auditLogger.Close()
+	}
+
+	if *interval > 0 {
+		return reconcileInBackground(client, *statePath, *interval, *planOnly)
+	}
+
+	state, err := sw.LoadDesiredState(*statePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	plan, err := client.PlanReconcile(context.Background(), state)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(plan.Changes) == 0 {
+		fmt.Println("No changes, the groups match the desired state")
+		return 0
+	}
+	fmt.Printf("%d changes:\n", len(plan.Changes))
+	for _, change := range plan.Changes {
+		fmt.Printf("  %s %s\n", changeSymbol(change), change.Describe())
+	}
+	if *planOnly {
+		return 0
+	}
+	if !*yes && !confirm(fmt.Sprintf("Apply these %d changes? Type yes to confirm: ", len(plan.Changes))) {
+		fmt.Println("Nothing changed")
+		return 1
+	}
+
+	applied, err := client.ApplyReconcilePlan(context.Background(), plan)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %d of %d changes before failing: %v\n", appliedLabel(client), applied, len(plan.Changes), err)
+		return 1
+	}
+	fmt.Printf("%s %d changes\n", appliedLabel(client), applied)
+	return 0
+}
+
+// reconcileInBackground reconciles until interrupted, re-reading the desired state each time so
+// edits are picked up. Failures are logged and retried at the next interval.
+func reconcileInBackground(client *sw.AuthentikClient, statePath string, interval time.Duration, planOnly bool) int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		reconcileOnce(ctx, client, statePath, planOnly)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopped reconciling")
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
+
+func reconcileOnce(ctx context.Context, client *sw.AuthentikClient, statePath string, planOnly bool) {
+	state, err := sw.LoadDesiredState(statePath)
+	if err != nil {
+		log.Printf("Not reconciling: %v", err)
+		return
+	}
+	plan, err := client.PlanReconcile(ctx, state)
+	if err != nil {
+		log.Printf("Unable to plan reconciliation: %v", err)
+		return
+	}
+	if len(plan.Changes) == 0 {
+		return
+	}
+
+	for _, change := range plan.Changes {
+		log.Printf("Drift: %s", change.Describe())
+	}
+	if planOnly {
+		return
+	}
+
+	applied, err := client.ApplyReconcilePlan(ctx, plan)
+	if err != nil {
+		log.Printf("%s %d of %d changes before failing: %v", appliedLabel(client), applied, len(plan.Changes), err)
+		return
+	}
+	log.Printf("%s %d changes", appliedLabel(client), applied)
+}
+
+// appliedLabel describes the changes ApplyReconcilePlan went through, which are only simulated in dry-run mode
+func appliedLabel(client *sw.AuthentikClient) string {
+	if client.DryRun() {
+		return "Dry run, would have applied"
+	}
+	return "Applied"
+}
+
+func changeSymbol(change sw.ReconcileChange) string {
+	switch change.Operation {
+	case sw.AuditOperationAddUserToGroup, sw.AuditOperationAddGroupToGroup:
+		return "+"
+	}
+	return "-"
+}
+
+// confirm asks a question on the terminal and reports whether it was answered with yes
+func confirm(question string) bool {
+	fmt.Print(question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(answer), "yes")
+}
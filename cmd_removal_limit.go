@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+func runRemovalLimit(args []string) int {
+	if len(args) < 1 || (args[0] != "status" && args[0] != "reset") {
+		fmt.Fprintln(os.Stderr, "Usage: removal-limit status|reset [-config file] [-app ID]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("removal-limit "+args[0], flag.ExitOnError)
+	configPath := configFlag(flags)
+	appID := flags.String("app", "", "app whose Authentik instance to check, required when several apps are configured")
+	flags.Parse(args[1:])
+
+	config, err := sw.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	backend, err := selectBackend(config, *appID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if args[0] == "reset" {
+		trip, err := backend.ResetRemovalLimit()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if trip == nil {
+			fmt.Printf("Changes for %s were not halted\n", backend.Name)
+		} else {
+			fmt.Printf("Changes for %s resumed, they were halted at %s as %s\n", backend.Name, trip.Time.Format("2006-01-02 15:04:05 MST"), trip)
+		}
+		return 0
+	}
+
+	trip, err := backend.RemovalLimitState()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if trip == nil {
+		fmt.Printf("Changes for %s are allowed\n", backend.Name)
+		return 0
+	}
+	fmt.Printf("Changes for %s are halted since %s: %s\n", backend.Name, trip.Time.Format("2006-01-02 15:04:05 MST"), trip)
+	return 1
+}
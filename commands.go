@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	sw "github.com/GIT_USER_ID/GIT_REPO_ID/go"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) int
+}
+
+var commands = map[string]command{
+	"serve": {
+		usage: "[-config file] run the connector (default)",
+		run:   runServe,
+	},
+	"config": {
+		usage: "config validate|print [-config file] - check or show the effective configuration",
+		run:   runConfig,
+	},
+	"call": {
+		usage: "call METHOD PATH -app-id ID [-secret S] [-d body] [-all] - send a signed request and print the response",
+		run:   runCall,
+	},
+	"conformance": {
+		usage: "conformance -url URL -app-id ID [-secret S] [-test-group G -test-user U] - check a deployed connector against the API spec",
+		run:   runConformance,
+	},
+	"bootstrap": {
+		usage: "bootstrap -output file:PATH|vault:PATH#KEY|- [-config file] [-admin-token T] - create the service account, permissions and API token",
+		run:   runBootstrap,
+	},
+	"doctor": {
+		usage: "doctor [-config file] - check Authentik, the credentials, permissions and clock of a deployment",
+		run:   runDoctor,
+	},
+	"export": {
+		usage: "export -out DIR [-format json|csv] [-config file] - dump users, groups, memberships and nesting with a checksummed manifest",
+		run:   runExport,
+	},
+	"reconcile": {
+		usage: "reconcile -f FILE [-plan] [-yes] [-interval D] [-config file] - make managed groups match a desired state file",
+		run:   runReconcile,
+	},
+	"conflicts": {
+		usage: "conflicts [-config file] - list users who are members of groups the separation_of_duties rules forbid combining",
+		run:   runConflicts,
+	},
+	"policy": {
+		usage: "policy test [-config file] [path...] - check policies compile and run their tests",
+		run:   runPolicy,
+	},
+	"removal-limit": {
+		usage: "removal-limit status|reset [-config file] [-app ID] - show whether the removal limit halted changes, or resume them",
+		run:   runRemovalLimit,
+	},
+	"audit": {
+		usage: "audit verify [-after SEQUENCE:HASH] <file>... - check the hash chain of audit log files, oldest first",
+		run:   runAudit,
+	},
+}
+
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		printUsage()
+		return 2
+	}
+
+	return cmd.run(args)
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+// selectBackend picks the Authentik instance a command works on, given its -app flag
+func selectBackend(config *sw.Config, appID string) (*sw.Backend, error) {
+	if appID != "" {
+		if len(config.Apps) == 0 {
+			return nil, fmt.Errorf("-app is only used when apps are configured")
+		}
+		backend, ok := config.Backend(appID)
+		if !ok {
+			return nil, fmt.Errorf("app %s is not configured", appID)
+		}
+		return backend, nil
+	}
+
+	backends := config.Backends()
+	if len(backends) != 1 {
+		names := make([]string, 0, len(backends))
+		for _, backend := range backends {
+			names = append(names, backend.Name)
+		}
+		return nil, fmt.Errorf("several apps are configured, pick one with -app: %s", strings.Join(names, ", "))
+	}
+
+	return backends[0], nil
+}
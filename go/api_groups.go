@@ -32,13 +32,19 @@ func (api *GroupsAPI) AddGroupMemberGroup(c *gin.Context) {
 		return
 	}
 
-	authentik, err := NewAuthentikClient()
+	options, err := changeOptionsFromCtx(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildRespFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	authentik, err := newAuthentikClientFromCtx(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
 		return
 	}
 
-	err = authentik.AddGroupToGroup(c, containingGroupID, addGroupMemberGroupRequest.GroupId)
+	err = authentik.AddGroupToGroup(c.Request.Context(), containingGroupID, addGroupMemberGroupRequest.GroupId, options)
 	if err != nil {
 		var clientErr *ClientError
 		if errors.As(err, &clientErr) {
@@ -49,6 +55,9 @@ func (api *GroupsAPI) AddGroupMemberGroup(c *gin.Context) {
 		return
 	}
 
+	if authentik.dryRun(options) {
+		c.Header(DryRunHeader, "true")
+	}
 	c.JSON(http.StatusOK, gin.H{})
 }
 
@@ -68,13 +77,19 @@ func (api *GroupsAPI) AddGroupUser(c *gin.Context) {
 		return
 	}
 
-	authentik, err := NewAuthentikClient()
+	options, err := changeOptionsFromCtx(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildRespFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	authentik, err := newAuthentikClientFromCtx(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
 		return
 	}
 
-	err = authentik.AddUserToGroup(c, groupID, addGroupUserRequest.UserId)
+	err = authentik.AddUserToGroup(c.Request.Context(), groupID, addGroupUserRequest.UserId, options)
 	if err != nil {
 		var clientErr *ClientError
 		if errors.As(err, &clientErr) {
@@ -85,6 +100,9 @@ func (api *GroupsAPI) AddGroupUser(c *gin.Context) {
 		return
 	}
 
+	if authentik.dryRun(options) {
+		c.Header(DryRunHeader, "true")
+	}
 	c.JSON(http.StatusOK, gin.H{})
 }
 
@@ -92,13 +110,16 @@ func (api *GroupsAPI) AddGroupUser(c *gin.Context) {
 func (api *GroupsAPI) GetGroup(c *gin.Context) {
 	groupID := c.Param("group_id")
 
-	authentik, err := NewAuthentikClient()
+	authentik, err := newAuthentikClientFromCtx(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
 		return
 	}
 
-	authentikGroup, err := authentik.GetGroup(c, groupID)
+	authentikGroup, err := authentik.GetGroup(c.Request.Context(), groupID)
+	if err == nil && authentik.backend.config.ProtectedGroups.hidden(authentikGroup) {
+		err = hiddenGroupError("failed to get group from authentik")
+	}
 	if err != nil {
 		var clientErr *ClientError
 		if errors.As(err, &clientErr) {
@@ -111,7 +132,7 @@ func (api *GroupsAPI) GetGroup(c *gin.Context) {
 
 	opalGroup := toOpalGroup(authentikGroup)
 
-	c.JSON(http.StatusOK, gin.H{"group": *opalGroup})
+	c.JSON(http.StatusOK, GroupResponse{Group: *opalGroup})
 }
 
 // Get /groups/:group_id/resources
@@ -125,13 +146,16 @@ func (api *GroupsAPI) GetGroupResources(c *gin.Context) {
 func (api *GroupsAPI) GetGroupUsers(c *gin.Context) {
 	groupID := c.Param("group_id")
 
-	authentik, err := NewAuthentikClient()
+	authentik, err := newAuthentikClientFromCtx(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
 		return
 	}
 
-	groupMemberships, err := authentik.GetGroupUsers(c, groupID)
+	groupMemberships, err := authentik.GetGroupUsers(c.Request.Context(), groupID)
+	if err == nil {
+		err = authentik.checkGroupVisible(c.Request.Context(), groupID, "failed to get users for group from Authentik")
+	}
 	if err != nil {
 		var clientErr *ClientError
 		if errors.As(err, &clientErr) {
@@ -163,13 +187,16 @@ func (api *GroupsAPI) GetGroupUsers(c *gin.Context) {
 func (api *GroupsAPI) GetGroupMemberGroups(c *gin.Context) {
 	groupID := c.Param("group_id")
 
-	authentik, err := NewAuthentikClient()
+	authentik, err := newAuthentikClientFromCtx(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
 		return
 	}
 
-	authentikMemberGroups, err := authentik.ListChildrenGroups(c, groupID)
+	authentikMemberGroups, err := authentik.ListChildrenGroups(c.Request.Context(), groupID)
+	if err == nil {
+		err = authentik.checkGroupVisible(c.Request.Context(), groupID, "failed to get children groups for group from Authentik")
+	}
 	if err != nil {
 		var clientErr *ClientError
 		if errors.As(err, &clientErr) {
@@ -182,6 +209,9 @@ func (api *GroupsAPI) GetGroupMemberGroups(c *gin.Context) {
 
 	memberGroups := make([]GroupMemberGroup, 0)
 	for _, authentikGroup := range authentikMemberGroups {
+		if authentik.backend.config.ProtectedGroups.hidden(authentikGroup) {
+			continue
+		}
 		group := toGroupMemberGroup(authentikGroup)
 		memberGroups = append(memberGroups, *group)
 	}
@@ -196,13 +226,13 @@ func (api *GroupsAPI) GetGroupMemberGroups(c *gin.Context) {
 
 // Get /groups
 func (api *GroupsAPI) GetGroups(c *gin.Context) {
-	authentik, err := NewAuthentikClient()
+	authentik, err := newAuthentikClientFromCtx(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
 		return
 	}
 
-	authentikGroups, nextCursor, err := authentik.PaginatedListGroups(c)
+	authentikGroups, nextCursor, err := authentik.PaginatedListGroups(c.Request.Context(), c.Query(PageQueryParam))
 	if err != nil {
 		var clientErr *ClientError
 		if errors.As(err, &clientErr) {
@@ -215,6 +245,9 @@ func (api *GroupsAPI) GetGroups(c *gin.Context) {
 
 	groups := make([]Group, 0)
 	for _, authentikGroup := range authentikGroups {
+		if authentik.backend.config.ProtectedGroups.hidden(&authentikGroup) {
+			continue
+		}
 		group := toOpalGroup(&authentikGroup)
 		groups = append(groups, *group)
 	}
@@ -230,13 +263,19 @@ func (api *GroupsAPI) RemoveGroupMemberGroup(c *gin.Context) {
 	containingGroupID := c.Param("group_id")
 	memberGroupID := c.Param("member_group_id")
 
-	authentik, err := NewAuthentikClient()
+	options, err := changeOptionsFromCtx(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildRespFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	authentik, err := newAuthentikClientFromCtx(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
 		return
 	}
 
-	err = authentik.RemoveGroupFromGroup(c, containingGroupID, memberGroupID)
+	err = authentik.RemoveGroupFromGroup(c.Request.Context(), containingGroupID, memberGroupID, options)
 	if err != nil {
 		var clientErr *ClientError
 		if errors.As(err, &clientErr) {
@@ -247,6 +286,9 @@ func (api *GroupsAPI) RemoveGroupMemberGroup(c *gin.Context) {
 		return
 	}
 
+	if authentik.dryRun(options) {
+		c.Header(DryRunHeader, "true")
+	}
 	c.JSON(http.StatusOK, gin.H{})
 }
 
@@ -261,13 +303,19 @@ func (api *GroupsAPI) RemoveGroupUser(c *gin.Context) {
 	groupID := c.Param("group_id")
 	userID := c.Param("user_id")
 
-	authentik, err := NewAuthentikClient()
+	options, err := changeOptionsFromCtx(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, buildRespFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	authentik, err := newAuthentikClientFromCtx(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
 		return
 	}
 
-	err = authentik.RemoveUserFromGroup(c, groupID, userID)
+	err = authentik.RemoveUserFromGroup(c.Request.Context(), groupID, userID, options)
 	if err != nil {
 		var clientErr *ClientError
 		if errors.As(err, &clientErr) {
@@ -278,6 +326,9 @@ func (api *GroupsAPI) RemoveGroupUser(c *gin.Context) {
 		return
 	}
 
+	if authentik.dryRun(options) {
+		c.Header(DryRunHeader, "true")
+	}
 	c.JSON(http.StatusOK, gin.H{})
 }
 
@@ -0,0 +1,274 @@
+package openapi
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+// seedGroups adds an engineering group with alice, and an empty platform group
+func seedGroups(tc *testConnector) {
+	tc.authentik.AddUser(authentiktest.User{Pk: 1, Username: "alice", Email: "alice@example.com"})
+	tc.authentik.AddUser(authentiktest.User{Pk: 2, Username: "bob", Email: "bob@example.com"})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "eng", Name: "Engineering", Users: []int32{1}})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "platform", Name: "Platform"})
+}
+
+func TestGetGroups(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+
+	var resp GroupsResponse
+	decode(t, tc.do(http.MethodGet, appPath("/groups"), ""), http.StatusOK, &resp)
+	if len(resp.Groups) != 2 || resp.Groups[0].Id != "eng" || resp.Groups[1].Name != "Platform" {
+		t.Fatalf("unexpected groups %+v", resp.Groups)
+	}
+	if resp.NextCursor == nil || *resp.NextCursor != "" {
+		t.Fatalf("expected an empty cursor, got %v", resp.NextCursor)
+	}
+}
+
+func TestGetGroup(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+
+	var resp GroupResponse
+	decode(t, tc.do(http.MethodGet, appPath("/groups/eng"), ""), http.StatusOK, &resp)
+	if resp.Group.Id != "eng" || resp.Group.Name != "Engineering" {
+		t.Fatalf("unexpected group %+v", resp.Group)
+	}
+
+	var errResp Error
+	decode(t, tc.do(http.MethodGet, appPath("/groups/missing"), ""), http.StatusNotFound, &errResp)
+	if errResp.Code != http.StatusNotFound {
+		t.Fatalf("unexpected error body %+v", errResp)
+	}
+}
+
+func TestGetGroupUsers(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+
+	var resp GroupUsersResponse
+	decode(t, tc.do(http.MethodGet, appPath("/groups/eng/users"), ""), http.StatusOK, &resp)
+	if len(resp.Users) != 1 || resp.Users[0].UserId != "1" || resp.Users[0].Email != "alice@example.com" {
+		t.Fatalf("unexpected group users %+v", resp.Users)
+	}
+}
+
+func TestAddAndRemoveGroupUser(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	if group, _ := tc.authentik.Group("eng"); len(group.Users) != 2 {
+		t.Fatalf("expected bob to be added, members are %v", group.Users)
+	}
+
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/1"), ""), http.StatusOK, nil)
+	if group, _ := tc.authentik.Group("eng"); len(group.Users) != 1 || group.Users[0] != 2 {
+		t.Fatalf("expected only bob to remain, members are %v", group.Users)
+	}
+
+	entries := tc.auditEntries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 audit entries, got %d", len(entries))
+	}
+	if entries[0].Operation != AuditOperationAddUserToGroup || entries[0].UserEmail != "bob@example.com" || entries[0].GroupName != "Engineering" {
+		t.Fatalf("unexpected audit entry %+v", entries[0])
+	}
+	if entries[1].Operation != AuditOperationRemoveUserFromGroup || entries[1].Outcome != AuditOutcomeSuccess {
+		t.Fatalf("unexpected audit entry %+v", entries[1])
+	}
+}
+
+func TestAddGroupUserRejectsInvalidBody(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+
+	var errResp Error
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"app_id":"`+testAppID+`"}`), http.StatusBadRequest, &errResp)
+	if errResp.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected error body %+v", errResp)
+	}
+	if len(tc.auditEntries()) != 0 {
+		t.Fatal("a rejected request must not reach Authentik")
+	}
+}
+
+func TestAddAndRemoveGroupMemberGroup(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/member-groups"), `{"group_id":"platform","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	if group, _ := tc.authentik.Group("platform"); group.Parent != "eng" {
+		t.Fatalf("expected platform to be nested under eng, parent is %q", group.Parent)
+	}
+
+	var resp GroupMemberGroupsResponse
+	decode(t, tc.do(http.MethodGet, appPath("/groups/eng/member-groups"), ""), http.StatusOK, &resp)
+	if len(resp.Groups) != 1 || resp.Groups[0].GroupId != "platform" {
+		t.Fatalf("unexpected member groups %+v", resp.Groups)
+	}
+
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/member-groups/platform"), ""), http.StatusOK, nil)
+	if group, _ := tc.authentik.Group("platform"); group.Parent != "" {
+		t.Fatalf("expected platform to be top level again, parent is %q", group.Parent)
+	}
+}
+
+func TestAuthentikErrorsArePassedThrough(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusTooManyRequests, http.StatusBadGateway} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			tc := newTestConnector(t, "")
+			seedGroups(tc)
+			tc.authentik.Fail(authentiktest.Failure{Method: http.MethodPost, Path: "/api/v3/core/groups/eng/add_user/", Status: status, Times: 1})
+
+			var errResp Error
+			decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), status, &errResp)
+			if errResp.Code != int32(status) {
+				t.Fatalf("unexpected error body %+v", errResp)
+			}
+
+			entries := tc.auditEntries()
+			if len(entries) != 1 || entries[0].Outcome != AuditOutcomeFailure || entries[0].AuthentikStatus != status {
+				t.Fatalf("expected a failed audit entry, got %+v", entries)
+			}
+
+			// The failure was scripted for one request only
+			decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+		})
+	}
+}
+
+func TestSlowAuthentik(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+	tc.authentik.Fail(authentiktest.Failure{Path: "/api/v3/core/groups/", Latency: 100 * time.Millisecond})
+
+	start := time.Now()
+	decode(t, tc.do(http.MethodGet, appPath("/groups/eng/users"), ""), http.StatusOK, nil)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected the request to wait for Authentik, took %s", elapsed)
+	}
+}
+
+// mutatingRequests returns the requests the fake Authentik received that could have changed it
+func mutatingRequests(tc *testConnector) []string {
+	var mutating []string
+	for _, request := range tc.authentik.Requests() {
+		if !strings.HasPrefix(request, http.MethodGet+" ") {
+			mutating = append(mutating, request)
+		}
+	}
+	return mutating
+}
+
+func TestDryRunHeader(t *testing.T) {
+	tc := newTestConnector(t, "  events: true\n")
+	seedGroups(tc)
+
+	req := tc.signedRequest(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`)
+	req.Header.Set(DryRunHeader, "true")
+	recorder := tc.serve(req)
+	decode(t, recorder, http.StatusOK, nil)
+	if recorder.Header().Get(DryRunHeader) != "true" {
+		t.Errorf("expected the response to be marked as a dry run")
+	}
+	if group, _ := tc.authentik.Group("eng"); len(group.Users) != 1 {
+		t.Errorf("expected the group to be left alone, members are %v", group.Users)
+	}
+	if mutating := mutatingRequests(tc); len(mutating) != 0 {
+		t.Errorf("expected no changes to Authentik, got %v", mutating)
+	}
+
+	entries := tc.auditEntries()
+	if len(entries) != 1 || !entries[0].DryRun || entries[0].Outcome != AuditOutcomeSuccess || entries[0].UserEmail != "bob@example.com" {
+		t.Fatalf("expected a successful dry run audit entry, got %+v", entries)
+	}
+
+	// The header is not signed, so anything but true or false is refused rather than guessed
+	req = tc.signedRequest(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`)
+	req.Header.Set(DryRunHeader, "yes please")
+	var errResp Error
+	decode(t, tc.serve(req), http.StatusBadRequest, &errResp)
+	if !strings.Contains(errResp.Message, DryRunHeader) {
+		t.Errorf("expected the error to name the header, got %q", errResp.Message)
+	}
+	if mutating := mutatingRequests(tc); len(mutating) != 0 {
+		t.Errorf("expected no changes to Authentik, got %v", mutating)
+	}
+
+	// Without the header, the change is made
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	if group, _ := tc.authentik.Group("eng"); len(group.Users) != 2 {
+		t.Errorf("expected bob to be added, members are %v", group.Users)
+	}
+}
+
+func TestDryRunConfig(t *testing.T) {
+	tc := newTestConnector(t, "dry_run: true\n")
+	seedGroups(tc)
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/member-groups"), `{"group_id":"platform","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/1"), ""), http.StatusOK, nil)
+	if mutating := mutatingRequests(tc); len(mutating) != 0 {
+		t.Errorf("expected no changes to Authentik, got %v", mutating)
+	}
+
+	// Targets are still resolved, so changes that cannot be made fail like they would for real
+	var errResp Error
+	decode(t, tc.do(http.MethodPost, appPath("/groups/missing/member-groups"), `{"group_id":"platform","app_id":"`+testAppID+`"}`), http.StatusNotFound, &errResp)
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"42","app_id":"`+testAppID+`"}`), http.StatusNotFound, &errResp)
+
+	entries := tc.auditEntries()
+	if len(entries) != 4 || entries[0].MemberGroupName != "Platform" || entries[3].Outcome != AuditOutcomeFailure {
+		t.Fatalf("unexpected audit entries %+v", entries)
+	}
+}
+
+func TestGroupResourcesAreEmpty(t *testing.T) {
+	tc := newTestConnector(t, "")
+
+	var resp GroupResourcesResponse
+	decode(t, tc.do(http.MethodGet, appPath("/groups/eng/resources"), ""), http.StatusOK, &resp)
+	if len(resp.Resources) != 0 {
+		t.Fatalf("expected no resources, got %+v", resp.Resources)
+	}
+}
+
+func TestGuardrailsLookUpTargetsOnce(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "membership.yaml"), []byte(testPolicies), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tc := newTestConnector(t, "eligibility:\n  require_active: true\n"+sodConfig+
+		"policies:\n  paths: ["+dir+"]\n"+removalLimitConfig(t, "  max: 5\n"))
+	seedGroups(tc)
+
+	lookups := func() (group int, user int) {
+		for _, request := range tc.authentik.Requests() {
+			switch request {
+			case "GET /api/v3/core/groups/eng/":
+				group++
+			case "GET /api/v3/core/users/2/":
+				user++
+			}
+		}
+		return group, user
+	}
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	if group, user := lookups(); group != 1 || user != 1 {
+		t.Errorf("expected the group and user to be looked up once for every check, got %d and %d lookups", group, user)
+	}
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/2"), ""), http.StatusOK, nil)
+	if group, user := lookups(); group != 2 || user != 2 {
+		t.Errorf("expected the group and user to be looked up once for the removal, got %d and %d lookups", group, user)
+	}
+}
@@ -10,6 +10,8 @@
 package openapi
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -18,6 +20,15 @@ type StatusAPI struct {
 
 // Get /status
 func (api *StatusAPI) GetStatus(c *gin.Context) {
-	// Your handler implementation
-	c.JSON(200, gin.H{"status": "OK"})
+	config, err := getConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
+		return
+	}
+
+	// Lets Opal operators see why changes are refused without reading the connector's configuration
+	c.JSON(http.StatusOK, gin.H{
+		"status":                "OK",
+		"disabled_capabilities": config.Capabilities.Disabled(),
+	})
 }
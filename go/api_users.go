@@ -23,13 +23,13 @@ type UsersAPI struct {
 
 // Get /users
 func (api *UsersAPI) GetUsers(c *gin.Context) {
-	authentik, err := NewAuthentikClient()
+	authentik, err := newAuthentikClientFromCtx(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
 		return
 	}
 
-	authentikUsers, nextCursor, err := authentik.PaginatedListUsers(c)
+	authentikUsers, nextCursor, err := authentik.PaginatedListUsers(c.Request.Context(), c.Query(PageQueryParam))
 	if err != nil {
 		var clientErr *ClientError
 		if errors.As(err, &clientErr) {
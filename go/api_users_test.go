@@ -0,0 +1,53 @@
+package openapi
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+func TestGetUsersFollowsCursorToTheLastPage(t *testing.T) {
+	tc := newTestConnector(t, "")
+	for pk := int32(1); pk <= 150; pk++ {
+		tc.authentik.AddUser(authentiktest.User{
+			Pk:       pk,
+			Username: "user" + strconv.Itoa(int(pk)),
+			Email:    "user" + strconv.Itoa(int(pk)) + "@example.com",
+		})
+	}
+
+	var first UsersResponse
+	decode(t, tc.do(http.MethodGet, appPath("/users"), ""), http.StatusOK, &first)
+	if len(first.Users) != DefaultPageSize {
+		t.Fatalf("expected %d users on the first page, got %d", DefaultPageSize, len(first.Users))
+	}
+	if first.NextCursor == nil || *first.NextCursor != "2" {
+		t.Fatalf("expected next cursor 2, got %v", first.NextCursor)
+	}
+
+	var second UsersResponse
+	decode(t, tc.do(http.MethodGet, appPath("/users?cursor=2"), ""), http.StatusOK, &second)
+	if len(second.Users) != 50 {
+		t.Fatalf("expected 50 users on the last page, got %d", len(second.Users))
+	}
+	if second.NextCursor == nil || *second.NextCursor != "" {
+		t.Fatalf("expected an empty cursor on the last page, got %v", second.NextCursor)
+	}
+	if last := second.Users[len(second.Users)-1]; last.Id != "150" || last.Email != "user150@example.com" {
+		t.Fatalf("unexpected last user %+v", last)
+	}
+}
+
+func TestGetUsersSkipsUsersWithoutEmail(t *testing.T) {
+	tc := newTestConnector(t, "")
+	tc.authentik.AddUser(authentiktest.User{Pk: 1, Username: "alice", Email: "alice@example.com"})
+	tc.authentik.AddUser(authentiktest.User{Pk: 2, Username: "service-account"})
+
+	var resp UsersResponse
+	decode(t, tc.do(http.MethodGet, appPath("/users"), ""), http.StatusOK, &resp)
+	if len(resp.Users) != 1 || resp.Users[0].Id != "1" {
+		t.Fatalf("expected only alice, got %+v", resp.Users)
+	}
+}
@@ -0,0 +1,506 @@
+package openapi
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	authentik "goauthentik.io/api/v3"
+)
+
+const (
+	AuditLogFileEnvKey       = "AUDIT_LOG_FILE"
+	AuditLogMaxBytesEnvKey   = "AUDIT_LOG_MAX_BYTES"
+	AuditLogSyslogAddrEnvKey = "AUDIT_LOG_SYSLOG_ADDR"
+	AuditLogSyslogNetEnvKey  = "AUDIT_LOG_SYSLOG_NETWORK"
+	AuditLogHTTPURLEnvKey    = "AUDIT_LOG_HTTP_URL"
+	AuditLogHTTPTokenEnvKey  = "AUDIT_LOG_HTTP_TOKEN"
+)
+
+// Setting AUDIT_LOG_SYSLOG_ADDR to this value logs to the local syslog daemon
+const auditSyslogLocal = "local"
+
+const (
+	AuditOperationAddUserToGroup       = "add_user_to_group"
+	AuditOperationRemoveUserFromGroup  = "remove_user_from_group"
+	AuditOperationAddGroupToGroup      = "add_group_to_group"
+	AuditOperationRemoveGroupFromGroup = "remove_group_from_group"
+)
+
+// Source of changes made by the reconcile command rather than Opal
+const AuditSourceReconcile = "reconcile"
+
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// The hash the first entry of a fresh audit log chains from
+const auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Authentik error bodies can be large HTML pages, only keep the start of them
+const maxAuditResponseLength = 2048
+
+// AuditEntry is a single record in the audit log. Entries are hash-chained: Hash covers
+// the entry itself and PrevHash, so removing, reordering or editing an entry breaks the chain.
+type AuditEntry struct {
+	Sequence uint64 `json:"sequence"`
+	Time     string `json:"time"`
+
+	// Opal request context
+	OpalTimestamp string `json:"opal_timestamp,omitempty"`
+	OpalSignature string `json:"opal_signature,omitempty"`
+	AppID         string `json:"app_id,omitempty"`
+	// Where the change came from when not from Opal, e.g. "reconcile"
+	Source string `json:"source,omitempty"`
+
+	Operation string `json:"operation"`
+	// Set when the change was only simulated, see DryRunHeader
+	DryRun bool `json:"dry_run,omitempty"`
+
+	GroupID         string `json:"group_id"`
+	GroupName       string `json:"group_name,omitempty"`
+	UserID          string `json:"user_id,omitempty"`
+	UserName        string `json:"user_name,omitempty"`
+	UserEmail       string `json:"user_email,omitempty"`
+	MemberGroupID   string `json:"member_group_id,omitempty"`
+	MemberGroupName string `json:"member_group_name,omitempty"`
+	// Revoked after a removal, see RevocationConfig
+	SessionsRevoked     int `json:"sessions_revoked,omitempty"`
+	AppPasswordsExpired int `json:"app_passwords_expired,omitempty"`
+	// Why revoking failed after a successful removal, which Opal retries
+	RevocationError string `json:"revocation_error,omitempty"`
+	// Set when Opal retried a removal that was already made, so only the revocation was repeated
+	RevocationRetry bool `json:"revocation_retry,omitempty"`
+
+	AuthentikStatus   int    `json:"authentik_status,omitempty"`
+	AuthentikResponse string `json:"authentik_response,omitempty"`
+	Outcome           string `json:"outcome"`
+	Error             string `json:"error,omitempty"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// computeHash returns the chain hash of the entry, which is independent of the current value of Hash
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	serialized, err := json.Marshal(e)
+	if err != nil {
+		return "", errors.Wrap(err, "error serializing audit entry")
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(e.PrevHash))
+	hash.Write(serialized)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// AuditSink is a destination for audit entries. Sinks receive entries that are already chained,
+// together with their serialized form, and must not modify them.
+type AuditSink interface {
+	Write(entry *AuditEntry, line []byte) error
+	Close() error
+}
+
+// auditChainHead is implemented by sinks that persist entries and can report where the chain left off,
+// so that restarting the connector continues the existing chain instead of starting a new one.
+type auditChainHead interface {
+	LastEntry() (*AuditEntry, error)
+}
+
+type AuditLogger struct {
+	mu       sync.Mutex
+	sinks    []AuditSink
+	sequence uint64
+	lastHash string
+}
+
+func NewAuditLogger(sinks ...AuditSink) (*AuditLogger, error) {
+	logger := &AuditLogger{
+		sinks:    sinks,
+		lastHash: auditGenesisHash,
+	}
+
+	for _, sink := range sinks {
+		head, ok := sink.(auditChainHead)
+		if !ok {
+			continue
+		}
+
+		last, err := head.LastEntry()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read the head of the audit log chain")
+		}
+		if last != nil && last.Sequence >= logger.sequence {
+			logger.sequence = last.Sequence
+			logger.lastHash = last.Hash
+		}
+	}
+
+	return logger, nil
+}
+
+// NewAuditLoggerFromConfig builds an audit logger with every sink that is configured.
+// It returns nil when no sink is configured. Only the file sink is read back on start, so without
+// one the chain starts again from the genesis hash after a restart.
+func NewAuditLoggerFromConfig(appConfig *Config) (*AuditLogger, error) {
+	config := appConfig.Audit
+	sinks := make([]AuditSink, 0)
+
+	if config.File != "" {
+		sink, err := NewFileAuditSink(config.File, config.MaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if config.SyslogAddr != "" {
+		network, addr := config.SyslogNetwork, config.SyslogAddr
+		if addr == auditSyslogLocal {
+			network, addr = "", ""
+		}
+
+		sink, err := NewSyslogAuditSink(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// A remote syslog server can be slow, the local daemon is not
+		if network != "" {
+			sinks = append(sinks, newAsyncAuditSink(sink, auditQueueSize))
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+
+	if config.HTTPURL != "" {
+		sinks = append(sinks, newAsyncAuditSink(NewHTTPAuditSink(config.HTTPURL, func() (string, error) {
+			return appConfig.ResolveSecret(config.HTTPToken)
+		}), auditQueueSize))
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	return NewAuditLogger(sinks...)
+}
+
+var (
+	auditLoggerOnce sync.Once
+	auditLogger     *AuditLogger
+)
+
+// getAuditLogger returns the process wide audit logger, or nil if auditing is disabled
+func getAuditLogger() *AuditLogger {
+	auditLoggerOnce.Do(func() {
+		config, err := getConfig()
+		if err != nil {
+			log.Fatalf("Unable to set up audit log: %v", err)
+		}
+		logger, err := NewAuditLoggerFromConfig(config)
+		if err != nil {
+			log.Fatalf("Unable to set up audit log: %v", err)
+		}
+		auditLogger = logger
+	})
+
+	return auditLogger
+}
+
+// SetAuditLogger replaces the process wide audit logger
+func SetAuditLogger(logger *AuditLogger) {
+	auditLoggerOnce.Do(func() {})
+	auditLogger = logger
+}
+
+// Record chains the entry onto the log and writes it to every sink. A sink failing does not stop
+// the entry from reaching the other sinks, but the first error is returned. Network sinks only
+// queue the entry here, see asyncAuditSink.
+func (l *AuditLogger) Record(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Sequence = l.sequence + 1
+	if entry.Time == "" {
+		entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	entry.PrevHash = l.lastHash
+
+	hash, err := entry.computeHash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "error serializing audit entry")
+	}
+
+	l.sequence = entry.Sequence
+	l.lastHash = entry.Hash
+
+	var firstErr error
+	for _, sink := range l.sinks {
+		if err := sink.Write(&entry, line); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (l *AuditLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var firstErr error
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// newAuditEntry fills in the Opal request context of an audit entry
+func newAuditEntry(options ChangeOptions, operation string) AuditEntry {
+	return AuditEntry{
+		OpalTimestamp: options.OpalTimestamp,
+		OpalSignature: options.OpalSignature,
+		AppID:         options.AppID,
+		Source:        options.Source,
+		Operation:     operation,
+	}
+}
+
+// setAuditOutcome records how Authentik answered a mutation
+func setAuditOutcome(entry *AuditEntry, resp *http.Response, err error) {
+	entry.Outcome = AuditOutcomeSuccess
+	if resp != nil {
+		entry.AuthentikStatus = resp.StatusCode
+		entry.AuthentikResponse = resp.Status
+	}
+	if err == nil {
+		return
+	}
+
+	entry.Outcome = AuditOutcomeFailure
+	entry.Error = err.Error()
+
+	var apiErr *authentik.GenericOpenAPIError
+	if errors.As(err, &apiErr) && len(apiErr.Body()) > 0 {
+		entry.AuthentikResponse = truncate(string(apiErr.Body()), maxAuditResponseLength)
+	}
+}
+
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+
+	return s[:length]
+}
+
+// AuditVerificationError describes the first entry at which an audit log chain is broken
+type AuditVerificationError struct {
+	Path   string
+	Line   int
+	Reason string
+}
+
+func (e *AuditVerificationError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Reason)
+}
+
+// AuditAnchor is the last entry of an earlier verification, which the verified files must continue.
+// It lets the files before them be archived without hiding that the head of the chain was cut off.
+type AuditAnchor struct {
+	Sequence uint64
+	Hash     string
+}
+
+// ParseAuditAnchor parses an anchor written as "<sequence>:<hash>", the way audit verify prints it
+func ParseAuditAnchor(s string) (*AuditAnchor, error) {
+	sequence, hash, ok := strings.Cut(s, ":")
+	number, err := strconv.ParseUint(sequence, 10, 64)
+	if !ok || err != nil || len(hash) != len(auditGenesisHash) {
+		return nil, errors.Errorf("audit anchor %q must be <sequence>:<hash>", s)
+	}
+
+	return &AuditAnchor{Sequence: number, Hash: hash}, nil
+}
+
+func (a *AuditAnchor) String() string {
+	return fmt.Sprintf("%d:%s", a.Sequence, a.Hash)
+}
+
+// AuditVerification describes a verified audit log chain
+type AuditVerification struct {
+	Entries int
+	// Last verified entry, to anchor the next verification, nil without entries
+	Head *AuditAnchor
+	// Set when the chain neither starts at the first entry ever written nor continues an anchor, so
+	// entries before it may have been removed unnoticed
+	Partial bool
+}
+
+// VerifyAuditLog checks the hash chain across the given audit log files, which must be passed
+// oldest first (rotated files before the active one). Without an anchor, the chain must start at
+// the first entry ever written to be verified in full. The result counts the verified entries, also
+// when an error is returned.
+func VerifyAuditLog(paths []string, anchor *AuditAnchor) (*AuditVerification, error) {
+	result := &AuditVerification{Head: anchor}
+	var prev *AuditEntry
+	if anchor != nil {
+		prev = &AuditEntry{Sequence: anchor.Sequence, Hash: anchor.Hash}
+	}
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return result, errors.Wrapf(err, "unable to open audit log %s", path)
+		}
+
+		count, first, last, err := verifyAuditChain(path, file, prev)
+		file.Close()
+		if prev == nil && first != nil && first.Sequence != 1 {
+			result.Partial = true
+		}
+		result.Entries += count
+		if last != nil {
+			result.Head = &AuditAnchor{Sequence: last.Sequence, Hash: last.Hash}
+		}
+		if err != nil {
+			return result, err
+		}
+		prev = last
+	}
+
+	return result, nil
+}
+
+// verifyAuditChain checks the entries of one file continue prev, returning the first and last
+// verified entries
+func verifyAuditChain(path string, r io.Reader, prev *AuditEntry) (int, *AuditEntry, *AuditEntry, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	verified := 0
+	var first *AuditEntry
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return verified, first, prev, &AuditVerificationError{Path: path, Line: lineNumber, Reason: "entry is not valid JSON"}
+		}
+
+		if prev == nil {
+			if entry.Sequence == 1 && entry.PrevHash != auditGenesisHash {
+				return verified, first, prev, &AuditVerificationError{Path: path, Line: lineNumber, Reason: "first entry does not chain from the genesis hash"}
+			}
+		} else {
+			if entry.Sequence != prev.Sequence+1 {
+				return verified, first, prev, &AuditVerificationError{
+					Path:   path,
+					Line:   lineNumber,
+					Reason: fmt.Sprintf("expected sequence %d, found %d", prev.Sequence+1, entry.Sequence),
+				}
+			}
+			if entry.PrevHash != prev.Hash {
+				return verified, first, prev, &AuditVerificationError{Path: path, Line: lineNumber, Reason: "previous hash does not match the preceding entry"}
+			}
+		}
+
+		hash, err := entry.computeHash()
+		if err != nil {
+			return verified, first, prev, err
+		}
+		if hash != entry.Hash {
+			return verified, first, prev, &AuditVerificationError{Path: path, Line: lineNumber, Reason: "entry hash does not match its contents"}
+		}
+
+		verified++
+		prev = &entry
+		if first == nil {
+			first = &entry
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return verified, first, prev, errors.Wrapf(err, "unable to read audit log %s", path)
+	}
+
+	return verified, first, prev, nil
+}
+
+// recordMembershipChange writes a membership change to the audit log and, once it has succeeded,
+// to Authentik's own event log. Names are resolved on a best effort basis: the change is recorded
+// even if a lookup fails.
+func (c *AuthentikClient) recordMembershipChange(ctx context.Context, entry AuditEntry, options ChangeOptions, resp *http.Response, err error) {
+	logger := getAuditLogger()
+	// Mirroring into Authentik's event log needs the "Can add Event" permission, so it is opt-in per instance
+	createEvent := err == nil && !entry.DryRun && !entry.RevocationRetry && c.backend.Authentik.Events
+	if logger == nil && !createEvent {
+		return
+	}
+
+	c.resolveAuditNames(ctx, &entry)
+	setAuditOutcome(&entry, resp, err)
+
+	if logger != nil {
+		if auditErr := logger.Record(entry); auditErr != nil {
+			log.Printf("Failed to write audit entry for %s on group %s: %v", entry.Operation, entry.GroupID, auditErr)
+		}
+	}
+
+	if createEvent {
+		if eventErr := c.createOpalEvent(ctx, entry, options.ClientIP); eventErr != nil {
+			log.Printf("Failed to create Authentik event for %s on group %s: %v", entry.Operation, entry.GroupID, eventErr)
+		}
+	}
+}
+
+// resolveAuditNames looks up the names a change failed before resolving, such as when the group does
+// not exist and the user was never looked up
+func (c *AuthentikClient) resolveAuditNames(ctx context.Context, entry *AuditEntry) {
+	if entry.GroupName == "" {
+		if group, lookupErr := c.GetGroup(ctx, entry.GroupID); lookupErr == nil {
+			entry.GroupName = group.GetName()
+		}
+	}
+	if entry.MemberGroupID != "" && entry.MemberGroupName == "" {
+		if group, lookupErr := c.GetGroup(ctx, entry.MemberGroupID); lookupErr == nil {
+			entry.MemberGroupName = group.GetName()
+		}
+	}
+	if entry.UserID != "" && entry.UserName == "" {
+		if userPK, convErr := strconv.Atoi(entry.UserID); convErr == nil {
+			if user, lookupErr := c.GetUser(ctx, int32(userPK)); lookupErr == nil {
+				entry.UserName = user.GetUsername()
+				entry.UserEmail = user.GetEmail()
+			}
+		}
+	}
+}
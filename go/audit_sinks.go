@@ -0,0 +1,266 @@
+package openapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const auditHTTPTimeout = 10 * time.Second
+
+const (
+	// Entries waiting for a network sink, beyond which new entries are dropped
+	auditQueueSize = 1000
+	// How long closing waits for queued entries to be sent
+	auditDrainTimeout = 15 * time.Second
+)
+
+// FileAuditSink appends entries to a file as JSON lines. When maxBytes is set the file is rotated
+// once it grows past that size: it is renamed with a timestamp suffix and a new file is started.
+// The chain continues across rotated files.
+type FileAuditSink struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+}
+
+func NewFileAuditSink(path string, maxBytes int64) (*FileAuditSink, error) {
+	sink := &FileAuditSink{path: path, maxBytes: maxBytes}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (s *FileAuditSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open audit log %s", s.path)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "unable to stat audit log %s", s.path)
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileAuditSink) Write(entry *AuditEntry, line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line))+1 > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "unable to write to audit log %s", s.path)
+	}
+
+	// Entries are few and must survive a crash, so flush each one to disk
+	return s.file.Sync()
+}
+
+func (s *FileAuditSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return errors.Wrapf(err, "unable to close audit log %s", s.path)
+	}
+
+	rotatedPath := fmt.Sprintf("%s.%s", s.path, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := os.Rename(s.path, rotatedPath); err != nil {
+		return errors.Wrapf(err, "unable to rotate audit log %s", s.path)
+	}
+
+	return s.open()
+}
+
+// LastEntry returns the last entry in the active file, or nil if the file is empty
+func (s *FileAuditSink) LastEntry() (*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open audit log %s", s.path)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var lastLine string
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lastLine = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "unable to read audit log %s", s.path)
+	}
+	if lastLine == "" {
+		return nil, nil
+	}
+
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(lastLine), &entry); err != nil {
+		return nil, errors.Wrapf(err, "last entry of audit log %s is corrupt", s.path)
+	}
+
+	return &entry, nil
+}
+
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// SyslogAuditSink forwards entries to syslog. An empty network and address use the local daemon.
+type SyslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogAuditSink(network string, addr string) (*SyslogAuditSink, error) {
+	writer, err := syslog.Dial(network, addr, syslog.LOG_NOTICE|syslog.LOG_AUTH, "opal-authentik-connector")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to syslog")
+	}
+
+	return &SyslogAuditSink{writer: writer}, nil
+}
+
+func (s *SyslogAuditSink) Write(entry *AuditEntry, line []byte) error {
+	if entry.Outcome == AuditOutcomeFailure {
+		return s.writer.Warning(string(line))
+	}
+
+	return s.writer.Notice(string(line))
+}
+
+func (s *SyslogAuditSink) Close() error {
+	return s.writer.Close()
+}
+
+// HTTPAuditSink POSTs each entry as JSON to a collector URL, optionally with a bearer token
+type HTTPAuditSink struct {
+	url string
+	// Looked up for every entry, so a rotated token takes effect without a restart
+	token  func() (string, error)
+	client *http.Client
+}
+
+func NewHTTPAuditSink(url string, token func() (string, error)) *HTTPAuditSink {
+	return &HTTPAuditSink{
+		url:    url,
+		token:  token,
+		client: &http.Client{Timeout: auditHTTPTimeout},
+	}
+}
+
+func (s *HTTPAuditSink) Write(entry *AuditEntry, line []byte) error {
+	token, err := s.token()
+	if err != nil {
+		return errors.Wrap(err, "unable to read the audit collector token")
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(line))
+	if err != nil {
+		return errors.Wrap(err, "unable to build audit log request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "unable to send audit entry")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("audit collector rejected entry %d with status %s", entry.Sequence, resp.Status)
+	}
+
+	return nil
+}
+
+func (s *HTTPAuditSink) Close() error {
+	return nil
+}
+
+type queuedAuditEntry struct {
+	entry AuditEntry
+	line  []byte
+}
+
+// asyncAuditSink hands entries to a network sink through a bounded queue, so a slow or unreachable
+// collector does not hold up membership changes. Entries are sent in order by a single goroutine.
+// When the queue is full, entries are dropped and the failure is reported like a failed write.
+type asyncAuditSink struct {
+	sink  AuditSink
+	queue chan queuedAuditEntry
+	done  chan struct{}
+}
+
+func newAsyncAuditSink(sink AuditSink, size int) *asyncAuditSink {
+	s := &asyncAuditSink{
+		sink:  sink,
+		queue: make(chan queuedAuditEntry, size),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+
+	return s
+}
+
+func (s *asyncAuditSink) run() {
+	defer close(s.done)
+	for queued := range s.queue {
+		if err := s.sink.Write(&queued.entry, queued.line); err != nil {
+			log.Printf("Failed to send audit entry %d: %v", queued.entry.Sequence, err)
+		}
+	}
+}
+
+func (s *asyncAuditSink) Write(entry *AuditEntry, line []byte) error {
+	select {
+	case s.queue <- queuedAuditEntry{entry: *entry, line: line}:
+		return nil
+	default:
+		return errors.Errorf("audit queue is full, dropped entry %d", entry.Sequence)
+	}
+}
+
+// Close sends the queued entries, giving up after auditDrainTimeout
+func (s *asyncAuditSink) Close() error {
+	close(s.queue)
+	select {
+	case <-s.done:
+	case <-time.After(auditDrainTimeout):
+		log.Printf("Gave up sending %d queued audit entries", len(s.queue))
+	}
+
+	return s.sink.Close()
+}
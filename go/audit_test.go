@@ -0,0 +1,271 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestAuditHTTPSinkDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan AuditEntry, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if auth := r.Header.Get("Authorization"); auth != "Bearer collector-token" {
+			t.Errorf("expected the resolved collector token, got %q", auth)
+		}
+		var entry AuditEntry
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			t.Errorf("unable to decode audit entry: %v", err)
+		}
+		received <- entry
+	}))
+	defer collector.Close()
+
+	// The token is a secret reference like any other
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("collector-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Audit:   AuditConfig{HTTPURL: collector.URL, HTTPToken: "file:" + tokenFile},
+		secrets: NewSecretResolver(SecretsConfig{}),
+	}
+	logger, err := NewAuditLoggerFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := logger.Record(AuditEntry{Operation: AuditOperationAddUserToGroup, GroupID: "eng"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected recording not to wait for the collector, took %s", elapsed)
+	}
+
+	close(release)
+	for want := uint64(1); want <= 3; want++ {
+		select {
+		case entry := <-received:
+			if entry.Sequence != want {
+				t.Errorf("expected entry %d to be sent in order, got %d", want, entry.Sequence)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected entry %d to be sent", want)
+		}
+	}
+	if err := logger.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	blocked := &blockingAuditSink{release: release}
+	sink := newAsyncAuditSink(blocked, 1)
+
+	// The first entry is being written, the second waits in the queue and the third is dropped
+	sink.Write(&AuditEntry{Sequence: 1}, []byte("{}"))
+	time.Sleep(50 * time.Millisecond)
+	sink.Write(&AuditEntry{Sequence: 2}, []byte("{}"))
+	if err := sink.Write(&AuditEntry{Sequence: 3}, []byte("{}")); err == nil || !strings.Contains(err.Error(), "dropped entry 3") {
+		t.Errorf("expected the entry to be dropped, got %v", err)
+	}
+
+	close(release)
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if blocked.written != 2 {
+		t.Errorf("expected the queued entries to be written before closing, got %d", blocked.written)
+	}
+}
+
+type blockingAuditSink struct {
+	release chan struct{}
+	written int
+}
+
+func (s *blockingAuditSink) Write(entry *AuditEntry, line []byte) error {
+	<-s.release
+	s.written++
+	return nil
+}
+
+func (s *blockingAuditSink) Close() error {
+	return nil
+}
+
+// writeAuditLog records entries to a file rotated every few entries, returning the files oldest first
+func writeAuditLog(t *testing.T, entries int) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := NewAuditLogger(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < entries; i++ {
+		if err := logger.Record(AuditEntry{Operation: AuditOperationAddUserToGroup, GroupID: "eng", UserID: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(rotated)
+	return append(rotated, path)
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(contents)), "\n")
+}
+
+func writeLines(t *testing.T, path string, lines []string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAuditLogAcrossRotation(t *testing.T) {
+	files := writeAuditLog(t, 20)
+	if len(files) < 3 {
+		t.Fatalf("expected the log to be rotated, got %v", files)
+	}
+
+	result, err := VerifyAuditLog(files, nil)
+	if err != nil || result.Partial || result.Entries != 20 || result.Head.Sequence != 20 {
+		t.Fatalf("expected the whole chain to verify, got %+v, %v", result, err)
+	}
+
+	// Restarting continues the chain
+	sink, err := NewFileAuditSink(files[len(files)-1], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := NewAuditLogger(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Record(AuditEntry{Operation: AuditOperationRemoveUserFromGroup, GroupID: "eng"})
+	logger.Close()
+	if result, err := VerifyAuditLog(files, nil); err != nil || result.Entries != 21 {
+		t.Errorf("expected the restarted chain to verify, got %+v, %v", result, err)
+	}
+
+	// Files passed out of order break the chain
+	swapped := append([]string{files[1], files[0]}, files[2:]...)
+	if _, err := VerifyAuditLog(swapped, nil); err == nil {
+		t.Error("expected files out of order to fail verification")
+	}
+}
+
+func TestVerifyAuditLogTampering(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		change func(lines []string) []string
+		reason string
+	}{
+		{"edited entry", func(lines []string) []string {
+			lines[2] = strings.Replace(lines[2], `"group_id":"eng"`, `"group_id":"admins"`, 1)
+			return lines
+		}, "entry hash does not match its contents"},
+		{"reordered entries", func(lines []string) []string {
+			lines[2], lines[3] = lines[3], lines[2]
+			return lines
+		}, "expected sequence 3, found 4"},
+		{"removed entry", func(lines []string) []string {
+			return append(lines[:2], lines[3:]...)
+		}, "expected sequence 3, found 4"},
+		{"forged first entry", func(lines []string) []string {
+			var entry AuditEntry
+			json.Unmarshal([]byte(lines[0]), &entry)
+			entry.PrevHash = strings.Repeat("1", len(auditGenesisHash))
+			entry.Hash, _ = entry.computeHash()
+			line, _ := json.Marshal(entry)
+			lines[0] = string(line)
+			return lines
+		}, "first entry does not chain from the genesis hash"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			files := writeAuditLog(t, 5)
+			path := files[len(files)-1]
+			writeLines(t, path, test.change(readLines(t, path)))
+
+			_, err := VerifyAuditLog([]string{path}, nil)
+			var verifyErr *AuditVerificationError
+			if !errors.As(err, &verifyErr) || verifyErr.Reason != test.reason {
+				t.Errorf("expected %q, got %v", test.reason, err)
+			}
+		})
+	}
+}
+
+func TestVerifyAuditLogTruncation(t *testing.T) {
+	files := writeAuditLog(t, 20)
+	full, err := VerifyAuditLog(files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the first file the chain cannot be verified in full
+	result, err := VerifyAuditLog(files[1:], nil)
+	if err != nil || !result.Partial {
+		t.Errorf("expected a chain missing its head to be partial, got %+v, %v", result, err)
+	}
+
+	// Entries removed from the head of the active file are also partial
+	path := files[len(files)-1]
+	writeLines(t, path, readLines(t, path)[1:])
+	if result, err := VerifyAuditLog([]string{path}, nil); err != nil || !result.Partial {
+		t.Errorf("expected a truncated file to be partial, got %+v, %v", result, err)
+	}
+
+	// With the head of the verification that covered the first file, the rest verifies in full
+	files = writeAuditLog(t, 20)
+	first, err := VerifyAuditLog(files[:1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchor, err := ParseAuditAnchor(first.Head.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := VerifyAuditLog(files[1:], anchor); err != nil || result.Partial || result.Head.Sequence != full.Head.Sequence {
+		t.Errorf("expected the anchored chain to verify, got %+v, %v", result, err)
+	}
+
+	// A missing file in the middle breaks the chain, and so does a file that does not follow the anchor
+	if _, err := VerifyAuditLog(append(files[:1:1], files[2:]...), nil); err == nil {
+		t.Error("expected a missing file to fail verification")
+	}
+	if _, err := VerifyAuditLog(files[2:], anchor); err == nil {
+		t.Error("expected files not continuing the anchor to fail verification")
+	}
+}
@@ -0,0 +1,1005 @@
+// Package authentiktest provides an in-memory fake of the parts of the Authentik API the connector
+// uses, for tests that should not need a live Authentik instance.
+package authentiktest
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	authentik "goauthentik.io/api/v3"
+)
+
+const apiPrefix = "/api/v3/"
+
+// Version the fake reports through the admin API
+const Version = "2024.8.3"
+
+// User is a user stored in the fake
+type User struct {
+	Pk       int32
+	Username string
+	Name     string
+	Email    string
+	// Global permissions as "<app_label>.<codename>", e.g. "authentik_core.view_user"
+	Permissions    []string
+	ServiceAccount bool
+	Inactive       bool
+	// Defaults to internal, or service_account for service accounts
+	Type       string
+	Attributes map[string]interface{}
+	Devices    []Device
+	// UUIDs of the user's authenticated sessions
+	Sessions []string
+}
+
+// Device is an authenticator enrolled by a user
+type Device struct {
+	// Django label of the device model, e.g. "authentik_stages_authenticator_totp.TOTPDevice"
+	Type      string
+	Confirmed bool
+}
+
+// Token is an API token stored in the fake. Requests authenticated with its key are accepted.
+type Token struct {
+	Identifier string
+	Key        string
+	User       int32
+	Intent     string
+	Expiring   bool
+	// Expiring tokens are rejected once this time has passed, never when it is zero
+	Expires time.Time
+}
+
+// Permissions the fake knows about, ordered by their IDs. Assigning any other permission fails.
+var knownPermissions = []string{
+	"authentik_core.view_user",
+	"authentik_core.add_user",
+	"authentik_core.change_user",
+	"authentik_core.view_group",
+	"authentik_core.change_group",
+	"authentik_core.add_user_to_group",
+	"authentik_core.remove_user_from_group",
+	"authentik_core.view_token",
+	"authentik_core.add_token",
+	"authentik_core.change_token",
+	"authentik_core.view_authenticatedsession",
+	"authentik_core.delete_authenticatedsession",
+	"authentik_events.view_event",
+	"authentik_events.add_event",
+	"authentik_stages_authenticator_duo.view_duodevice",
+	"authentik_stages_authenticator_sms.view_smsdevice",
+	"authentik_stages_authenticator_totp.view_totpdevice",
+	"authentik_stages_authenticator_webauthn.view_webauthndevice",
+}
+
+// Group is a group stored in the fake. Parent is the primary key of the parent group, if any.
+type Group struct {
+	Pk          string
+	Name        string
+	Parent      string
+	Users       []int32
+	IsSuperuser bool
+	Attributes  map[string]interface{}
+}
+
+// Failure makes matching requests fail with Status, after waiting for Latency. A Failure with only
+// a Latency slows requests down without failing them.
+type Failure struct {
+	// HTTP method to match, any method when empty
+	Method string
+	// Path prefix to match, e.g. "/api/v3/core/groups/", any path when empty
+	Path    string
+	Status  int
+	Latency time.Duration
+	// Number of requests the failure applies to, every request when 0
+	Times int
+}
+
+func (f *Failure) matches(r *http.Request) bool {
+	return (f.Method == "" || f.Method == r.Method) && strings.HasPrefix(r.URL.Path, f.Path)
+}
+
+// Server is a fake Authentik instance serving over HTTP on a local port
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	token    string
+	users    map[int32]*User
+	groups   map[string]*Group
+	tokens   map[string]*Token
+	events   []map[string]interface{}
+	failures []*Failure
+	requests []string
+}
+
+// NewServer starts a fake that accepts the given API token. Close it when done.
+func NewServer(token string) *Server {
+	s := &Server{
+		token:  token,
+		users:  make(map[int32]*User),
+		groups: make(map[string]*Group),
+		tokens: make(map[string]*Token),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// Host returns the host and port to configure as the Authentik host, the scheme is http
+func (s *Server) Host() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func (s *Server) AddUser(user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user.Permissions = append([]string(nil), user.Permissions...)
+	user.Sessions = append([]string(nil), user.Sessions...)
+	s.users[user.Pk] = &user
+}
+
+// User returns a copy of the user as currently stored
+func (s *Server) User(pk int32) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[pk]
+	if !ok {
+		return User{}, false
+	}
+	copied := *user
+	copied.Permissions = append([]string(nil), user.Permissions...)
+	copied.Sessions = append([]string(nil), user.Sessions...)
+
+	return copied, true
+}
+
+// UserByUsername returns a copy of the user with the given username
+func (s *Server) UserByUsername(username string) (User, bool) {
+	s.mu.Lock()
+	pk, ok := int32(0), false
+	for _, user := range s.users {
+		if user.Username == username {
+			pk, ok = user.Pk, true
+		}
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return User{}, false
+	}
+	return s.User(pk)
+}
+
+// AddToken stores an API token, which is then accepted like the token the fake was started with
+func (s *Server) AddToken(token Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[token.Identifier] = &token
+}
+
+// Token returns a copy of the token with the given identifier
+func (s *Server) Token(identifier string) (Token, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[identifier]
+	if !ok {
+		return Token{}, false
+	}
+	return *token, true
+}
+
+func (s *Server) AddGroup(group Group) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group.Users = append([]int32(nil), group.Users...)
+	s.groups[group.Pk] = &group
+}
+
+// Group returns a copy of the group as currently stored
+func (s *Server) Group(pk string) (Group, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[pk]
+	if !ok {
+		return Group{}, false
+	}
+	copied := *group
+	copied.Users = append([]int32(nil), group.Users...)
+
+	return copied, true
+}
+
+// Fail scripts a failure. Failures are checked in the order they were added.
+func (s *Server) Fail(failure Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, &failure)
+}
+
+// ClearFailures removes every scripted failure
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = nil
+}
+
+// Requests returns every request received so far as "METHOD /path"
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+// Events returns the bodies of the events created through the events API
+func (s *Server) Events() []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]map[string]interface{}(nil), s.events...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	failure := s.takeFailure(r)
+	s.mu.Unlock()
+
+	if failure != nil {
+		time.Sleep(failure.Latency)
+		if failure.Status != 0 {
+			writeDetail(w, failure.Status, http.StatusText(failure.Status))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	// Like Authentik, the root config is served without authentication
+	if r.Method == http.MethodGet && match(segments, "root", "config") {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"capabilities": []string{}})
+		return
+	}
+
+	user, ok := s.authenticate(r.Header.Get("Authorization"))
+	if !ok {
+		writeDetail(w, http.StatusForbidden, "Token invalid/expired")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && match(segments, "core", "users", "me"):
+		s.getMe(w, user)
+	case r.Method == http.MethodGet && match(segments, "admin", "version"):
+		writeJSON(w, http.StatusOK, authentik.Version{VersionCurrent: Version, VersionLatest: Version, VersionLatestValid: true})
+	case r.Method == http.MethodGet && match(segments, "core", "users"):
+		s.listUsers(w, r)
+	case r.Method == http.MethodPost && match(segments, "core", "users", "service_account"):
+		s.createServiceAccount(w, r)
+	case r.Method == http.MethodGet && match(segments, "core", "users", "*"):
+		s.getUser(w, segments[2])
+	case r.Method == http.MethodPatch && match(segments, "core", "users", "*"):
+		s.patchUser(w, r, segments[2])
+	case r.Method == http.MethodGet && match(segments, "core", "groups"):
+		s.listGroups(w, r)
+	case r.Method == http.MethodGet && match(segments, "core", "groups", "*"):
+		s.getGroup(w, r, segments[2])
+	case r.Method == http.MethodPatch && match(segments, "core", "groups", "*"):
+		s.patchGroup(w, r, segments[2])
+	case r.Method == http.MethodGet && match(segments, "core", "groups", "*", "used_by"):
+		s.groupUsedBy(w, segments[2])
+	case r.Method == http.MethodPost && match(segments, "core", "groups", "*", "add_user"):
+		s.changeMembership(w, r, segments[2], true)
+	case r.Method == http.MethodPost && match(segments, "core", "groups", "*", "remove_user"):
+		s.changeMembership(w, r, segments[2], false)
+	case r.Method == http.MethodPost && match(segments, "events", "events"):
+		s.createEvent(w, r)
+	case r.Method == http.MethodGet && match(segments, "core", "authenticated_sessions"):
+		s.listSessions(w, r)
+	case r.Method == http.MethodDelete && match(segments, "core", "authenticated_sessions", "*"):
+		s.deleteSession(w, segments[2])
+	case r.Method == http.MethodGet && match(segments, "core", "tokens"):
+		s.listTokens(w, r)
+	case r.Method == http.MethodPost && match(segments, "core", "tokens"):
+		s.createToken(w, r)
+	case r.Method == http.MethodGet && match(segments, "core", "tokens", "*"):
+		s.getToken(w, segments[2])
+	case r.Method == http.MethodPatch && match(segments, "core", "tokens", "*"):
+		s.patchToken(w, r, segments[2])
+	case r.Method == http.MethodGet && match(segments, "core", "tokens", "*", "view_key"):
+		s.viewTokenKey(w, segments[2])
+	case r.Method == http.MethodGet && match(segments, "authenticators", "admin", "all"):
+		s.listDevices(w, r)
+	case r.Method == http.MethodGet && match(segments, "rbac", "permissions"):
+		s.listPermissions(w, r)
+	case r.Method == http.MethodPost && match(segments, "rbac", "permissions", "assigned_by_users", "*", "assign"):
+		s.assignPermissions(w, r, segments[3], true)
+	case r.Method == http.MethodPatch && match(segments, "rbac", "permissions", "assigned_by_users", "*", "unassign"):
+		s.assignPermissions(w, r, segments[3], false)
+	default:
+		writeDetail(w, http.StatusNotFound, "Not found.")
+	}
+}
+
+// authenticate returns the user owning the token in the Authorization header. The token the fake
+// was started with does not belong to any stored user.
+func (s *Server) authenticate(header string) (*User, bool) {
+	if header == "Bearer "+s.token {
+		return nil, true
+	}
+	for _, token := range s.tokens {
+		if token.Expiring && !token.Expires.IsZero() && !token.Expires.After(time.Now()) {
+			continue
+		}
+		if header == "Bearer "+token.Key {
+			return s.users[token.User], true
+		}
+	}
+
+	return nil, false
+}
+
+// takeFailure returns the first scripted failure matching the request and uses up one of its times
+func (s *Server) takeFailure(r *http.Request) *Failure {
+	for i, failure := range s.failures {
+		if !failure.matches(r) {
+			continue
+		}
+		if failure.Times > 0 {
+			failure.Times--
+			if failure.Times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return failure
+	}
+
+	return nil
+}
+
+// match compares path segments against a pattern, where "*" matches any single segment
+func match(segments []string, pattern ...string) bool {
+	if len(segments) != len(pattern) {
+		return false
+	}
+	for i := range pattern {
+		if pattern[i] != "*" && pattern[i] != segments[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *Server) getMe(w http.ResponseWriter, user *User) {
+	if user == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"user": map[string]interface{}{"pk": 0, "username": "opal-connector"},
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user": map[string]interface{}{"pk": user.Pk, "username": user.Username, "is_active": true},
+	})
+}
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	pks := make([]int, 0, len(s.users))
+	for pk := range s.users {
+		pks = append(pks, int(pk))
+	}
+	sort.Ints(pks)
+
+	username := r.URL.Query().Get("username")
+	users := make([]authentik.User, 0, len(pks))
+	for _, pk := range pks {
+		if user := s.users[int32(pk)]; username == "" || user.Username == username {
+			users = append(users, s.toUser(user))
+		}
+	}
+
+	start, end, pagination, ok := paginate(w, r.URL.Query(), len(users))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, authentik.PaginatedUserList{Pagination: pagination, Results: users[start:end]})
+}
+
+func (s *Server) getUser(w http.ResponseWriter, pk string) {
+	userPK, err := strconv.Atoi(pk)
+	if err != nil {
+		writeDetail(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	user, ok := s.users[int32(userPK)]
+	if !ok {
+		writeDetail(w, http.StatusNotFound, "No User matches the given query.")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.toUser(user))
+}
+
+// patchUser applies the attributes of a partial update, which is all the connector changes
+func (s *Server) patchUser(w http.ResponseWriter, r *http.Request, pk string) {
+	userPK, err := strconv.Atoi(pk)
+	user, ok := s.users[int32(userPK)]
+	if err != nil || !ok {
+		writeDetail(w, http.StatusNotFound, "No User matches the given query.")
+		return
+	}
+
+	var request authentik.PatchedUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeDetail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if request.Attributes != nil {
+		user.Attributes = request.Attributes
+	}
+
+	writeJSON(w, http.StatusOK, s.toUser(user))
+}
+
+// listDevices lists the authenticators of the user given by the user parameter
+func (s *Server) listDevices(w http.ResponseWriter, r *http.Request) {
+	devices := make([]authentik.Device, 0)
+	userPK, err := strconv.Atoi(r.URL.Query().Get("user"))
+	if user, ok := s.users[int32(userPK)]; err == nil && ok {
+		for i, device := range user.Devices {
+			devices = append(devices, authentik.Device{Pk: int32(i + 1), Name: device.Type, Type: device.Type, Confirmed: device.Confirmed})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (s *Server) createServiceAccount(w http.ResponseWriter, r *http.Request) {
+	var request authentik.UserServiceAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeDetail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, user := range s.users {
+		if user.Username == request.Name {
+			writeJSON(w, http.StatusBadRequest, map[string][]string{
+				"username": {"This field must be unique."},
+			})
+			return
+		}
+	}
+
+	pk := int32(1)
+	for existing := range s.users {
+		if existing >= pk {
+			pk = existing + 1
+		}
+	}
+	s.users[pk] = &User{Pk: pk, Username: request.Name, Name: request.Name, ServiceAccount: true}
+
+	writeJSON(w, http.StatusOK, authentik.UserServiceAccountResponse{
+		Username: request.Name,
+		UserUid:  strconv.Itoa(int(pk)),
+		UserPk:   pk,
+	})
+}
+
+func (s *Server) listGroups(w http.ResponseWriter, r *http.Request) {
+	// members_by_pk keeps the groups any of the given users is a direct member of
+	members := make(map[int32]bool)
+	for _, value := range r.URL.Query()["members_by_pk"] {
+		pk, err := strconv.Atoi(value)
+		if err != nil {
+			writeDetail(w, http.StatusBadRequest, "members_by_pk must be a list of integers")
+			return
+		}
+		members[int32(pk)] = true
+	}
+
+	groups := make([]authentik.Group, 0, len(s.groups))
+	for _, group := range s.groups {
+		if len(members) > 0 && !hasMember(group, members) {
+			continue
+		}
+		groups = append(groups, s.toGroup(group, false))
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+
+	start, end, pagination, ok := paginate(w, r.URL.Query(), len(groups))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, authentik.PaginatedGroupList{Pagination: pagination, Results: groups[start:end]})
+}
+
+func hasMember(group *Group, members map[int32]bool) bool {
+	for _, user := range group.Users {
+		if members[user] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) getGroup(w http.ResponseWriter, r *http.Request, pk string) {
+	group, ok := s.groups[pk]
+	if !ok {
+		writeDetail(w, http.StatusNotFound, "No Group matches the given query.")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.toGroup(group, r.URL.Query().Get("include_users") != "false"))
+}
+
+func (s *Server) patchGroup(w http.ResponseWriter, r *http.Request, pk string) {
+	group, ok := s.groups[pk]
+	if !ok {
+		writeDetail(w, http.StatusNotFound, "No Group matches the given query.")
+		return
+	}
+
+	var patch map[string]*string
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeDetail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if parent, ok := patch["parent"]; ok {
+		if parent == nil {
+			group.Parent = ""
+		} else if _, exists := s.groups[*parent]; !exists {
+			writeJSON(w, http.StatusBadRequest, map[string][]string{
+				"parent": {"Invalid pk \"" + *parent + "\" - object does not exist."},
+			})
+			return
+		} else {
+			group.Parent = *parent
+		}
+	}
+
+	writeJSON(w, http.StatusOK, s.toGroup(group, true))
+}
+
+// groupUsedBy lists the child groups, which reference the group as their parent
+func (s *Server) groupUsedBy(w http.ResponseWriter, pk string) {
+	if _, ok := s.groups[pk]; !ok {
+		writeDetail(w, http.StatusNotFound, "No Group matches the given query.")
+		return
+	}
+
+	usedBy := make([]authentik.UsedBy, 0)
+	for _, group := range s.groups {
+		if group.Parent == pk {
+			usedBy = append(usedBy, authentik.UsedBy{
+				App:       "authentik_core",
+				ModelName: "group",
+				Pk:        group.Pk,
+				Name:      group.Name,
+				Action:    authentik.USEDBYACTIONENUM_SET_NULL,
+			})
+		}
+	}
+	sort.Slice(usedBy, func(i, j int) bool {
+		return usedBy[i].Name < usedBy[j].Name
+	})
+
+	writeJSON(w, http.StatusOK, usedBy)
+}
+
+func (s *Server) changeMembership(w http.ResponseWriter, r *http.Request, pk string, add bool) {
+	group, ok := s.groups[pk]
+	if !ok {
+		writeDetail(w, http.StatusNotFound, "No Group matches the given query.")
+		return
+	}
+
+	var request authentik.UserAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeDetail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := s.users[request.Pk]; !ok {
+		writeJSON(w, http.StatusBadRequest, map[string][]string{
+			"pk": {"Invalid pk \"" + strconv.Itoa(int(request.Pk)) + "\" - object does not exist."},
+		})
+		return
+	}
+
+	users := make([]int32, 0, len(group.Users)+1)
+	for _, userPK := range group.Users {
+		if userPK != request.Pk {
+			users = append(users, userPK)
+		}
+	}
+	if add {
+		users = append(users, request.Pk)
+	}
+	group.Users = users
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createEvent(w http.ResponseWriter, r *http.Request) {
+	var event map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		writeDetail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.events = append(s.events, event)
+
+	writeJSON(w, http.StatusCreated, event)
+}
+
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request) {
+	var request authentik.TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeDetail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, exists := s.tokens[request.Identifier]; exists {
+		writeJSON(w, http.StatusBadRequest, map[string][]string{
+			"identifier": {"token with this identifier already exists."},
+		})
+		return
+	}
+
+	token := &Token{
+		Identifier: request.Identifier,
+		Key:        "key-" + request.Identifier,
+		Intent:     string(authentik.INTENTENUM_VERIFICATION),
+		Expiring:   request.Expiring == nil || *request.Expiring,
+	}
+	if request.Intent != nil {
+		token.Intent = string(*request.Intent)
+	}
+	if request.User != nil {
+		token.User = *request.User
+	}
+	s.tokens[token.Identifier] = token
+
+	writeJSON(w, http.StatusCreated, s.toToken(token))
+}
+
+// listTokens lists tokens, filtered like Authentik by the user__username and intent parameters
+func (s *Server) listTokens(w http.ResponseWriter, r *http.Request) {
+	identifiers := make([]string, 0, len(s.tokens))
+	for identifier := range s.tokens {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+
+	username, intent := r.URL.Query().Get("user__username"), r.URL.Query().Get("intent")
+	tokens := make([]authentik.Token, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		token := s.tokens[identifier]
+		if intent != "" && token.Intent != intent {
+			continue
+		}
+		if user, ok := s.users[token.User]; username != "" && (!ok || user.Username != username) {
+			continue
+		}
+		tokens = append(tokens, s.toToken(token))
+	}
+
+	start, end, pagination, ok := paginate(w, r.URL.Query(), len(tokens))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, authentik.PaginatedTokenList{Pagination: pagination, Results: tokens[start:end]})
+}
+
+// patchToken applies the expiry fields of a partial update, which is all the connector changes
+func (s *Server) patchToken(w http.ResponseWriter, r *http.Request, identifier string) {
+	token, ok := s.tokens[identifier]
+	if !ok {
+		writeDetail(w, http.StatusNotFound, "No Token matches the given query.")
+		return
+	}
+	var request authentik.PatchedTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeDetail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if request.Expiring != nil {
+		token.Expiring = *request.Expiring
+	}
+	if request.Expires.IsSet() {
+		token.Expires = time.Time{}
+		if expires := request.Expires.Get(); expires != nil {
+			token.Expires = *expires
+		}
+	}
+
+	writeJSON(w, http.StatusOK, s.toToken(token))
+}
+
+// listSessions lists authenticated sessions, filtered like Authentik by the user__username parameter
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	pks := make([]int, 0, len(s.users))
+	for pk := range s.users {
+		pks = append(pks, int(pk))
+	}
+	sort.Ints(pks)
+
+	username := r.URL.Query().Get("user__username")
+	sessions := make([]authentik.AuthenticatedSession, 0)
+	for _, pk := range pks {
+		user := s.users[int32(pk)]
+		if username != "" && user.Username != username {
+			continue
+		}
+		for _, uuid := range user.Sessions {
+			uuid := uuid
+			sessions = append(sessions, authentik.AuthenticatedSession{Uuid: &uuid, User: user.Pk, LastIp: "127.0.0.1", LastUsed: time.Now()})
+		}
+	}
+
+	start, end, pagination, ok := paginate(w, r.URL.Query(), len(sessions))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, authentik.PaginatedAuthenticatedSessionList{Pagination: pagination, Results: sessions[start:end]})
+}
+
+func (s *Server) deleteSession(w http.ResponseWriter, uuid string) {
+	for _, user := range s.users {
+		for i, session := range user.Sessions {
+			if session == uuid {
+				user.Sessions = append(user.Sessions[:i], user.Sessions[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	}
+
+	writeDetail(w, http.StatusNotFound, "No AuthenticatedSession matches the given query.")
+}
+
+func (s *Server) getToken(w http.ResponseWriter, identifier string) {
+	token, ok := s.tokens[identifier]
+	if !ok {
+		writeDetail(w, http.StatusNotFound, "No Token matches the given query.")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.toToken(token))
+}
+
+func (s *Server) viewTokenKey(w http.ResponseWriter, identifier string) {
+	token, ok := s.tokens[identifier]
+	if !ok {
+		writeDetail(w, http.StatusNotFound, "No Token matches the given query.")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, authentik.TokenView{Key: token.Key})
+}
+
+// listPermissions lists every known permission, or those a user holds with the user parameter
+func (s *Server) listPermissions(w http.ResponseWriter, r *http.Request) {
+	permissions := make([]authentik.Permission, 0, len(knownPermissions))
+	for i, name := range knownPermissions {
+		if value := r.URL.Query().Get("user"); value != "" {
+			userPK, _ := strconv.Atoi(value)
+			user, ok := s.users[int32(userPK)]
+			if !ok || !contains(user.Permissions, name) {
+				continue
+			}
+		}
+		appLabel, codename, _ := strings.Cut(name, ".")
+		permissions = append(permissions, authentik.Permission{
+			Id:       int32(i + 1),
+			Name:     codename,
+			Codename: codename,
+			AppLabel: appLabel,
+		})
+	}
+
+	start, end, pagination, ok := paginate(w, r.URL.Query(), len(permissions))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, authentik.PaginatedPermissionList{Pagination: pagination, Results: permissions[start:end]})
+}
+
+func (s *Server) assignPermissions(w http.ResponseWriter, r *http.Request, pk string, assign bool) {
+	userPK, _ := strconv.Atoi(pk)
+	user, ok := s.users[int32(userPK)]
+	if !ok {
+		writeDetail(w, http.StatusNotFound, "No User matches the given query.")
+		return
+	}
+
+	var request authentik.PermissionAssignRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeDetail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, name := range request.Permissions {
+		if !contains(knownPermissions, name) {
+			writeJSON(w, http.StatusBadRequest, map[string][]string{
+				"permissions": {"Permission " + name + " does not exist."},
+			})
+			return
+		}
+	}
+
+	permissions := make([]string, 0, len(user.Permissions)+len(request.Permissions))
+	for _, name := range user.Permissions {
+		if !contains(request.Permissions, name) {
+			permissions = append(permissions, name)
+		}
+	}
+	if assign {
+		permissions = append(permissions, request.Permissions...)
+	}
+	user.Permissions = permissions
+
+	if !assign {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, []authentik.PermissionAssignResult{})
+}
+
+func (s *Server) toToken(token *Token) authentik.Token {
+	intent := authentik.IntentEnum(token.Intent)
+	converted := authentik.Token{
+		Pk:         token.Identifier,
+		Identifier: token.Identifier,
+		Intent:     &intent,
+		User:       &token.User,
+		Expiring:   &token.Expiring,
+	}
+	if !token.Expires.IsZero() {
+		converted.Expires = *authentik.NewNullableTime(&token.Expires)
+	}
+	if user, ok := s.users[token.User]; ok {
+		converted.UserObj = s.toUser(user)
+	}
+
+	return converted
+}
+
+func (s *Server) toUser(user *User) authentik.User {
+	converted := authentik.User{
+		Pk:       user.Pk,
+		Username: user.Username,
+		Name:     user.Name,
+		Uid:      strconv.Itoa(int(user.Pk)),
+	}
+	if user.Email != "" {
+		converted.Email = &user.Email
+	}
+	active := !user.Inactive
+	converted.IsActive = &active
+	userType := authentik.USERTYPEENUM_INTERNAL
+	if user.ServiceAccount {
+		userType = authentik.USERTYPEENUM_SERVICE_ACCOUNT
+	}
+	if user.Type != "" {
+		userType = authentik.UserTypeEnum(user.Type)
+	}
+	converted.Type = &userType
+	converted.Attributes = user.Attributes
+
+	return converted
+}
+
+func (s *Server) toGroup(group *Group, includeUsers bool) authentik.Group {
+	converted := authentik.Group{
+		Pk:    group.Pk,
+		Name:  group.Name,
+		Users: append([]int32(nil), group.Users...),
+	}
+	if group.IsSuperuser {
+		converted.IsSuperuser = &group.IsSuperuser
+	}
+	if group.Attributes != nil {
+		converted.Attributes = group.Attributes
+	}
+	if parent, ok := s.groups[group.Parent]; ok {
+		converted.Parent = *authentik.NewNullableString(&parent.Pk)
+		converted.ParentName = *authentik.NewNullableString(&parent.Name)
+	}
+
+	if includeUsers {
+		converted.UsersObj = make([]authentik.GroupMember, 0, len(group.Users))
+		for _, pk := range group.Users {
+			if user, ok := s.users[pk]; ok {
+				member := authentik.GroupMember{Pk: user.Pk, Username: user.Username, Name: user.Name}
+				if user.Email != "" {
+					member.Email = &user.Email
+				}
+				converted.UsersObj = append(converted.UsersObj, member)
+			}
+		}
+	}
+
+	return converted
+}
+
+// paginate applies Authentik's page and page_size parameters to a list of count items
+func paginate(w http.ResponseWriter, query url.Values, count int) (start int, end int, pagination authentik.Pagination, ok bool) {
+	page, pageSize := 1, 20
+	var err error
+	if value := query.Get("page"); value != "" {
+		if page, err = strconv.Atoi(value); err != nil || page < 1 {
+			writeDetail(w, http.StatusNotFound, "Invalid page.")
+			return 0, 0, pagination, false
+		}
+	}
+	if value := query.Get("page_size"); value != "" {
+		if pageSize, err = strconv.Atoi(value); err != nil || pageSize < 1 {
+			pageSize = 20
+		}
+	}
+
+	totalPages := int(math.Max(1, math.Ceil(float64(count)/float64(pageSize))))
+	if page > totalPages {
+		writeDetail(w, http.StatusNotFound, "Invalid page.")
+		return 0, 0, pagination, false
+	}
+
+	start = (page - 1) * pageSize
+	end = start + pageSize
+	if end > count {
+		end = count
+	}
+
+	pagination = authentik.Pagination{
+		Count:      float32(count),
+		Current:    float32(page),
+		TotalPages: float32(totalPages),
+		StartIndex: float32(start + 1),
+		EndIndex:   float32(end),
+	}
+	if page < totalPages {
+		pagination.Next = float32(page + 1)
+	}
+	if page > 1 {
+		pagination.Previous = float32(page - 1)
+	}
+
+	return start, end, pagination, true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeDetail(w http.ResponseWriter, status int, detail string) {
+	writeJSON(w, status, map[string]string{"detail": detail})
+}
@@ -0,0 +1,152 @@
+package openapi
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Name of the backend serving every app_id when no apps are configured
+const DefaultBackendName = "default"
+
+// Key under which the backend of the current request is stored in the gin context
+const backendContextKey = "opal_authentik_backend"
+
+// AppConfig is the configuration of one Opal custom app, keyed by its app_id
+type AppConfig struct {
+	// Falls back to the top level opal_signing_secret
+	OpalSigningSecret string          `yaml:"opal_signing_secret"`
+	Authentik         AuthentikConfig `yaml:"authentik"`
+}
+
+// Backend is an Authentik instance that Opal requests are routed to, together with the state
+// shared by every client talking to it
+type Backend struct {
+	Name      string
+	Authentik AuthentikConfig
+
+	signingSecret string
+	config        *Config
+	tokenSource   *clientCredentialsTokenSource
+	transport     http.RoundTripper
+	removals      *removalLimiter
+}
+
+func newBackend(config *Config, name string, authentikConfig AuthentikConfig, signingSecret string) (*Backend, error) {
+	transport, err := newAuthentikTransport(authentikConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &Backend{
+		Name:          name,
+		Authentik:     authentikConfig,
+		signingSecret: signingSecret,
+		config:        config,
+		transport:     transport,
+		removals:      newRemovalLimiter(config.RemovalLimit.StateFile, name),
+	}
+	if authentikConfig.OAuth2.Enabled() {
+		backend.tokenSource = &clientCredentialsTokenSource{backend: backend}
+	}
+
+	return backend, nil
+}
+
+func (c *Config) buildBackends(configErr *ConfigError) {
+	c.backends = make(map[string]*Backend)
+
+	if len(c.Apps) == 0 {
+		backend, err := newBackend(c, DefaultBackendName, c.Authentik, c.OpalSigningSecret)
+		if err != nil {
+			configErr.add("authentik.tls: %v", err)
+			return
+		}
+		c.backends[DefaultBackendName] = backend
+		return
+	}
+
+	for _, appID := range sortedAppIDs(c.Apps) {
+		app := c.Apps[appID]
+		signingSecret := app.OpalSigningSecret
+		if signingSecret == "" {
+			signingSecret = c.OpalSigningSecret
+		}
+
+		backend, err := newBackend(c, appID, app.Authentik, signingSecret)
+		if err != nil {
+			configErr.add("apps.%s.authentik.tls: %v", appID, err)
+			continue
+		}
+		c.backends[appID] = backend
+	}
+}
+
+// Backend returns the backend serving the given Opal app. Without configured apps, the default
+// backend serves every app_id.
+func (c *Config) Backend(appID string) (*Backend, bool) {
+	if len(c.Apps) == 0 {
+		backend, ok := c.backends[DefaultBackendName]
+		return backend, ok
+	}
+
+	backend, ok := c.backends[appID]
+	return backend, ok
+}
+
+// Backends returns every backend, sorted by name
+func (c *Config) Backends() []*Backend {
+	backends := make([]*Backend, 0, len(c.backends))
+	for _, backend := range c.backends {
+		backends = append(backends, backend)
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].Name < backends[j].Name
+	})
+
+	return backends
+}
+
+// SigningSecret returns the secret Opal signs requests for this backend with
+func (b *Backend) SigningSecret() (string, error) {
+	return b.config.ResolveSecret(b.signingSecret)
+}
+
+// resolveBackend finds the backend for the request's app_id, rejecting app_ids that are not configured
+func resolveBackend(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		backend, ok := config.Backend(c.Query("app_id"))
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, &Error{
+				Code:    http.StatusNotFound,
+				Message: "Unknown app_id " + strconv.Quote(c.Query("app_id")) + ", it is not configured under apps",
+			})
+			return
+		}
+
+		c.Set(backendContextKey, backend)
+		c.Next()
+	}
+}
+
+// backendFromCtx returns the backend resolveBackend picked for the request
+func backendFromCtx(c *gin.Context) (*Backend, error) {
+	if value, ok := c.Get(backendContextKey); ok {
+		return value.(*Backend), nil
+	}
+
+	return nil, errors.Errorf("No Authentik backend selected for this request!")
+}
+
+func sortedAppIDs(apps map[string]AppConfig) []string {
+	appIDs := make([]string, 0, len(apps))
+	for appID := range apps {
+		appIDs = append(appIDs, appID)
+	}
+	sort.Strings(appIDs)
+
+	return appIDs
+}
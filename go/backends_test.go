@@ -0,0 +1,92 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSignaturesPerBackend(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Each instance only counts the requests it gets, what it answers does not matter here
+	var firstHits, otherHits atomic.Int32
+	instance := func(hits *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			http.NotFound(w, r)
+		}))
+	}
+	first, other := instance(&firstHits), instance(&otherHits)
+	defer first.Close()
+	defer other.Close()
+
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "other-secret")
+	if err := os.WriteFile(secretFile, []byte("other-signing-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	authentikConfig := func(server *httptest.Server) string {
+		return "    authentik:\n      host: " + strings.TrimPrefix(server.URL, "http://") + "\n      scheme: http\n      token: token\n"
+	}
+	// first-app falls back to the top level secret, other-app has its own
+	configPath := filepath.Join(dir, "config.yaml")
+	contents := "opal_signing_secret: first-signing-secret\napps:\n" +
+		"  first-app:\n" + authentikConfig(first) +
+		"  other-app:\n    opal_signing_secret: file:" + secretFile + "\n" + authentikConfig(other)
+	if err := os.WriteFile(configPath, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetConfig(config)
+	defer SetConfig(nil)
+	router := NewRouter(ApiHandleFunctions{})
+
+	signedWith := func(secret string, appID string) int {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		signature, err := GenerateSignature(secret, timestamp, []byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/groups/engineering?app_id="+appID, nil)
+		req.Header.Set("X-Opal-Request-Timestamp", timestamp)
+		req.Header.Set("X-Opal-Signature", signature)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// A secret only opens its own app
+	if code := signedWith("other-signing-secret", "first-app"); code != http.StatusUnauthorized {
+		t.Errorf("expected another app's secret to be rejected, got %d", code)
+	}
+	if code := signedWith("first-signing-secret", "other-app"); code != http.StatusUnauthorized {
+		t.Errorf("expected the top level secret to be rejected for an app with its own, got %d", code)
+	}
+	if hits := firstHits.Load() + otherHits.Load(); hits != 0 {
+		t.Errorf("expected rejected requests not to reach Authentik, got %d requests", hits)
+	}
+
+	// Each app is served by its own instance
+	if code := signedWith("first-signing-secret", "first-app"); code == http.StatusUnauthorized || firstHits.Load() != 1 || otherHits.Load() != 0 {
+		t.Errorf("expected first-app to reach its instance, got %d with %d and %d requests", code, firstHits.Load(), otherHits.Load())
+	}
+	if code := signedWith("other-signing-secret", "other-app"); code == http.StatusUnauthorized || firstHits.Load() != 1 || otherHits.Load() != 1 {
+		t.Errorf("expected other-app to reach its instance, got %d with %d and %d requests", code, firstHits.Load(), otherHits.Load())
+	}
+
+	if code := signedWith("first-signing-secret", "unknown-app"); code != http.StatusNotFound {
+		t.Errorf("expected an unknown app to be rejected with 404, got %d", code)
+	}
+}
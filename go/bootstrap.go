@@ -0,0 +1,261 @@
+package openapi
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+	authentik "goauthentik.io/api/v3"
+)
+
+const AuthentikAdminTokenEnvKey = "AUTHENTIK_ADMIN_TOKEN"
+
+const (
+	DefaultServiceAccountName = "opal-connector"
+	// Identifier of the connector's API token, the service account name is appended
+	bootstrapTokenIdentifierSuffix = "-api-token"
+)
+
+// Attribute marking the service accounts bootstrap created, whose permissions it fully manages
+const bootstrapManagedAttribute = "opal_connector_managed"
+
+// Page size used when listing permissions, far more than a service account normally holds
+const bootstrapPermissionPageSize = 100
+
+// BootstrapOptions describes the service account the bootstrap command provisions
+type BootstrapOptions struct {
+	// Username of the service account, DefaultServiceAccountName when empty
+	ServiceAccount string
+	// Identifier of the API token, "<service account>-api-token" when empty
+	TokenIdentifier string
+	// Revoke unneeded permissions even from a service account bootstrap did not create
+	RevokeUnneeded bool
+}
+
+// BootstrapResult describes what Bootstrap found and changed
+type BootstrapResult struct {
+	Username       string
+	UserPk         int32
+	CreatedAccount bool
+	// Whether bootstrap created the account, in this run or an earlier one
+	ManagedAccount bool
+	Granted        []string
+	Revoked        []string
+	// Unneeded permissions left in place, as the account was not created by bootstrap
+	Kept            []string
+	TokenIdentifier string
+	CreatedToken    bool
+	// The key of the API token, to be stored where the connector reads AUTHENTIK_TOKEN from
+	Token string
+}
+
+// RequiredPermissions lists the global permissions, as "<app_label>.<codename>", that the connector
+// needs for the features enabled on this backend
+func (b *Backend) RequiredPermissions() []string {
+	capabilities := b.config.Capabilities
+	permissions := []string{
+		"authentik_core.view_user",
+		"authentik_core.view_group",
+	}
+	if capabilities.Enabled(CapabilityGroupUsers) {
+		permissions = append(permissions, "authentik_core.add_user_to_group", "authentik_core.remove_user_from_group")
+	}
+	if capabilities.Enabled(CapabilityMemberGroups) {
+		// Nesting a member group sets its parent
+		permissions = append(permissions, "authentik_core.change_group")
+	}
+	if b.Authentik.Events {
+		permissions = append(permissions, "authentik_events.add_event")
+	}
+	if b.config.Eligibility.RequireMFA {
+		permissions = append(permissions, mfaDevicePermissions...)
+	}
+	revocation := b.config.Revocation.any()
+	if revocation.Sessions {
+		permissions = append(permissions, "authentik_core.view_authenticatedsession", "authentik_core.delete_authenticatedsession")
+	}
+	if revocation.AppPasswords {
+		permissions = append(permissions, "authentik_core.view_token", "authentik_core.change_token")
+	}
+	sort.Strings(permissions)
+
+	return permissions
+}
+
+// Bootstrap provisions the connector's service account, its permissions and a non-expiring API
+// token. The client must be authenticated as an admin. Running it again changes nothing, except
+// that permissions granted by hand since are revoked, so the account holds exactly what it needs.
+// Existing users are only used if they are service accounts, and their unneeded permissions are
+// only revoked if bootstrap created them or opts.RevokeUnneeded is set.
+func (c *AuthentikClient) Bootstrap(ctx context.Context, opts BootstrapOptions) (*BootstrapResult, error) {
+	if opts.ServiceAccount == "" {
+		opts.ServiceAccount = DefaultServiceAccountName
+	}
+	if opts.TokenIdentifier == "" {
+		opts.TokenIdentifier = opts.ServiceAccount + bootstrapTokenIdentifierSuffix
+	}
+	ctxWithAuth := c.addAuthTokenToCtx(ctx)
+	result := &BootstrapResult{Username: opts.ServiceAccount, TokenIdentifier: opts.TokenIdentifier}
+
+	userPk, created, managed, err := c.ensureServiceAccount(ctxWithAuth, opts.ServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+	result.UserPk = userPk
+	result.CreatedAccount = created
+	result.ManagedAccount = managed
+
+	revoke := managed || opts.RevokeUnneeded
+	result.Granted, result.Revoked, result.Kept, err = c.syncPermissions(ctxWithAuth, userPk, c.backend.RequiredPermissions(), revoke)
+	if err != nil {
+		return nil, err
+	}
+
+	result.CreatedToken, err = c.ensureAPIToken(ctxWithAuth, userPk, opts.TokenIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	key, resp, err := c.client.CoreApi.CoreTokensViewKeyRetrieve(ctxWithAuth, opts.TokenIdentifier).Execute()
+	if err != nil {
+		return nil, bootstrapError(resp, "failed to read the key of token "+opts.TokenIdentifier, err)
+	}
+	result.Token = key.Key
+
+	return result, nil
+}
+
+// ensureServiceAccount returns the primary key of the service account, creating it if needed.
+// managed reports whether bootstrap created the account. An existing user that is not a service
+// account, such as an admin, is refused rather than having its permissions rewritten.
+func (c *AuthentikClient) ensureServiceAccount(ctx context.Context, username string) (pk int32, created bool, managed bool, err error) {
+	users, resp, err := c.client.CoreApi.CoreUsersList(ctx).Username(username).Execute()
+	if err != nil {
+		return 0, false, false, bootstrapError(resp, "failed to look up user "+username, err)
+	}
+	if len(users.Results) > 0 {
+		user := users.Results[0]
+		if user.GetType() != authentik.USERTYPEENUM_SERVICE_ACCOUNT {
+			return 0, false, false, errors.Errorf("refusing to use user %s (%d) as the service account, it is an %s user rather than a service account", user.Username, user.Pk, user.GetType())
+		}
+		managed, _ := user.GetAttributes()[bootstrapManagedAttribute].(bool)
+		return user.Pk, false, managed, nil
+	}
+
+	request := authentik.NewUserServiceAccountRequest(username)
+	request.SetCreateGroup(false)
+	request.SetExpiring(false)
+	account, resp, err := c.client.CoreApi.CoreUsersServiceAccountCreate(ctx).UserServiceAccountRequest(*request).Execute()
+	if err != nil {
+		return 0, false, false, bootstrapError(resp, "failed to create service account "+username, err)
+	}
+
+	_, resp, err = c.client.CoreApi.CoreUsersPartialUpdate(ctx, account.UserPk).PatchedUserRequest(authentik.PatchedUserRequest{
+		Attributes: map[string]interface{}{bootstrapManagedAttribute: true},
+	}).Execute()
+	if err != nil {
+		return 0, false, false, bootstrapError(resp, "failed to mark service account "+username+" as managed by the connector", err)
+	}
+
+	return account.UserPk, true, true, nil
+}
+
+// syncPermissions grants the missing permissions and, if revoke is set, revokes those that are not
+// required. Otherwise they are returned as kept.
+func (c *AuthentikClient) syncPermissions(ctx context.Context, userPk int32, required []string, revoke bool) (granted []string, revoked []string, kept []string, err error) {
+	held, err := c.userPermissions(ctx, userPk)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, permission := range required {
+		if !held[permission] {
+			granted = append(granted, permission)
+		}
+		delete(held, permission)
+	}
+	for permission := range held {
+		revoked = append(revoked, permission)
+	}
+	sort.Strings(revoked)
+	if !revoke {
+		kept, revoked = revoked, nil
+	}
+
+	if len(granted) > 0 {
+		_, resp, err := c.client.RbacApi.RbacPermissionsAssignedByUsersAssign(ctx, userPk).PermissionAssignRequest(authentik.PermissionAssignRequest{
+			Permissions: granted,
+		}).Execute()
+		if err != nil {
+			return nil, nil, nil, bootstrapError(resp, "failed to assign permissions to the service account", err)
+		}
+	}
+	if len(revoked) > 0 {
+		resp, err := c.client.RbacApi.RbacPermissionsAssignedByUsersUnassignPartialUpdate(ctx, userPk).PatchedPermissionAssignRequest(authentik.PatchedPermissionAssignRequest{
+			Permissions: revoked,
+		}).Execute()
+		if err != nil {
+			return nil, nil, nil, bootstrapError(resp, "failed to unassign permissions from the service account", err)
+		}
+	}
+
+	return granted, revoked, kept, nil
+}
+
+// userPermissions returns the global permissions assigned directly to a user, as "<app_label>.<codename>"
+func (c *AuthentikClient) userPermissions(ctx context.Context, userPk int32) (map[string]bool, error) {
+	held := make(map[string]bool)
+	for page := int32(1); ; page++ {
+		permissions, resp, err := c.client.RbacApi.RbacPermissionsList(ctx).User(userPk).Page(page).PageSize(bootstrapPermissionPageSize).Execute()
+		if err != nil {
+			return nil, bootstrapError(resp, "failed to list the permissions of the service account", err)
+		}
+		for _, permission := range permissions.Results {
+			held[permission.AppLabel+"."+permission.Codename] = true
+		}
+		if getNextCursorFromPagination(permissions.Pagination) == "" {
+			return held, nil
+		}
+	}
+}
+
+// ensureAPIToken creates the non-expiring API token of the service account, unless it exists.
+// An existing token with the identifier is only reused if it is such a token.
+func (c *AuthentikClient) ensureAPIToken(ctx context.Context, userPk int32, identifier string) (created bool, err error) {
+	token, resp, err := c.client.CoreApi.CoreTokensRetrieve(ctx, identifier).Execute()
+	if err == nil {
+		switch {
+		case token.User == nil || *token.User != userPk:
+			return false, errors.Errorf("token %s already exists and belongs to another user, choose another identifier", identifier)
+		case token.Intent == nil || *token.Intent != authentik.INTENTENUM_API:
+			return false, errors.Errorf("token %s already exists but is not an API token, choose another identifier", identifier)
+		case token.Expiring == nil || *token.Expiring:
+			return false, errors.Errorf("token %s already exists but expires, delete it or choose another identifier", identifier)
+		}
+		return false, nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return false, bootstrapError(resp, "failed to look up token "+identifier, err)
+	}
+
+	request := authentik.NewTokenRequest(identifier)
+	request.SetIntent(authentik.INTENTENUM_API)
+	request.SetUser(userPk)
+	request.SetExpiring(false)
+	request.SetDescription("Used by the Opal Authentik connector")
+	_, resp, err = c.client.CoreApi.CoreTokensCreate(ctx).TokenRequest(*request).Execute()
+	if err != nil {
+		return false, bootstrapError(resp, "failed to create token "+identifier, err)
+	}
+
+	return true, nil
+}
+
+func bootstrapError(resp *http.Response, message string, err error) error {
+	statusCode := 500
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	return &ClientError{StatusCode: statusCode, Message: message, innerError: err}
+}
@@ -0,0 +1,211 @@
+package openapi
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+const testAdminToken = "admin-token"
+
+// bootstrapClient returns a client for a fake Authentik authenticated with the admin token. The
+// config has neither a signing secret nor a usable token yet, as before the first bootstrap.
+func bootstrapClient(t *testing.T, fake *authentiktest.Server, extraConfig string) *AuthentikClient {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	contents := "authentik:\n  host: " + fake.Host() + "\n  scheme: http\n  token: file:/nonexistent/token\n" + extraConfig
+	if err := os.WriteFile(configPath, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfigWithToken(configPath, testAdminToken)
+	if err != nil {
+		t.Fatalf("LoadConfigWithToken: %v", err)
+	}
+	client, err := NewAuthentikClientForBackend(config.Backends()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestBootstrapProvisionsServiceAccount(t *testing.T) {
+	fake := authentiktest.NewServer(testAdminToken)
+	defer fake.Close()
+	client := bootstrapClient(t, fake, "  events: true\n")
+
+	result, err := client.Bootstrap(context.Background(), BootstrapOptions{})
+	if err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if !result.CreatedAccount || !result.CreatedToken {
+		t.Errorf("expected the account and token to be created, got %+v", result)
+	}
+
+	account, ok := fake.UserByUsername(DefaultServiceAccountName)
+	if !ok {
+		t.Fatal("service account was not created")
+	}
+	if !result.ManagedAccount || account.Attributes[bootstrapManagedAttribute] != true {
+		t.Errorf("expected the account to be marked as managed, got %+v", account.Attributes)
+	}
+	required := client.backend.RequiredPermissions()
+	if len(required) != 6 || required[len(required)-1] != "authentik_events.add_event" {
+		t.Errorf("expected the core permissions and adding events to be required, got %v", required)
+	}
+	if !reflect.DeepEqual(result.Granted, required) || !sameSet(account.Permissions, required) {
+		t.Errorf("expected permissions %v, granted %v and holding %v", required, result.Granted, account.Permissions)
+	}
+
+	token, ok := fake.Token(DefaultServiceAccountName + "-api-token")
+	if !ok {
+		t.Fatal("token was not created")
+	}
+	if token.User != account.Pk || token.Intent != "api" || token.Expiring {
+		t.Errorf("expected a non-expiring API token of the service account, got %+v", token)
+	}
+	if result.Token != token.Key {
+		t.Errorf("expected the key of the token, got %q", result.Token)
+	}
+}
+
+func TestBootstrapIsIdempotent(t *testing.T) {
+	fake := authentiktest.NewServer(testAdminToken)
+	defer fake.Close()
+	client := bootstrapClient(t, fake, "")
+
+	first, err := client.Bootstrap(context.Background(), BootstrapOptions{ServiceAccount: "opal"})
+	if err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	second, err := client.Bootstrap(context.Background(), BootstrapOptions{ServiceAccount: "opal"})
+	if err != nil {
+		t.Fatalf("second Bootstrap: %v", err)
+	}
+
+	if second.CreatedAccount || second.CreatedToken || len(second.Granted) > 0 || len(second.Revoked) > 0 {
+		t.Errorf("expected the second run to change nothing, got %+v", second)
+	}
+	if second.UserPk != first.UserPk || second.Token != first.Token {
+		t.Errorf("expected the same account and token, got %+v and %+v", first, second)
+	}
+}
+
+func TestBootstrapRevokesUnneededPermissions(t *testing.T) {
+	fake := authentiktest.NewServer(testAdminToken)
+	defer fake.Close()
+	fake.AddUser(authentiktest.User{
+		Pk:             7,
+		Username:       "opal",
+		ServiceAccount: true,
+		Permissions:    []string{"authentik_core.view_user", "authentik_core.add_user", "authentik_events.add_event"},
+	})
+	client := bootstrapClient(t, fake, "")
+
+	// Bootstrap did not create the account, so extra permissions are only reported
+	result, err := client.Bootstrap(context.Background(), BootstrapOptions{ServiceAccount: "opal"})
+	if err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if want := []string{"authentik_core.add_user", "authentik_events.add_event"}; !reflect.DeepEqual(result.Kept, want) || len(result.Revoked) != 0 {
+		t.Errorf("expected %v to be kept, got %+v", want, result)
+	}
+	if account, _ := fake.User(7); !contains(account.Permissions, "authentik_core.add_user") || !contains(account.Permissions, "authentik_events.add_event") {
+		t.Errorf("expected the extra permissions to be kept, got %v", account.Permissions)
+	}
+
+	result, err = client.Bootstrap(context.Background(), BootstrapOptions{ServiceAccount: "opal", RevokeUnneeded: true})
+	if err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+
+	// Events are disabled, so adding events is not needed either
+	if want := []string{"authentik_core.add_user", "authentik_events.add_event"}; !reflect.DeepEqual(result.Revoked, want) {
+		t.Errorf("expected %v to be revoked, got %v", want, result.Revoked)
+	}
+	account, _ := fake.User(7)
+	if required := client.backend.RequiredPermissions(); !sameSet(account.Permissions, required) {
+		t.Errorf("expected exactly %v, got %v", required, account.Permissions)
+	}
+}
+
+func TestBootstrapRefusesUsersOtherThanServiceAccounts(t *testing.T) {
+	fake := authentiktest.NewServer(testAdminToken)
+	defer fake.Close()
+	adminPermissions := []string{"authentik_core.add_user", "authentik_core.change_user", "authentik_core.view_user"}
+	fake.AddUser(authentiktest.User{Pk: 1, Username: "akadmin", Permissions: adminPermissions})
+	client := bootstrapClient(t, fake, "")
+
+	_, err := client.Bootstrap(context.Background(), BootstrapOptions{ServiceAccount: "akadmin", RevokeUnneeded: true})
+	if err == nil || !strings.Contains(err.Error(), "akadmin (1)") || !strings.Contains(err.Error(), "internal user") {
+		t.Errorf("expected the internal user to be refused by name, got %v", err)
+	}
+	if account, _ := fake.User(1); !sameSet(account.Permissions, adminPermissions) {
+		t.Errorf("expected the admin's permissions to be untouched, got %v", account.Permissions)
+	}
+	for _, request := range fake.Requests() {
+		if !strings.HasPrefix(request, http.MethodGet+" ") {
+			t.Errorf("expected nothing to be changed, got %s", request)
+		}
+	}
+}
+
+func TestBootstrapRefusesForeignToken(t *testing.T) {
+	fake := authentiktest.NewServer(testAdminToken)
+	defer fake.Close()
+	fake.AddUser(authentiktest.User{Pk: 1, Username: "akadmin"})
+	fake.AddToken(authentiktest.Token{Identifier: "opal-api-token", Key: "other", User: 1, Intent: "api"})
+	client := bootstrapClient(t, fake, "")
+
+	if _, err := client.Bootstrap(context.Background(), BootstrapOptions{ServiceAccount: "opal"}); err == nil {
+		t.Error("expected reusing another user's token to fail")
+	}
+}
+
+func TestStoreSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+
+	if err := StoreSecret(SecretsConfig{}, "file:"+path, "secret"); err != nil {
+		t.Fatalf("StoreSecret: %v", err)
+	}
+
+	value, err := NewSecretResolver(SecretsConfig{}).Resolve("file:" + path)
+	if err != nil || value != "secret" {
+		t.Errorf("expected to read back the secret, got %q, %v", value, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the file to be private, got %v", info.Mode().Perm())
+	}
+
+	if err := StoreSecret(SecretsConfig{}, "exec:echo", "secret"); err == nil {
+		t.Error("expected storing to exec: to fail")
+	}
+}
+
+func sameSet(a []string, b []string) bool {
+	set := make(map[string]bool, len(a))
+	for _, value := range a {
+		set[value] = true
+	}
+	if len(set) != len(b) {
+		return false
+	}
+	for _, value := range b {
+		if !set[value] {
+			return false
+		}
+	}
+	return true
+}
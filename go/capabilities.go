@@ -0,0 +1,98 @@
+package openapi
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ReadOnlyEnvKey               = "READ_ONLY"
+	CapabilityGroupUsersEnvKey   = "CAPABILITY_GROUP_USERS"
+	CapabilityMemberGroupsEnvKey = "CAPABILITY_MEMBER_GROUPS"
+	CapabilityResourcesEnvKey    = "CAPABILITY_RESOURCES"
+)
+
+// Capabilities are groups of mutating routes that can be switched off separately
+const (
+	CapabilityGroupUsers   = "group_users"
+	CapabilityMemberGroups = "member_groups"
+	CapabilityResources    = "resources"
+)
+
+// The capability each mutating route belongs to, keyed by route name
+var routeCapabilities = map[string]string{
+	"AddGroupUser":           CapabilityGroupUsers,
+	"RemoveGroupUser":        CapabilityGroupUsers,
+	"AddGroupMemberGroup":    CapabilityMemberGroups,
+	"RemoveGroupMemberGroup": CapabilityMemberGroups,
+	"AddGroupResource":       CapabilityResources,
+	"RemoveGroupResource":    CapabilityResources,
+	"AddResourceUser":        CapabilityResources,
+	"RemoveResourceUser":     CapabilityResources,
+}
+
+// What each capability changes, for error messages
+var capabilityDescriptions = map[string]string{
+	CapabilityGroupUsers:   "the users of groups",
+	CapabilityMemberGroups: "the member groups of groups",
+	CapabilityResources:    "resources",
+}
+
+// CapabilitiesConfig switches off the routes that change Authentik, for environments where Opal
+// should only import data
+type CapabilitiesConfig struct {
+	// Disables every capability below
+	ReadOnly     bool `yaml:"read_only"`
+	GroupUsers   bool `yaml:"group_users"`
+	MemberGroups bool `yaml:"member_groups"`
+	Resources    bool `yaml:"resources"`
+}
+
+func defaultCapabilitiesConfig() CapabilitiesConfig {
+	return CapabilitiesConfig{
+		GroupUsers:   true,
+		MemberGroups: true,
+		Resources:    true,
+	}
+}
+
+// Enabled reports whether the routes of the given capability are served
+func (c CapabilitiesConfig) Enabled(capability string) bool {
+	if c.ReadOnly {
+		return false
+	}
+
+	switch capability {
+	case CapabilityGroupUsers:
+		return c.GroupUsers
+	case CapabilityMemberGroups:
+		return c.MemberGroups
+	case CapabilityResources:
+		return c.Resources
+	}
+
+	return true
+}
+
+// Disabled returns the capabilities that are switched off
+func (c CapabilitiesConfig) Disabled() []string {
+	disabled := make([]string, 0)
+	for _, capability := range []string{CapabilityGroupUsers, CapabilityMemberGroups, CapabilityResources} {
+		if !c.Enabled(capability) {
+			disabled = append(disabled, capability)
+		}
+	}
+
+	return disabled
+}
+
+// capabilityDisabled replaces the handler of a route whose capability is switched off
+func capabilityDisabled(capability string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusForbidden, &Error{
+			Code:    http.StatusForbidden,
+			Message: "This connector does not change " + capabilityDescriptions[capability] + ", as the " + capability + " capability is disabled in its configuration",
+		})
+	}
+}
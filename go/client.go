@@ -2,12 +2,13 @@ package openapi
 
 import (
 	"context"
-	"os"
+	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	authentik "goauthentik.io/api/v3"
+	"golang.org/x/oauth2"
 )
 
 const (
@@ -22,6 +23,23 @@ const PageQueryParam = "cursor"
 
 const DefaultPageSize = 100
 
+// ChangeOptions describes who asked for a membership change, for the audit log, events and policies,
+// and whether to only simulate it
+type ChangeOptions struct {
+	// Opal request context
+	OpalTimestamp string
+	OpalSignature string
+	AppID         string
+	// Where the change came from when not from Opal, e.g. AuditSourceReconcile
+	Source string
+	// The route the change was requested on and the address it came from, empty for commands
+	Method   string
+	Route    string
+	ClientIP string
+	// Simulate the change even if dry-run mode is off, see DryRunHeader
+	DryRun bool
+}
+
 type ClientError struct {
 	innerError error
 	StatusCode int
@@ -32,71 +50,108 @@ func (e *ClientError) Error() string {
 	return "error: " + e.Message + " due to: " + e.innerError.Error()
 }
 
-// Default authentication strategy, look for token in environment variables
-func getTokenFromEnv() (token string, ok bool) {
-	if _, hasEnv := os.LookupEnv(AuthentikTokenEnvKey); !hasEnv {
-		return "", false
-	}
-
-	token = os.Getenv(AuthentikTokenEnvKey)
-	return token, true
+// Default authentication strategy, use the token from the config file or environment variables
+func getTokenFromConfig(backend *Backend) (token string, ok bool) {
+	return backend.Authentik.Token, backend.Authentik.Token != ""
 }
 
-func getToken() (token string, ok bool) {
-	// Currently only support getting auth token from env, can add more in the future
-	getTokenFuncs := []func() (token string, ok bool){
-		getTokenFromEnv,
+// getToken returns the Authentik token. The configured value may refer to a file, command or
+// Vault secret, which is re-read periodically so a rotated token is picked up.
+func getToken(backend *Backend) (token string, err error) {
+	getTokenFuncs := []func(backend *Backend) (token string, ok bool){
+		getTokenFromConfig,
 	}
 
 	for _, getTokenFunc := range getTokenFuncs {
-		token, ok = getTokenFunc()
+		token, ok := getTokenFunc(backend)
 		if ok {
-			return token, true
+			return backend.config.ResolveSecret(token)
 		}
 	}
 
-	return "", false
+	return "", errors.Errorf("Unable to find authentik token!")
 }
 
 type AuthentikClient struct {
-	token  string
-	client *authentik.APIClient
+	backend     *Backend
+	tokenSource oauth2.TokenSource
+	client      *authentik.APIClient
 }
 
+// NewAuthentikClient returns a client for the only configured Authentik instance. When apps are
+// configured, use NewAuthentikClientForBackend instead.
 func NewAuthentikClient() (*AuthentikClient, error) {
-	token, ok := getToken()
-	if !ok {
-		return nil, errors.Errorf("Unable to find authentik token!")
+	config, err := getConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	configuration := authentik.NewConfiguration()
-	configuration.Host = os.Getenv(AuthentikHostEnvKey)
-	configuration.Scheme = os.Getenv(AuthentikSchemeEnvKey)
+	backends := config.Backends()
+	if len(backends) != 1 {
+		return nil, errors.Errorf("Several Authentik instances are configured, an app_id is needed to pick one!")
+	}
 
-	// Add Cloudflare Access token headers to the default headers
-	clientID := os.Getenv("CF_ACCESS_CLIENT_ID")
-	clientSecret := os.Getenv("CF_ACCESS_CLIENT_SECRET")
+	return NewAuthentikClientForBackend(backends[0])
+}
 
-	if os.Getenv("DEBUG") != "" {
-		configuration.Debug = true
+// newAuthentikClientFromCtx returns a client for the Authentik instance serving the request's app_id
+func newAuthentikClientFromCtx(c *gin.Context) (*AuthentikClient, error) {
+	backend, err := backendFromCtx(c)
+	if err != nil {
+		return nil, err
 	}
 
-	if clientID == "" || clientSecret == "" {
-		return nil, errors.Errorf("Cloudflare Access credentials are not set!")
+	return NewAuthentikClientForBackend(backend)
+}
+
+// changeOptionsFromCtx describes the Opal request asking for a membership change
+func changeOptionsFromCtx(c *gin.Context) (ChangeOptions, error) {
+	dryRun, err := dryRunRequested(c)
+	if err != nil {
+		return ChangeOptions{}, err
 	}
 
-	// Use AddDefaultHeader to include the Cloudflare headers globally
-	configuration.AddDefaultHeader("CF-Access-Client-Id", clientID)
-	configuration.AddDefaultHeader("CF-Access-Client-Secret", clientSecret)
+	return ChangeOptions{
+		OpalTimestamp: c.GetHeader("X-Opal-Request-Timestamp"),
+		OpalSignature: c.GetHeader("X-Opal-Signature"),
+		AppID:         c.Query("app_id"),
+		Method:        c.Request.Method,
+		Route:         c.FullPath(),
+		ClientIP:      c.ClientIP(),
+		DryRun:        dryRun,
+	}, nil
+}
+
+func NewAuthentikClientForBackend(backend *Backend) (*AuthentikClient, error) {
+	tokenSource, err := backend.getTokenSource()
+	if err != nil {
+		return nil, err
+	}
+
+	configuration := authentik.NewConfiguration()
+	configuration.Host = backend.Authentik.Host
+	configuration.Scheme = backend.Authentik.Scheme
+	configuration.Debug = backend.config.Debug
+	configuration.HTTPClient = &http.Client{Transport: backend.transport}
+
+	// Use AddDefaultHeader to include the Cloudflare Access token headers globally
+	headers, err := backend.defaultHeaders()
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		configuration.AddDefaultHeader(key, value)
+	}
 
 	return &AuthentikClient{
-		token:  token,
-		client: authentik.NewAPIClient(configuration),
+		backend:     backend,
+		tokenSource: tokenSource,
+		client:      authentik.NewAPIClient(configuration),
 	}, nil
 }
 
-func (c *AuthentikClient) PaginatedListUsers(ctx *gin.Context) (users []authentik.User, nextCursor string, err error) {
-	page, err := getPageFromCtx(ctx)
+func (c *AuthentikClient) PaginatedListUsers(ctx context.Context, cursor string) (users []authentik.User, nextCursor string, err error) {
+	page, err := pageFromCursor(cursor)
 	if err != nil {
 		return nil, "", errors.Wrap(err, "Encountered error while getting page number from request!")
 	}
@@ -114,8 +169,8 @@ func (c *AuthentikClient) PaginatedListUsers(ctx *gin.Context) (users []authenti
 	return paginatedUsers.Results, getNextCursorFromPagination(paginatedUsers.Pagination), nil
 }
 
-func (c *AuthentikClient) PaginatedListGroups(ctx *gin.Context) (groups []authentik.Group, nextCursor string, err error) {
-	page, err := getPageFromCtx(ctx)
+func (c *AuthentikClient) PaginatedListGroups(ctx context.Context, cursor string) (groups []authentik.Group, nextCursor string, err error) {
+	page, err := pageFromCursor(cursor)
 	if err != nil {
 		return nil, "", errors.Wrap(err, "Encountered error while getting page number from request!")
 	}
@@ -133,7 +188,7 @@ func (c *AuthentikClient) PaginatedListGroups(ctx *gin.Context) (groups []authen
 	return paginatedGroups.Results, getNextCursorFromPagination(paginatedGroups.Pagination), nil
 }
 
-func (c *AuthentikClient) ListChildrenGroups(ctx *gin.Context, groupID string) (memberGroups []*authentik.Group, err error) {
+func (c *AuthentikClient) ListChildrenGroups(ctx context.Context, groupID string) (memberGroups []*authentik.Group, err error) {
 	ctxWithAuth := c.addAuthTokenToCtx(ctx)
 	usedByModels, resp, err := c.client.CoreApi.CoreGroupsUsedByList(ctxWithAuth, groupID).Execute()
 	if err != nil {
@@ -159,7 +214,7 @@ func (c *AuthentikClient) ListChildrenGroups(ctx *gin.Context, groupID string) (
 	return memberGroups, nil
 }
 
-func (c *AuthentikClient) GetGroupUsers(ctx *gin.Context, groupID string) (members []authentik.GroupMember, err error) {
+func (c *AuthentikClient) GetGroupUsers(ctx context.Context, groupID string) (members []authentik.GroupMember, err error) {
 	ctxWithAuth := c.addAuthTokenToCtx(ctx)
 	group, resp, err := c.client.CoreApi.CoreGroupsRetrieve(ctxWithAuth, groupID).IncludeUsers(true).Execute()
 	if err != nil {
@@ -173,7 +228,7 @@ func (c *AuthentikClient) GetGroupUsers(ctx *gin.Context, groupID string) (membe
 	return group.UsersObj, nil
 }
 
-func (c *AuthentikClient) GetGroup(ctx *gin.Context, groupID string) (group *authentik.Group, err error) {
+func (c *AuthentikClient) GetGroup(ctx context.Context, groupID string) (group *authentik.Group, err error) {
 	ctxWithAuth := c.addAuthTokenToCtx(ctx)
 	group, resp, err := c.client.CoreApi.CoreGroupsRetrieve(ctxWithAuth, groupID).IncludeUsers(false).Execute()
 	if err != nil {
@@ -187,16 +242,101 @@ func (c *AuthentikClient) GetGroup(ctx *gin.Context, groupID string) (group *aut
 	return group, nil
 }
 
-func (c *AuthentikClient) AddUserToGroup(ctx *gin.Context, groupID string, userID string) error {
+func (c *AuthentikClient) GetUser(ctx context.Context, userPK int32) (user *authentik.User, err error) {
 	ctxWithAuth := c.addAuthTokenToCtx(ctx)
-	// The user ID provided by Opal is the user's primary key in Authentik
-	userPK, err := strconv.Atoi(userID)
+	user, resp, err := c.client.CoreApi.CoreUsersRetrieve(ctxWithAuth, userPK).Execute()
 	if err != nil {
+		statusCode := 500
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		return nil, &ClientError{StatusCode: statusCode, Message: "failed to get user from Authentik", innerError: err}
+	}
+
+	return user, nil
+}
+
+// changeTargets are the groups and user a membership change involves
+type changeTargets struct {
+	group       *authentik.Group
+	memberGroup *authentik.Group
+	user        *authentik.User
+}
+
+// lookupTargets fetches the groups and user of the change described by entry, once for every check,
+// and records their names in the entry
+func (c *AuthentikClient) lookupTargets(ctx context.Context, entry *AuditEntry) (*changeTargets, error) {
+	targets := &changeTargets{}
+
+	group, err := c.GetGroup(ctx, entry.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	targets.group = group
+	entry.GroupName = group.GetName()
+
+	if entry.MemberGroupID != "" {
+		memberGroup, err := c.GetGroup(ctx, entry.MemberGroupID)
+		if err != nil {
+			return nil, err
+		}
+		targets.memberGroup = memberGroup
+		entry.MemberGroupName = memberGroup.GetName()
+	}
+
+	if entry.UserID != "" {
+		// The user ID provided by Opal is the user's primary key in Authentik
+		userPK, err := strconv.Atoi(entry.UserID)
+		if err != nil {
+			return nil, err
+		}
+		user, err := c.GetUser(ctx, int32(userPK))
+		if err != nil {
+			return nil, err
+		}
+		targets.user = user
+		entry.UserName = user.GetUsername()
+		entry.UserEmail = user.GetEmail()
+	}
+
+	return targets, nil
+}
+
+func (c *AuthentikClient) AddUserToGroup(ctx context.Context, groupID string, userID string, options ChangeOptions) (err error) {
+	auditEntry := newAuditEntry(options, AuditOperationAddUserToGroup)
+	auditEntry.GroupID = groupID
+	auditEntry.UserID = userID
+	var resp *http.Response
+	defer func() { c.recordMembershipChange(ctx, auditEntry, options, resp, err) }()
+
+	targets, err := c.lookupTargets(ctx, &auditEntry)
+	if err != nil {
+		return err
+	}
+	userPK := targets.user.GetPk()
+	if err = c.checkGroupNotProtected(ctx, targets.group); err != nil {
+		return err
+	}
+	if err = c.checkEligibility(ctx, targets.user); err != nil {
+		return err
+	}
+	if err = c.checkUserSeparationOfDuties(ctx, targets.group, userPK); err != nil {
+		return err
+	}
+	if err = c.checkPolicies(auditEntry, options, targets); err != nil {
+		return err
+	}
+	if c.dryRun(options) {
+		c.simulateMembershipChange(&auditEntry)
+		return nil
+	}
+	if err = c.checkNotHalted(); err != nil {
 		return err
 	}
-	userAccountRequest := authentik.NewUserAccountRequest(int32(userPK))
+	userAccountRequest := authentik.NewUserAccountRequest(userPK)
 
-	resp, err := c.client.CoreApi.CoreGroupsAddUserCreate(ctxWithAuth, groupID).UserAccountRequest(*userAccountRequest).Execute()
+	ctxWithAuth := c.addAuthTokenToCtx(ctx)
+	resp, err = c.client.CoreApi.CoreGroupsAddUserCreate(ctxWithAuth, groupID).UserAccountRequest(*userAccountRequest).Execute()
 	if err != nil {
 		statusCode := 500
 		if resp != nil {
@@ -208,16 +348,50 @@ func (c *AuthentikClient) AddUserToGroup(ctx *gin.Context, groupID string, userI
 	return err
 }
 
-func (c *AuthentikClient) RemoveUserFromGroup(ctx *gin.Context, groupID string, userID string) error {
-	ctxWithAuth := c.addAuthTokenToCtx(ctx)
-	// The user ID provided by Opal is the user's primary key in Authentik
-	userPK, err := strconv.Atoi(userID)
+func (c *AuthentikClient) RemoveUserFromGroup(ctx context.Context, groupID string, userID string, options ChangeOptions) (err error) {
+	auditEntry := newAuditEntry(options, AuditOperationRemoveUserFromGroup)
+	auditEntry.GroupID = groupID
+	auditEntry.UserID = userID
+	var resp *http.Response
+	defer func() {
+		// A failed revocation does not undo the removal, which is recorded as made. A retry
+		// removes nothing, so its outcome is the revocation's
+		recordErr := err
+		if auditEntry.RevocationError != "" && !auditEntry.RevocationRetry {
+			recordErr = nil
+		}
+		c.recordMembershipChange(ctx, auditEntry, options, resp, recordErr)
+	}()
+
+	targets, err := c.lookupTargets(ctx, &auditEntry)
 	if err != nil {
 		return err
 	}
-	userAccountRequest := authentik.NewUserAccountRequest(int32(userPK))
+	userPK := targets.user.GetPk()
+	if err = c.checkGroupNotProtected(ctx, targets.group); err != nil {
+		return err
+	}
+	if err = c.checkPolicies(auditEntry, options, targets); err != nil {
+		return err
+	}
+	if c.dryRun(options) {
+		c.simulateMembershipChange(&auditEntry)
+		return nil
+	}
+	if c.retriesRevocation(targets.group, userPK) {
+		auditEntry.RevocationRetry = true
+		if err = c.revokeAccess(ctx, groupID, targets.user, &auditEntry); err != nil {
+			auditEntry.RevocationError = err.Error()
+		}
+		return err
+	}
+	if err = c.checkUserRemovalLimit(targets.group, userPK); err != nil {
+		return err
+	}
+	userAccountRequest := authentik.NewUserAccountRequest(userPK)
 
-	resp, err := c.client.CoreApi.CoreGroupsRemoveUserCreate(ctxWithAuth, groupID).UserAccountRequest(*userAccountRequest).Execute()
+	ctxWithAuth := c.addAuthTokenToCtx(ctx)
+	resp, err = c.client.CoreApi.CoreGroupsRemoveUserCreate(ctxWithAuth, groupID).UserAccountRequest(*userAccountRequest).Execute()
 	if err != nil {
 		statusCode := 500
 		if resp != nil {
@@ -226,13 +400,46 @@ func (c *AuthentikClient) RemoveUserFromGroup(ctx *gin.Context, groupID string,
 		return &ClientError{StatusCode: statusCode, Message: "failed to remove user from group in authentik", innerError: err}
 	}
 
+	if err = c.revokeAccess(ctx, groupID, targets.user, &auditEntry); err != nil {
+		auditEntry.RevocationError = err.Error()
+	}
 	return err
 }
 
-func (c *AuthentikClient) AddGroupToGroup(ctx *gin.Context, containingGroupID string, memberGroupID string) error {
+func (c *AuthentikClient) AddGroupToGroup(ctx context.Context, containingGroupID string, memberGroupID string, options ChangeOptions) (err error) {
+	auditEntry := newAuditEntry(options, AuditOperationAddGroupToGroup)
+	auditEntry.GroupID = containingGroupID
+	auditEntry.MemberGroupID = memberGroupID
+	var resp *http.Response
+	defer func() { c.recordMembershipChange(ctx, auditEntry, options, resp, err) }()
+
+	targets, err := c.lookupTargets(ctx, &auditEntry)
+	if err != nil {
+		return err
+	}
+	// Nesting changes the member group's parent, so both groups are changed
+	for _, group := range []*authentik.Group{targets.group, targets.memberGroup} {
+		if err = c.checkGroupNotProtected(ctx, group); err != nil {
+			return err
+		}
+	}
+	if err = c.checkNestingSeparationOfDuties(ctx, targets.group, targets.memberGroup); err != nil {
+		return err
+	}
+	if err = c.checkPolicies(auditEntry, options, targets); err != nil {
+		return err
+	}
+	if c.dryRun(options) {
+		c.simulateMembershipChange(&auditEntry)
+		return nil
+	}
+	if err = c.checkNotHalted(); err != nil {
+		return err
+	}
+
 	ctxWithAuth := c.addAuthTokenToCtx(ctx)
 
-	_, resp, err := c.client.CoreApi.CoreGroupsPartialUpdate(
+	_, resp, err = c.client.CoreApi.CoreGroupsPartialUpdate(
 		ctxWithAuth,
 		memberGroupID,
 	).PatchedGroupRequest(
@@ -251,10 +458,42 @@ func (c *AuthentikClient) AddGroupToGroup(ctx *gin.Context, containingGroupID st
 	return nil
 }
 
-func (c *AuthentikClient) RemoveGroupFromGroup(ctx *gin.Context, containingGroupID string, memberGroupID string) error {
+func (c *AuthentikClient) RemoveGroupFromGroup(ctx context.Context, containingGroupID string, memberGroupID string, options ChangeOptions) (err error) {
+	auditEntry := newAuditEntry(options, AuditOperationRemoveGroupFromGroup)
+	auditEntry.GroupID = containingGroupID
+	auditEntry.MemberGroupID = memberGroupID
+	var resp *http.Response
+	defer func() { c.recordMembershipChange(ctx, auditEntry, options, resp, err) }()
+
+	targets, err := c.lookupTargets(ctx, &auditEntry)
+	if err != nil {
+		return err
+	}
+	// Nesting changes the member group's parent, so both groups are changed
+	for _, group := range []*authentik.Group{targets.group, targets.memberGroup} {
+		if err = c.checkGroupNotProtected(ctx, group); err != nil {
+			return err
+		}
+	}
+	if err = c.checkPolicies(auditEntry, options, targets); err != nil {
+		return err
+	}
+	if c.dryRun(options) {
+		c.simulateMembershipChange(&auditEntry)
+		return nil
+	}
+	// A member group that is not nested in the group, such as when Opal retries a removal, is left alone
+	// and not counted, rather than taken out of the group it is nested in
+	if targets.memberGroup.GetParent() != containingGroupID {
+		return nil
+	}
+	if err = c.checkRemovalLimit(containingGroupID); err != nil {
+		return err
+	}
+
 	ctxWithAuth := c.addAuthTokenToCtx(ctx)
 
-	_, resp, err := c.client.CoreApi.CoreGroupsPartialUpdate(
+	_, resp, err = c.client.CoreApi.CoreGroupsPartialUpdate(
 		ctxWithAuth,
 		memberGroupID,
 	).PatchedGroupRequest(
@@ -273,8 +512,25 @@ func (c *AuthentikClient) RemoveGroupFromGroup(ctx *gin.Context, containingGroup
 	return nil
 }
 
-func (c *AuthentikClient) addAuthTokenToCtx(ctx *gin.Context) context.Context {
-	return context.WithValue(ctx, authentik.ContextAccessToken, c.token)
+// Ping checks that Authentik is reachable and accepts the connector's credentials
+func (c *AuthentikClient) Ping(ctx context.Context) error {
+	ctxWithAuth := c.addAuthTokenToCtx(ctx)
+	_, resp, err := c.client.CoreApi.CoreUsersMeRetrieve(ctxWithAuth).Execute()
+	if err != nil {
+		statusCode := 500
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		return &ClientError{StatusCode: statusCode, Message: "failed to reach Authentik", innerError: err}
+	}
+
+	return nil
+}
+
+// addAuthTokenToCtx attaches the client's credentials to a context
+func (c *AuthentikClient) addAuthTokenToCtx(ctx context.Context) context.Context {
+	// The generated client asks the token source for a token on every request, so refreshed tokens are picked up
+	return context.WithValue(ctx, authentik.ContextOAuth2, c.tokenSource)
 }
 
 func getNextCursorFromPagination(pagination authentik.Pagination) string {
@@ -286,8 +542,12 @@ func getNextCursorFromPagination(pagination authentik.Pagination) string {
 	return strconv.FormatFloat(float64(pagination.Next), 'f', 0, 32)
 }
 
-func getPageFromCtx(ctx *gin.Context) (int32, error) {
-	page, err := strconv.Atoi(ctx.DefaultQuery(PageQueryParam, "1"))
+// pageFromCursor returns the Authentik page a cursor points to, the first page for an empty cursor
+func pageFromCursor(cursor string) (int32, error) {
+	if cursor == "" {
+		return 1, nil
+	}
+	page, err := strconv.Atoi(cursor)
 	if err != nil {
 		return -1, err
 	}
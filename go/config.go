@@ -0,0 +1,649 @@
+package openapi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigFileEnvKey        = "CONNECTOR_CONFIG"
+	ListenAddressEnvKey     = "LISTEN_ADDRESS"
+	OpalSigningSecretEnvKey = "OPAL_SIGNING_SECRET"
+	DebugEnvKey             = "DEBUG"
+	CFAccessClientIDEnvKey  = "CF_ACCESS_CLIENT_ID"
+	CFAccessSecretEnvKey    = "CF_ACCESS_CLIENT_SECRET"
+)
+
+const DefaultListenAddress = ":8080"
+
+// Printed in place of secrets when showing the effective configuration
+const redactedValue = "<redacted>"
+
+// Config is the complete configuration of the connector. It is loaded from an optional YAML file,
+// then environment variables override individual settings, so existing env-only deployments keep working.
+type Config struct {
+	ListenAddress string `yaml:"listen_address"`
+	// Serve /healthz and /readyz on this address instead of alongside the Opal API
+	AdminListenAddress string `yaml:"admin_listen_address"`
+	OpalSigningSecret  string `yaml:"opal_signing_secret"`
+	Debug              bool   `yaml:"debug"`
+	// Simulate membership changes instead of making them, see DryRunHeader
+	DryRun    bool            `yaml:"dry_run"`
+	Server    ServerConfig    `yaml:"server"`
+	Authentik AuthentikConfig `yaml:"authentik"`
+	Audit     AuditConfig     `yaml:"audit"`
+	// Switch off routes that change Authentik
+	Capabilities CapabilitiesConfig `yaml:"capabilities"`
+	// Groups the connector refuses to change
+	ProtectedGroups ProtectedGroupsConfig `yaml:"protected_groups"`
+	// Combinations of groups nobody may be a member of at the same time
+	SeparationOfDuties []SeparationOfDutiesRule `yaml:"separation_of_duties"`
+	// Conditions users must meet before being added to a group
+	Eligibility EligibilityConfig `yaml:"eligibility"`
+	// CEL policies every membership change must pass
+	Policies PolicyConfig `yaml:"policies"`
+	// Halt removals when too many are made in a short time
+	RemovalLimit RemovalLimitConfig `yaml:"removal_limit"`
+	// Sessions and tokens revoked when a user is removed from a group
+	Revocation RevocationConfig `yaml:"revocation"`
+	Secrets    SecretsConfig    `yaml:"secrets"`
+	// Check requests and responses against api/openapi.yaml
+	Validation ValidationConfig `yaml:"validation"`
+	// Route each Opal app to its own Authentik instance. When empty, every app_id is served by
+	// the top level authentik settings.
+	Apps map[string]AppConfig `yaml:"apps"`
+
+	secrets  *SecretResolver
+	backends map[string]*Backend
+	policies *policyEngine
+}
+
+type AuthentikConfig struct {
+	Host             string                 `yaml:"host"`
+	Scheme           string                 `yaml:"scheme"`
+	Token            string                 `yaml:"token"`
+	OAuth2           OAuth2Config           `yaml:"oauth2"`
+	CloudflareAccess CloudflareAccessConfig `yaml:"cloudflare_access"`
+	TLS              TLSConfig              `yaml:"tls"`
+	// Explicit HTTP(S) proxy, otherwise HTTPS_PROXY and friends apply
+	ProxyURL string `yaml:"proxy_url"`
+	// Extra headers sent with every request, values may refer to secrets
+	Headers map[string]string `yaml:"headers"`
+	// Mirror membership changes into Authentik's event log, see createOpalEvent
+	Events bool `yaml:"events"`
+}
+
+type CloudflareAccessConfig struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+}
+
+type AuditConfig struct {
+	File          string `yaml:"file"`
+	MaxBytes      int64  `yaml:"max_bytes"`
+	SyslogAddr    string `yaml:"syslog_addr"`
+	SyslogNetwork string `yaml:"syslog_network"`
+	HTTPURL       string `yaml:"http_url"`
+	HTTPToken     string `yaml:"http_token"`
+}
+
+type SecretsConfig struct {
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	Vault           VaultConfig   `yaml:"vault"`
+}
+
+// ConfigError lists every problem found while loading or validating the configuration,
+// so they can all be fixed in one go instead of one restart at a time.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddress:   DefaultListenAddress,
+		Server:          defaultServerConfig(),
+		Validation:      defaultValidationConfig(),
+		Capabilities:    defaultCapabilitiesConfig(),
+		ProtectedGroups: defaultProtectedGroupsConfig(),
+		Secrets: SecretsConfig{
+			RefreshInterval: DefaultSecretsRefreshInterval,
+		},
+	}
+}
+
+// LoadConfig reads the YAML file at path, if any, applies environment overrides and validates the result
+func LoadConfig(path string) (*Config, error) {
+	return loadConfig(path, nil)
+}
+
+// LoadConfigWithToken loads the configuration like LoadConfig, but authenticates to every Authentik
+// instance with the given token instead of the configured credentials. The bootstrap command uses
+// it to act as an admin before the connector's own token exists.
+func LoadConfigWithToken(path string, token string) (*Config, error) {
+	return loadConfig(path, func(config *Config) {
+		useToken := func(authentikConfig *AuthentikConfig) {
+			authentikConfig.Token = token
+			authentikConfig.OAuth2 = OAuth2Config{}
+		}
+		useToken(&config.Authentik)
+		for appID, app := range config.Apps {
+			useToken(&app.Authentik)
+			config.Apps[appID] = app
+		}
+
+		// Opal is not involved, and the signing secret is often created after the token
+		if config.OpalSigningSecret == "" {
+			config.OpalSigningSecret = "unused"
+		}
+	})
+}
+
+// loadConfig loads the configuration, calling override, if given, after the environment is applied
+func loadConfig(path string, override func(config *Config)) (*Config, error) {
+	config := defaultConfig()
+
+	if path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read config file %s", path)
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(contents))
+		// Reject unknown keys so a typo does not silently fall back to a default
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && err != io.EOF {
+			return nil, errors.Wrapf(err, "unable to parse config file %s", path)
+		}
+	}
+
+	configErr := &ConfigError{}
+	config.applyEnv(configErr)
+	if override != nil {
+		override(config)
+	}
+	config.applyDefaults()
+	config.validate(configErr)
+	if len(configErr.Problems) > 0 {
+		return nil, configErr
+	}
+
+	config.secrets = NewSecretResolver(config.Secrets)
+	config.checkSecrets(configErr)
+	if len(configErr.Problems) > 0 {
+		return nil, configErr
+	}
+
+	// Load the listener certificates once here so problems with them are reported with the rest
+	if _, err := newCertReloader(config.Server.TLS); err != nil {
+		configErr.add("server.tls: %v", err)
+		return nil, configErr
+	}
+
+	if len(config.Policies.Paths) > 0 {
+		engine, err := newPolicyEngine(config.Policies.Paths)
+		config.policies = engine
+		var policyErr *ConfigError
+		if errors.As(err, &policyErr) {
+			for _, problem := range policyErr.Problems {
+				configErr.add("policies: %s", problem)
+			}
+		} else if err != nil {
+			configErr.add("policies: %v", err)
+		}
+		if len(configErr.Problems) > 0 {
+			return nil, configErr
+		}
+	}
+
+	config.buildBackends(configErr)
+	if len(configErr.Problems) > 0 {
+		return nil, configErr
+	}
+
+	return config, nil
+}
+
+func (c *Config) applyEnv(configErr *ConfigError) {
+	overrideString(&c.ListenAddress, ListenAddressEnvKey)
+	overrideString(&c.AdminListenAddress, AdminListenAddressEnvKey)
+	overrideSecret(&c.OpalSigningSecret, OpalSigningSecretEnvKey)
+	// DEBUG used to be enabled by any non-empty value, keep accepting that
+	if value := os.Getenv(DebugEnvKey); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		c.Debug = err != nil || enabled
+	}
+	overrideBool(&c.DryRun, DryRunEnvKey, configErr)
+
+	overrideDuration(&c.Server.ReadTimeout, ServerReadTimeoutEnvKey, configErr)
+	overrideDuration(&c.Server.WriteTimeout, ServerWriteTimeoutEnvKey, configErr)
+	overrideDuration(&c.Server.IdleTimeout, ServerIdleTimeoutEnvKey, configErr)
+	overrideDuration(&c.Server.ShutdownTimeout, ServerShutdownTimeoutEnvKey, configErr)
+	overrideString(&c.Server.TLS.CertFile, ServerTLSCertFileEnvKey)
+	overrideString(&c.Server.TLS.KeyFile, ServerTLSKeyFileEnvKey)
+	overrideString(&c.Server.TLS.CAFile, ServerTLSClientCAFileEnvKey)
+	overrideString(&c.Server.TLS.MinVersion, ServerTLSMinVersionEnvKey)
+
+	overrideString(&c.Authentik.Host, AuthentikHostEnvKey)
+	overrideString(&c.Authentik.Scheme, AuthentikSchemeEnvKey)
+	overrideSecret(&c.Authentik.Token, AuthentikTokenEnvKey)
+	overrideString(&c.Authentik.OAuth2.TokenURL, AuthentikOAuth2TokenURLEnvKey)
+	overrideString(&c.Authentik.OAuth2.ClientID, AuthentikOAuth2ClientIDEnvKey)
+	overrideSecret(&c.Authentik.OAuth2.ClientSecret, AuthentikOAuth2ClientSecretEnvKey)
+	overrideString(&c.Authentik.OAuth2.Username, AuthentikOAuth2UsernameEnvKey)
+	overrideSecret(&c.Authentik.OAuth2.Password, AuthentikOAuth2PasswordEnvKey)
+	if value := os.Getenv(AuthentikOAuth2ScopesEnvKey); value != "" {
+		c.Authentik.OAuth2.Scopes = parseScopes(value)
+	}
+	overrideSecret(&c.Authentik.CloudflareAccess.ClientID, CFAccessClientID)
+	overrideSecret(&c.Authentik.CloudflareAccess.ClientID, CFAccessClientIDEnvKey)
+	overrideSecret(&c.Authentik.CloudflareAccess.ClientSecret, CFAccessClientSecret)
+	overrideSecret(&c.Authentik.CloudflareAccess.ClientSecret, CFAccessSecretEnvKey)
+	overrideBool(&c.Authentik.Events, AuthentikEventsEnvKey, configErr)
+	overrideString(&c.Authentik.TLS.CAFile, AuthentikCAFileEnvKey)
+	overrideString(&c.Authentik.TLS.CertFile, AuthentikClientCertEnvKey)
+	overrideString(&c.Authentik.TLS.KeyFile, AuthentikClientKeyEnvKey)
+	overrideString(&c.Authentik.TLS.MinVersion, AuthentikTLSMinVersionEnvKey)
+	overrideString(&c.Authentik.ProxyURL, AuthentikProxyEnvKey)
+
+	overrideString(&c.Audit.File, AuditLogFileEnvKey)
+	overrideInt64(&c.Audit.MaxBytes, AuditLogMaxBytesEnvKey, configErr)
+	overrideString(&c.Audit.SyslogAddr, AuditLogSyslogAddrEnvKey)
+	overrideString(&c.Audit.SyslogNetwork, AuditLogSyslogNetEnvKey)
+	overrideString(&c.Audit.HTTPURL, AuditLogHTTPURLEnvKey)
+	overrideSecret(&c.Audit.HTTPToken, AuditLogHTTPTokenEnvKey)
+
+	overrideBool(&c.Capabilities.ReadOnly, ReadOnlyEnvKey, configErr)
+	overrideBool(&c.Capabilities.GroupUsers, CapabilityGroupUsersEnvKey, configErr)
+	overrideBool(&c.Capabilities.MemberGroups, CapabilityMemberGroupsEnvKey, configErr)
+	overrideBool(&c.Capabilities.Resources, CapabilityResourcesEnvKey, configErr)
+	c.ProtectedGroups.applyEnv(configErr)
+	c.Eligibility.applyEnv(configErr)
+	if value := os.Getenv(PolicyPathsEnvKey); value != "" {
+		c.Policies.Paths = splitList(value)
+	}
+	c.RemovalLimit.applyEnv(configErr)
+	c.Revocation.applyEnv(configErr)
+
+	overrideBool(&c.Validation.Requests, ValidateRequestsEnvKey, configErr)
+	overrideBool(&c.Validation.Responses, ValidateResponsesEnvKey, configErr)
+
+	overrideDuration(&c.Secrets.RefreshInterval, SecretsRefreshIntervalEnvKey, configErr)
+	overrideString(&c.Secrets.Vault.Address, VaultAddrEnvKey)
+	overrideString(&c.Secrets.Vault.Token, VaultTokenEnvKey)
+	overrideString(&c.Secrets.Vault.TokenFile, VaultTokenFileEnvKey)
+	overrideString(&c.Secrets.Vault.Namespace, VaultNamespaceEnvKey)
+}
+
+// Empty environment variables do not override the file, as .env files commonly leave unused keys blank
+func overrideString(field *string, envKey string) {
+	if value := os.Getenv(envKey); value != "" {
+		*field = value
+	}
+}
+
+// overrideSecret also supports the <KEY>_FILE convention, pointing at a file that holds the secret
+func overrideSecret(field *string, envKey string) {
+	if path := os.Getenv(envKey + secretFileEnvSuffix); path != "" {
+		*field = "file:" + path
+	}
+	overrideString(field, envKey)
+}
+
+func overrideBool(field *bool, envKey string, configErr *ConfigError) {
+	value := os.Getenv(envKey)
+	if value == "" {
+		return
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		configErr.add("%s must be true or false, got %q", envKey, value)
+		return
+	}
+	*field = parsed
+}
+
+func overrideInt(field *int, envKey string, configErr *ConfigError) {
+	value := os.Getenv(envKey)
+	if value == "" {
+		return
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		configErr.add("%s must be an integer, got %q", envKey, value)
+		return
+	}
+	*field = parsed
+}
+
+func overrideInt64(field *int64, envKey string, configErr *ConfigError) {
+	value := os.Getenv(envKey)
+	if value == "" {
+		return
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		configErr.add("%s must be an integer, got %q", envKey, value)
+		return
+	}
+	*field = parsed
+}
+
+func overrideDuration(field *time.Duration, envKey string, configErr *ConfigError) {
+	value := os.Getenv(envKey)
+	if value == "" {
+		return
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		configErr.add("%s must be a duration such as 5m, got %q", envKey, value)
+		return
+	}
+	*field = parsed
+}
+
+// applyDefaults fills in settings left empty. It runs after decoding rather than before, as the
+// decoder cannot pre-populate the Authentik settings of each app.
+func (c *Config) applyDefaults() {
+	c.Authentik.applyDefaults()
+	for appID, app := range c.Apps {
+		app.Authentik.applyDefaults()
+		c.Apps[appID] = app
+	}
+	c.RemovalLimit.applyDefaults()
+}
+
+func (c *AuthentikConfig) applyDefaults() {
+	if c.Scheme == "" {
+		c.Scheme = "https"
+	}
+	if c.TLS.MinVersion == "" {
+		c.TLS.MinVersion = "1.2"
+	}
+	if c.OAuth2.Scopes == nil {
+		c.OAuth2.Scopes = []string{authentikAPIScope}
+	}
+	if c.OAuth2.RefreshMargin == 0 {
+		c.OAuth2.RefreshMargin = DefaultOAuth2RefreshMargin
+	}
+}
+
+func (c *Config) validate(configErr *ConfigError) {
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		configErr.add("listen_address %q is not a valid host:port", c.ListenAddress)
+	}
+	if c.AdminListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.AdminListenAddress); err != nil {
+			configErr.add("admin_listen_address (%s) %q is not a valid host:port", AdminListenAddressEnvKey, c.AdminListenAddress)
+		} else if c.AdminListenAddress == c.ListenAddress {
+			configErr.add("admin_listen_address must differ from listen_address")
+		}
+	}
+	c.Server.validate(configErr)
+	c.ProtectedGroups.validate(configErr)
+	validateSeparationOfDuties(c.SeparationOfDuties, configErr)
+	c.Eligibility.validate(configErr)
+	c.RemovalLimit.validate(configErr)
+
+	if len(c.Apps) == 0 {
+		if c.OpalSigningSecret == "" {
+			configErr.add("opal_signing_secret (%s) is required", OpalSigningSecretEnvKey)
+		}
+		c.Authentik.validate("authentik", configErr)
+	}
+	for _, appID := range sortedAppIDs(c.Apps) {
+		app := c.Apps[appID]
+		if app.OpalSigningSecret == "" && c.OpalSigningSecret == "" {
+			configErr.add("apps.%s.opal_signing_secret is required as there is no top level opal_signing_secret", appID)
+		}
+		app.Authentik.validate("apps."+appID+".authentik", configErr)
+	}
+
+	if c.Audit.MaxBytes < 0 {
+		configErr.add("audit.max_bytes must not be negative")
+	}
+	switch c.Audit.SyslogNetwork {
+	case "", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix", "unixgram":
+	default:
+		configErr.add("audit.syslog_network %q is not a supported network", c.Audit.SyslogNetwork)
+	}
+	if c.Audit.HTTPURL != "" {
+		if parsed, err := url.Parse(c.Audit.HTTPURL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			configErr.add("audit.http_url %q is not an absolute URL", c.Audit.HTTPURL)
+		}
+	}
+
+	if c.Secrets.RefreshInterval <= 0 {
+		configErr.add("secrets.refresh_interval must be positive")
+	}
+}
+
+// validate checks the settings of one Authentik instance. Problems with the top level instance
+// mention the environment variable too, as that is where most deployments set them.
+func (c AuthentikConfig) validate(name string, configErr *ConfigError) {
+	hint := func(envKey string) string {
+		if name != "authentik" {
+			return ""
+		}
+		return " (" + envKey + ")"
+	}
+
+	if c.Host == "" {
+		configErr.add("%s.host%s is required", name, hint(AuthentikHostEnvKey))
+	} else if strings.Contains(c.Host, "://") || strings.Contains(c.Host, "/") {
+		configErr.add("%s.host must be a host name without scheme or path, got %q", name, c.Host)
+	}
+	if c.Scheme != "http" && c.Scheme != "https" {
+		configErr.add("%s.scheme%s must be http or https, got %q", name, hint(AuthentikSchemeEnvKey), c.Scheme)
+	}
+	if oauth2Config := c.OAuth2; oauth2Config.Enabled() {
+		if oauth2Config.ClientSecret == "" && oauth2Config.Password == "" {
+			configErr.add("%s.oauth2 needs a password%s for the service account or a client_secret%s", name, hint(AuthentikOAuth2PasswordEnvKey), hint(AuthentikOAuth2ClientSecretEnvKey))
+		}
+		if (oauth2Config.Username == "") != (oauth2Config.Password == "") {
+			configErr.add("%s.oauth2 needs both username%s and password%s, or neither", name, hint(AuthentikOAuth2UsernameEnvKey), hint(AuthentikOAuth2PasswordEnvKey))
+		}
+		if oauth2Config.TokenURL != "" {
+			if parsed, err := url.Parse(oauth2Config.TokenURL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				configErr.add("%s.oauth2.token_url %q is not an absolute URL", name, oauth2Config.TokenURL)
+			}
+		}
+		if oauth2Config.RefreshMargin < 0 {
+			configErr.add("%s.oauth2.refresh_margin must not be negative", name)
+		}
+	} else if c.Token == "" {
+		configErr.add("%s.token%s is required unless %s.oauth2 is configured", name, hint(AuthentikTokenEnvKey), name)
+	}
+	c.TLS.validate(name+".tls", configErr)
+	if c.ProxyURL != "" {
+		if parsed, err := url.Parse(c.ProxyURL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			configErr.add("%s.proxy_url%s %q is not an absolute URL", name, hint(AuthentikProxyEnvKey), c.ProxyURL)
+		}
+	}
+	cf := c.CloudflareAccess
+	if (cf.ClientID == "") != (cf.ClientSecret == "") {
+		configErr.add("%s.cloudflare_access needs both client_id%s and client_secret%s, or neither", name, hint(CFAccessClientIDEnvKey), hint(CFAccessSecretEnvKey))
+	}
+}
+
+// secretSettings lists the secret settings of one Authentik instance by name
+func (c AuthentikConfig) secretSettings(name string) map[string]string {
+	secrets := map[string]string{
+		name + ".token":                           c.Token,
+		name + ".oauth2.client_secret":            c.OAuth2.ClientSecret,
+		name + ".oauth2.password":                 c.OAuth2.Password,
+		name + ".cloudflare_access.client_id":     c.CloudflareAccess.ClientID,
+		name + ".cloudflare_access.client_secret": c.CloudflareAccess.ClientSecret,
+	}
+	for header, value := range c.Headers {
+		secrets[name+".headers."+header] = value
+	}
+
+	return secrets
+}
+
+// checkSecrets resolves every secret setting once, so a missing file or unreachable Vault fails at startup
+func (c *Config) checkSecrets(configErr *ConfigError) {
+	secrets := map[string]string{
+		"opal_signing_secret":          c.OpalSigningSecret,
+		"removal_limit.alert_webhook":  c.RemovalLimit.AlertWebhook,
+		"removal_limit.operator_token": c.RemovalLimit.OperatorToken,
+		"audit.http_token":             c.Audit.HTTPToken,
+	}
+	addSecrets := func(more map[string]string) {
+		for name, value := range more {
+			secrets[name] = value
+		}
+	}
+	if len(c.Apps) == 0 {
+		addSecrets(c.Authentik.secretSettings("authentik"))
+	}
+	for appID, app := range c.Apps {
+		secrets["apps."+appID+".opal_signing_secret"] = app.OpalSigningSecret
+		addSecrets(app.Authentik.secretSettings("apps." + appID + ".authentik"))
+	}
+
+	for _, name := range sortedKeys(secrets) {
+		value, err := c.ResolveSecret(secrets[name])
+		if err != nil {
+			configErr.add("%s: %v", name, err)
+		} else if value == "" && secrets[name] != "" {
+			configErr.add("%s resolved to an empty value", name)
+		}
+	}
+}
+
+// ResolveSecret returns the current value of a secret setting, see SecretProvider
+func (c *Config) ResolveSecret(value string) (string, error) {
+	if c.secrets == nil {
+		return value, nil
+	}
+
+	return c.secrets.Resolve(value)
+}
+
+// Redacted returns a copy of the configuration with every secret replaced, safe to print or log
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redactString(&redacted.OpalSigningSecret)
+	redacted.Authentik = redacted.Authentik.redacted()
+	redactString(&redacted.Audit.HTTPToken)
+	redactString(&redacted.Secrets.Vault.Token)
+	redactString(&redacted.RemovalLimit.AlertWebhook)
+	redactString(&redacted.RemovalLimit.OperatorToken)
+
+	if c.Apps != nil {
+		redacted.Apps = make(map[string]AppConfig, len(c.Apps))
+		for appID, app := range c.Apps {
+			redactString(&app.OpalSigningSecret)
+			app.Authentik = app.Authentik.redacted()
+			redacted.Apps[appID] = app
+		}
+	}
+
+	return &redacted
+}
+
+func (c AuthentikConfig) redacted() AuthentikConfig {
+	redactString(&c.Token)
+	redactString(&c.OAuth2.ClientSecret)
+	redactString(&c.OAuth2.Password)
+	redactString(&c.CloudflareAccess.ClientSecret)
+
+	// Header values are often credentials, so all of them are treated as secrets
+	if c.Headers != nil {
+		headers := make(map[string]string, len(c.Headers))
+		for header, value := range c.Headers {
+			redactString(&value)
+			headers[header] = value
+		}
+		c.Headers = headers
+	}
+
+	return c
+}
+
+// References to secrets are kept, as they say where a secret comes from without revealing it
+func redactString(field *string) {
+	if *field == "" {
+		return
+	}
+	if !isSecretRef(*field) {
+		*field = redactedValue
+		return
+	}
+	*field = redactSecretRef(*field)
+}
+
+// YAML renders the configuration in the same format LoadConfig reads
+func (c *Config) YAML() (string, error) {
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to serialize config")
+	}
+
+	return string(out), nil
+}
+
+var (
+	configMu     sync.Mutex
+	activeConfig *Config
+)
+
+// SetConfig installs the configuration the connector runs with
+func SetConfig(config *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	activeConfig = config
+}
+
+// getConfig returns the active configuration. If none was installed at startup, for example when the
+// package is used as a library, it is loaded from the environment alone.
+func getConfig() (*Config, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	if activeConfig != nil {
+		return activeConfig, nil
+	}
+
+	config, err := LoadConfig(os.Getenv(ConfigFileEnvKey))
+	if err != nil {
+		return nil, err
+	}
+	activeConfig = config
+	return activeConfig, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
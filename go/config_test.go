@@ -0,0 +1,152 @@
+package openapi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// writeConfig writes a config file with the settings every test needs, followed by extra
+func writeConfig(t *testing.T, extra string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	contents := "opal_signing_secret: from-file\n" +
+		"authentik:\n  host: authentik.example.com\n  scheme: https\n  token: file-token\n  events: true\n" + extra
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func configProblems(t *testing.T, err error) []string {
+	t.Helper()
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a ConfigError, got %v", err)
+	}
+	return configErr.Problems
+}
+
+func TestConfigEnvOverrides(t *testing.T) {
+	path := writeConfig(t, "listen_address: 0.0.0.0:8080\naudit:\n  max_bytes: 1024\n")
+	t.Setenv(ListenAddressEnvKey, "127.0.0.1:9090")
+	t.Setenv(AuthentikEventsEnvKey, "false")
+	t.Setenv(AuditLogMaxBytesEnvKey, "2048")
+	t.Setenv(SecretsRefreshIntervalEnvKey, "30s")
+	// Blank variables, as .env files often have, keep the value from the file
+	t.Setenv(AuthentikHostEnvKey, "")
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddress != "127.0.0.1:9090" || config.Authentik.Events || config.Audit.MaxBytes != 2048 || config.Secrets.RefreshInterval != 30*time.Second {
+		t.Errorf("expected the environment to override the file, got %s, %t, %d, %s",
+			config.ListenAddress, config.Authentik.Events, config.Audit.MaxBytes, config.Secrets.RefreshInterval)
+	}
+	if config.Authentik.Host != "authentik.example.com" {
+		t.Errorf("expected a blank variable to keep the file value, got %q", config.Authentik.Host)
+	}
+}
+
+func TestConfigInvalidEnv(t *testing.T) {
+	t.Setenv(AuthentikEventsEnvKey, "maybe")
+	t.Setenv(AuditLogMaxBytesEnvKey, "lots")
+	t.Setenv(SecretsRefreshIntervalEnvKey, "30")
+
+	_, err := LoadConfig(writeConfig(t, ""))
+	problems := configProblems(t, err)
+	for _, want := range []string{AuthentikEventsEnvKey + " must be true or false", AuditLogMaxBytesEnvKey + " must be an integer", SecretsRefreshIntervalEnvKey + " must be a duration"} {
+		if !strings.Contains(strings.Join(problems, "\n"), want) {
+			t.Errorf("expected %q to be reported, got %v", want, problems)
+		}
+	}
+}
+
+func TestConfigSecretFileEnv(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("token-from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(AuthentikTokenEnvKey+secretFileEnvSuffix, tokenFile)
+
+	config, err := LoadConfig(writeConfig(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Authentik.Token != "file:"+tokenFile {
+		t.Errorf("expected the setting to refer to the file, got %q", config.Authentik.Token)
+	}
+	if token, err := config.ResolveSecret(config.Authentik.Token); err != nil || token != "token-from-file" {
+		t.Errorf("expected the file contents without the newline, got %q, %v", token, err)
+	}
+
+	// The variable itself wins over <KEY>_FILE
+	t.Setenv(AuthentikTokenEnvKey, "token-from-env")
+	if config, err := LoadConfig(writeConfig(t, "")); err != nil || config.Authentik.Token != "token-from-env" {
+		t.Errorf("expected the variable to take precedence, got %v", err)
+	}
+
+	// A missing file fails at startup rather than on the first request
+	t.Setenv(AuthentikTokenEnvKey, "")
+	t.Setenv(AuthentikTokenEnvKey+secretFileEnvSuffix, filepath.Join(dir, "missing"))
+	_, err = LoadConfig(writeConfig(t, ""))
+	if problems := configProblems(t, err); len(problems) != 1 || !strings.HasPrefix(problems[0], "authentik.token: ") {
+		t.Errorf("expected the missing secret file to be reported, got %v", problems)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	// Every problem is reported at once
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("listen_address: nowhere\nauthentik:\n  host: https://authentik.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadConfig(path)
+	problems := configProblems(t, err)
+	for _, want := range []string{"listen_address", "opal_signing_secret", "authentik.host", "authentik.token"} {
+		if !strings.Contains(strings.Join(problems, "\n"), want) {
+			t.Errorf("expected %s to be reported, got %v", want, problems)
+		}
+	}
+
+	// Unknown keys are rejected instead of being ignored
+	if _, err := LoadConfig(writeConfig(t, "dryrun: true\n")); err == nil || !strings.Contains(err.Error(), "field dryrun not found") {
+		t.Errorf("expected the unknown key to be rejected, got %v", err)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	signingSecret := "exec:/usr/local/bin/get-secret --password hunter2 signing"
+	config := &Config{
+		OpalSigningSecret: "plain-secret",
+		Authentik:         AuthentikConfig{Token: "exec:get-token", Headers: map[string]string{"X-Api-Key": "plain-key"}},
+		Audit:             AuditConfig{HTTPToken: "file:/run/secrets/audit"},
+		Apps: map[string]AppConfig{testAppID: {
+			OpalSigningSecret: signingSecret,
+			Authentik:         AuthentikConfig{Token: "vault:secret/data/opal#token"},
+		}},
+	}
+
+	redacted := config.Redacted()
+	for name, test := range map[string]struct{ got, want string }{
+		"plain secret":      {redacted.OpalSigningSecret, redactedValue},
+		"header":            {redacted.Authentik.Headers["X-Api-Key"], redactedValue},
+		"command":           {redacted.Authentik.Token, "exec:get-token"},
+		"command arguments": {redacted.Apps[testAppID].OpalSigningSecret, "exec:/usr/local/bin/get-secret " + redactedValue},
+		"file reference":    {redacted.Audit.HTTPToken, "file:/run/secrets/audit"},
+		"vault reference":   {redacted.Apps[testAppID].Authentik.Token, "vault:secret/data/opal#token"},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: expected %q, got %q", name, test.want, test.got)
+		}
+	}
+	if config.Apps[testAppID].OpalSigningSecret != signingSecret || config.Authentik.Headers["X-Api-Key"] != "plain-key" {
+		t.Error("expected redacting not to change the configuration")
+	}
+}
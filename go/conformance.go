@@ -0,0 +1,428 @@
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/pkg/errors"
+)
+
+// Defaults for ConformanceOptions
+const (
+	DefaultConformanceSampleSize = 5
+	DefaultConformanceMaxPages   = 1000
+)
+
+// ConformanceOptions describes how a deployed connector is checked against api/openapi.yaml
+type ConformanceOptions struct {
+	Client *OpalClient
+	// Group used for add and remove round trips. They are skipped when it is empty.
+	TestGroupID string
+	// User added to and removed from the test group, and left as it was found
+	TestUserID string
+	// Group nested into and removed from the test group, and left as it was found
+	TestMemberGroupID string
+	// Get-by-ID checks are run on this many groups and resources
+	SampleSize int
+	// Pagination is reported as broken when it does not end after this many pages
+	MaxPages int
+}
+
+type ConformanceResult struct {
+	Check   string
+	Passed  bool
+	Skipped bool
+	// Problems found, or why the check was skipped
+	Details []string
+}
+
+type ConformanceReport struct {
+	Results []ConformanceResult
+}
+
+// Failed returns how many checks failed
+func (r *ConformanceReport) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if !result.Passed && !result.Skipped {
+			failed++
+		}
+	}
+	return failed
+}
+
+type conformanceRun struct {
+	ctx     context.Context
+	opts    ConformanceOptions
+	doc     *openapi3.T
+	options *openapi3filter.Options
+	report  *ConformanceReport
+}
+
+// RunConformance acts like Opal against a deployed connector. It walks every endpoint of the spec,
+// following cursors to the last page, fetches a sample of groups and resources by ID and, when a
+// test group is given, adds and removes members on it. Responses are checked against the spec.
+func RunConformance(ctx context.Context, opts ConformanceOptions) (*ConformanceReport, error) {
+	doc, err := loadSpec()
+	if err != nil {
+		return nil, err
+	}
+	if opts.SampleSize <= 0 {
+		opts.SampleSize = DefaultConformanceSampleSize
+	}
+	if opts.MaxPages <= 0 {
+		opts.MaxPages = DefaultConformanceMaxPages
+	}
+
+	run := &conformanceRun{
+		ctx:     ctx,
+		opts:    opts,
+		doc:     doc,
+		options: specValidationOptions(),
+		report:  &ConformanceReport{},
+	}
+
+	run.checkStatus()
+	run.checkSignatureRequired()
+	run.paginate("list users", "/users", nil, "users", "id")
+	groupIDs := run.paginate("list groups", "/groups", nil, "groups", "id")
+	for _, groupID := range sample(groupIDs, opts.SampleSize) {
+		run.checkGroup(groupID)
+	}
+	resourceIDs := run.paginate("list resources", "/resources", nil, "resources", "id")
+	for _, resourceID := range sample(resourceIDs, opts.SampleSize) {
+		run.checkResource(resourceID)
+	}
+	run.checkUnknownGroup()
+	run.checkUserRoundTrip()
+	run.checkMemberGroupRoundTrip()
+
+	return run.report, nil
+}
+
+func (r *conformanceRun) record(check string, problems []string) {
+	r.report.Results = append(r.report.Results, ConformanceResult{
+		Check:   check,
+		Passed:  len(problems) == 0,
+		Details: problems,
+	})
+}
+
+func (r *conformanceRun) skip(check string, reason string) {
+	r.report.Results = append(r.report.Results, ConformanceResult{
+		Check:   check,
+		Skipped: true,
+		Details: []string{reason},
+	})
+}
+
+// call sends a signed request to the operation at template, e.g. "/groups/{group_id}", and checks
+// the response against the spec. Error responses must have an Error body, whatever their status.
+func (r *conformanceRun) call(method string, template string, params map[string]string, query url.Values, body interface{}) (*OpalResponse, []string) {
+	path := template
+	for name, value := range params {
+		path = strings.ReplaceAll(path, "{"+name+"}", url.PathEscape(value))
+	}
+
+	var bodyBytes []byte
+	if body != nil {
+		var err error
+		if bodyBytes, err = json.Marshal(body); err != nil {
+			return nil, []string{err.Error()}
+		}
+	}
+
+	resp, err := r.opts.Client.Do(r.ctx, method, path, query, bodyBytes)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	return resp, r.checkResponse(method, template, params, resp)
+}
+
+func (r *conformanceRun) checkResponse(method string, template string, params map[string]string, resp *OpalResponse) []string {
+	var problems []string
+	where := method + " " + resp.Request.URL.Path
+
+	if pathItem := r.doc.Paths.Find(template); pathItem != nil && pathItem.GetOperation(method) != nil {
+		err := openapi3filter.ValidateResponse(r.ctx, &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: &openapi3filter.RequestValidationInput{
+				Request:    resp.Request,
+				PathParams: params,
+				Route: &routers.Route{
+					Spec:      r.doc,
+					Path:      template,
+					PathItem:  pathItem,
+					Method:    method,
+					Operation: pathItem.GetOperation(method),
+				},
+				Options: r.options,
+			},
+			Status:  resp.StatusCode,
+			Header:  resp.Header,
+			Body:    io.NopCloser(bytes.NewReader(resp.Body)),
+			Options: r.options,
+		})
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: schema violation: %v", where, err))
+		}
+	}
+
+	if resp.StatusCode >= 400 {
+		if err := r.checkErrorBody(resp.Body); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %d error body is not an Error: %v", where, resp.StatusCode, err))
+		}
+	}
+
+	return problems
+}
+
+func (r *conformanceRun) checkErrorBody(body []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return errors.Errorf("not JSON: %q", truncate(string(body), 200))
+	}
+
+	schema := r.doc.Components.Schemas["Error"]
+	if schema == nil || schema.Value == nil {
+		return nil
+	}
+	if err := schema.Value.VisitJSON(value, openapi3.SetSchemaErrorMessageCustomizer(schemaErrorMessage)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func expectStatus(resp *OpalResponse, status int) []string {
+	if resp == nil || resp.StatusCode == status {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s %s: expected %d, got %d: %s",
+		resp.Request.Method, resp.Request.URL.Path, status, resp.StatusCode, truncate(string(resp.Body), 200))}
+}
+
+func (r *conformanceRun) checkStatus() {
+	resp, problems := r.call(http.MethodGet, "/status", nil, nil, nil)
+	r.record("status", append(problems, expectStatus(resp, http.StatusOK)...))
+}
+
+func (r *conformanceRun) checkSignatureRequired() {
+	req, err := r.opts.Client.NewRequest(r.ctx, http.MethodGet, "/groups", nil, nil)
+	if err != nil {
+		r.record("requests with a bad signature are rejected", []string{err.Error()})
+		return
+	}
+	req.Header.Set("X-Opal-Signature", strings.Repeat("0", 64))
+
+	resp, err := r.opts.Client.Send(req)
+	if err != nil {
+		r.record("requests with a bad signature are rejected", []string{err.Error()})
+		return
+	}
+	problems := r.checkResponse(http.MethodGet, "/groups", nil, resp)
+	r.record("requests with a bad signature are rejected", append(problems, expectStatus(resp, http.StatusUnauthorized)...))
+}
+
+// paginate lists every item of a paginated endpoint and records the outcome as a check
+func (r *conformanceRun) paginate(check string, template string, params map[string]string, itemsKey string, idKey string) []string {
+	ids, problems := r.collect(template, params, itemsKey, idKey)
+	r.record(fmt.Sprintf("%s (%d items)", check, len(ids)), problems)
+	return ids
+}
+
+// collect follows next_cursor from the first page to the last and returns the idKey of every item.
+// A cursor that comes back a second time means Opal would loop forever.
+func (r *conformanceRun) collect(template string, params map[string]string, itemsKey string, idKey string) ([]string, []string) {
+	var ids, problems []string
+	seen := make(map[string]bool)
+	cursor := ""
+
+	for page := 1; ; page++ {
+		if page > r.opts.MaxPages {
+			problems = append(problems, fmt.Sprintf("still not on the last page after %d pages", r.opts.MaxPages))
+			break
+		}
+
+		var query url.Values
+		if cursor != "" {
+			query = url.Values{PageQueryParam: {cursor}}
+		}
+		resp, callProblems := r.call(http.MethodGet, template, params, query, nil)
+		problems = append(problems, callProblems...)
+		if resp == nil {
+			break
+		}
+		if resp.StatusCode != http.StatusOK {
+			problems = append(problems, expectStatus(resp, http.StatusOK)...)
+			break
+		}
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(resp.Body, &body); err != nil {
+			problems = append(problems, fmt.Sprintf("page %d is not a JSON object", page))
+			break
+		}
+		items, _ := body[itemsKey].([]interface{})
+		for _, item := range items {
+			if fields, ok := item.(map[string]interface{}); ok {
+				if id, ok := fields[idKey].(string); ok {
+					ids = append(ids, id)
+				}
+			}
+		}
+
+		next, _ := body["next_cursor"].(string)
+		if next == "" {
+			break
+		}
+		if seen[next] || next == cursor {
+			problems = append(problems, fmt.Sprintf("cursor loop: cursor %q was returned again on page %d", next, page))
+			break
+		}
+		seen[next] = true
+		cursor = next
+	}
+
+	return ids, problems
+}
+
+func (r *conformanceRun) checkGroup(groupID string) {
+	params := map[string]string{"group_id": groupID}
+
+	resp, problems := r.call(http.MethodGet, "/groups/{group_id}", params, nil, nil)
+	r.record("get group "+groupID, append(problems, expectStatus(resp, http.StatusOK)...))
+
+	r.paginate("list users of group "+groupID, "/groups/{group_id}/users", params, "users", "user_id")
+	r.paginate("list member groups of group "+groupID, "/groups/{group_id}/member-groups", params, "groups", "group_id")
+	r.paginate("list resources of group "+groupID, "/groups/{group_id}/resources", params, "resources", "resource_id")
+}
+
+func (r *conformanceRun) checkResource(resourceID string) {
+	params := map[string]string{"resource_id": resourceID}
+
+	resp, problems := r.call(http.MethodGet, "/resources/{resource_id}", params, nil, nil)
+	r.record("get resource "+resourceID, append(problems, expectStatus(resp, http.StatusOK)...))
+
+	r.paginate("list access levels of resource "+resourceID, "/resources/{resource_id}/access_levels", params, "access_levels", "id")
+	r.paginate("list users of resource "+resourceID, "/resources/{resource_id}/users", params, "users", "user_id")
+}
+
+func (r *conformanceRun) checkUnknownGroup() {
+	params := map[string]string{"group_id": "opal-conformance-missing-group"}
+
+	resp, problems := r.call(http.MethodGet, "/groups/{group_id}", params, nil, nil)
+	if resp != nil && resp.StatusCode < 400 {
+		problems = append(problems, fmt.Sprintf("expected an error for a group that does not exist, got %d", resp.StatusCode))
+	}
+	r.record("unknown group is an error", problems)
+}
+
+// checkUserRoundTrip adds the test user to the test group and removes it again, or the other way
+// round if it already is a member, so the group ends up as it was
+func (r *conformanceRun) checkUserRoundTrip() {
+	check := "add and remove user on test group"
+	if r.opts.TestGroupID == "" || r.opts.TestUserID == "" {
+		r.skip(check, "no test group and user given")
+		return
+	}
+
+	add := func() []string {
+		resp, problems := r.call(http.MethodPost, "/groups/{group_id}/users", map[string]string{"group_id": r.opts.TestGroupID}, nil,
+			map[string]string{"user_id": r.opts.TestUserID, "app_id": r.opts.Client.AppID})
+		return append(problems, expectStatus(resp, http.StatusOK)...)
+	}
+	remove := func() []string {
+		resp, problems := r.call(http.MethodDelete, "/groups/{group_id}/users/{user_id}",
+			map[string]string{"group_id": r.opts.TestGroupID, "user_id": r.opts.TestUserID}, nil, nil)
+		return append(problems, expectStatus(resp, http.StatusOK)...)
+	}
+	isMember := func() (bool, []string) {
+		members, problems := r.collect("/groups/{group_id}/users", map[string]string{"group_id": r.opts.TestGroupID}, "users", "user_id")
+		return contains(members, r.opts.TestUserID), problems
+	}
+
+	r.roundTrip(check, "user "+r.opts.TestUserID, isMember, add, remove)
+}
+
+func (r *conformanceRun) checkMemberGroupRoundTrip() {
+	check := "add and remove member group on test group"
+	if r.opts.TestGroupID == "" || r.opts.TestMemberGroupID == "" {
+		r.skip(check, "no test group and member group given")
+		return
+	}
+
+	add := func() []string {
+		resp, problems := r.call(http.MethodPost, "/groups/{group_id}/member-groups", map[string]string{"group_id": r.opts.TestGroupID}, nil,
+			map[string]string{"group_id": r.opts.TestMemberGroupID, "app_id": r.opts.Client.AppID})
+		return append(problems, expectStatus(resp, http.StatusOK)...)
+	}
+	remove := func() []string {
+		resp, problems := r.call(http.MethodDelete, "/groups/{group_id}/member-groups/{member_group_id}",
+			map[string]string{"group_id": r.opts.TestGroupID, "member_group_id": r.opts.TestMemberGroupID}, nil, nil)
+		return append(problems, expectStatus(resp, http.StatusOK)...)
+	}
+	isMember := func() (bool, []string) {
+		members, problems := r.collect("/groups/{group_id}/member-groups", map[string]string{"group_id": r.opts.TestGroupID}, "groups", "group_id")
+		return contains(members, r.opts.TestMemberGroupID), problems
+	}
+
+	r.roundTrip(check, "group "+r.opts.TestMemberGroupID, isMember, add, remove)
+}
+
+func (r *conformanceRun) roundTrip(check string, member string, isMember func() (bool, []string), add func() []string, remove func() []string) {
+	steps := []struct {
+		name   string
+		do     func() []string
+		member bool
+	}{{"add", add, true}, {"remove", remove, false}}
+
+	wasMember, problems := isMember()
+	if len(problems) > 0 {
+		r.record(check, problems)
+		return
+	}
+	if wasMember {
+		steps[0], steps[1] = steps[1], steps[0]
+	}
+
+	for _, step := range steps {
+		if problems = step.do(); len(problems) > 0 {
+			break
+		}
+		nowMember, listProblems := isMember()
+		if problems = listProblems; len(problems) > 0 {
+			break
+		}
+		if nowMember != step.member {
+			problems = []string{fmt.Sprintf("%s of %s succeeded but is not reflected in the membership list", step.name, member)}
+			break
+		}
+	}
+
+	r.record(check, problems)
+}
+
+func sample(ids []string, size int) []string {
+	if len(ids) > size {
+		return ids[:size]
+	}
+	return ids
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
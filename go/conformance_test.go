@@ -0,0 +1,69 @@
+package openapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+	connector := httptest.NewServer(tc.router)
+	defer connector.Close()
+
+	report, err := RunConformance(context.Background(), ConformanceOptions{
+		Client: &OpalClient{
+			BaseURL:       connector.URL,
+			AppID:         testAppID,
+			SigningSecret: testSigningSecret,
+		},
+		TestGroupID:       "eng",
+		TestUserID:        "2",
+		TestMemberGroupID: "platform",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range report.Results {
+		if !result.Passed || result.Skipped {
+			t.Errorf("%s failed: %v", result.Check, result.Details)
+		}
+	}
+
+	if group, _ := tc.authentik.Group("eng"); len(group.Users) != 1 || group.Users[0] != 1 {
+		t.Fatalf("round trips must leave the test group as it was, members are %v", group.Users)
+	}
+	if group, _ := tc.authentik.Group("platform"); group.Parent != "" {
+		t.Fatalf("round trips must leave the member group as it was, parent is %q", group.Parent)
+	}
+}
+
+func TestConformanceDetectsCursorLoops(t *testing.T) {
+	// A connector that always hands out the same cursor
+	connector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"users":[{"id":"1","email":"alice@example.com"}],"next_cursor":"2"}`))
+	}))
+	defer connector.Close()
+
+	report, err := RunConformance(context.Background(), ConformanceOptions{
+		Client: &OpalClient{BaseURL: connector.URL, AppID: testAppID, SigningSecret: testSigningSecret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range report.Results {
+		if strings.HasPrefix(result.Check, "list users") {
+			if result.Passed || len(result.Details) == 0 || !strings.Contains(result.Details[0], "cursor loop") {
+				t.Fatalf("expected a cursor loop to be reported, got %+v", result)
+			}
+			return
+		}
+	}
+	t.Fatal("users were not listed")
+}
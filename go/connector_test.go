@@ -0,0 +1,183 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	testSigningSecret = "test-signing-secret"
+	testToken         = "test-token"
+	testAppID         = "test-app"
+)
+
+// testConnector is the connector's router wired to a fake Authentik
+type testConnector struct {
+	t         *testing.T
+	authentik *authentiktest.Server
+	router    *gin.Engine
+	auditFile string
+}
+
+// newTestConnector starts a fake Authentik and builds the router against it. extraConfig is appended
+// to the generated config file, right after the authentik section. Responses are checked against the
+// spec unless extraConfig has its own validation section.
+func newTestConnector(t *testing.T, extraConfig string) *testConnector {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	fake := authentiktest.NewServer(testToken)
+	t.Cleanup(fake.Close)
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	contents := "opal_signing_secret: " + testSigningSecret + "\n"
+	if !strings.Contains(extraConfig, "validation:") {
+		contents += "validation:\n  responses: true\n"
+	}
+	contents += "authentik:\n  host: " + fake.Host() + "\n  scheme: http\n  token: " + testToken + "\n" +
+		extraConfig
+	if err := os.WriteFile(configPath, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	SetConfig(config)
+	t.Cleanup(func() { SetConfig(nil) })
+
+	auditFile := filepath.Join(dir, "audit.jsonl")
+	sink, err := NewFileAuditSink(auditFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := NewAuditLogger(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetAuditLogger(logger)
+	t.Cleanup(func() {
+		SetAuditLogger(nil)
+		logger.Close()
+	})
+
+	return &testConnector{
+		t:         t,
+		authentik: fake,
+		router:    NewRouter(ApiHandleFunctions{}),
+		auditFile: auditFile,
+	}
+}
+
+// do sends a request signed the way Opal signs it
+func (tc *testConnector) do(method string, path string, body string) *httptest.ResponseRecorder {
+	tc.t.Helper()
+	return tc.serve(tc.signedRequest(method, path, body))
+}
+
+// signedRequest builds a request signed the way Opal signs it, for tests that need to modify it
+func (tc *testConnector) signedRequest(method string, path string, body string) *http.Request {
+	tc.t.Helper()
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signedBody := body
+	if signedBody == "" {
+		signedBody = "{}"
+	}
+	signature, err := GenerateSignature(testSigningSecret, timestamp, []byte(signedBody))
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("X-Opal-Request-Timestamp", timestamp)
+	req.Header.Set("X-Opal-Signature", signature)
+
+	return req
+}
+
+func (tc *testConnector) serve(req *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	tc.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// auditEntries returns the entries written to the audit log so far
+func (tc *testConnector) auditEntries() []AuditEntry {
+	tc.t.Helper()
+
+	contents, err := os.ReadFile(tc.auditFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	var entries []AuditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			tc.t.Fatalf("invalid audit line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// decode checks the status code and unmarshals the response body into v
+func decode(t *testing.T, recorder *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+
+	if recorder.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, recorder.Code, recorder.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+		t.Fatalf("unable to decode %s: %v", recorder.Body.String(), err)
+	}
+}
+
+// appPath appends the app_id Opal sends with every request
+func appPath(path string) string {
+	if strings.Contains(path, "?") {
+		return path + "&app_id=" + testAppID
+	}
+	return path + "?app_id=" + testAppID
+}
+
+// testClient returns a client for the fake Authentik of the current test connector
+func testClient(t *testing.T) *AuthentikClient {
+	t.Helper()
+
+	config, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewAuthentikClientForBackend(config.Backends()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
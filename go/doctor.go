@@ -0,0 +1,293 @@
+package openapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Result of a doctor check
+const (
+	DoctorPass = "PASS"
+	DoctorWarn = "WARN"
+	DoctorFail = "FAIL"
+	DoctorSkip = "SKIP"
+)
+
+const (
+	doctorProbeTimeout = 10 * time.Second
+	// Drift beyond which OAuth2 tokens may be treated as expired or not yet valid
+	doctorMaxClockDrift  = time.Minute
+	doctorWarnClockDrift = 5 * time.Second
+	// Shorter secrets are unlikely to have been generated by Opal
+	doctorMinSigningSecretLength = 16
+)
+
+// DoctorResult is the outcome of one doctor check, with a hint on how to fix it when it did not pass
+type DoctorResult struct {
+	Check  string
+	Status string
+	Detail string
+	Hint   string
+}
+
+type DoctorReport struct {
+	Results []DoctorResult
+}
+
+// Failed returns the number of checks that failed
+func (r *DoctorReport) Failed() int {
+	return r.Count(DoctorFail)
+}
+
+// Count returns the number of checks with the given status
+func (r *DoctorReport) Count(status string) int {
+	count := 0
+	for _, result := range r.Results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// RunDoctor checks that the connector can work with the given configuration: that each Authentik
+// instance is reachable through Cloudflare Access, accepts the credentials, grants the permissions
+// the connector needs and agrees on the time, and that the signing secrets look right.
+func RunDoctor(ctx context.Context, config *Config) *DoctorReport {
+	report := &DoctorReport{}
+	for _, backend := range config.Backends() {
+		prefix := ""
+		if len(config.Apps) > 0 {
+			prefix = backend.Name + ": "
+		}
+		run := &doctorRun{ctx: ctx, backend: backend, prefix: prefix, report: report}
+		run.checkSigningSecret()
+		if run.checkReachable() {
+			run.checkAuthentik()
+		}
+	}
+
+	return report
+}
+
+type doctorRun struct {
+	ctx     context.Context
+	backend *Backend
+	prefix  string
+	report  *DoctorReport
+}
+
+func (r *doctorRun) add(check string, status string, detail string, hint string) {
+	r.report.Results = append(r.report.Results, DoctorResult{
+		Check:  r.prefix + check,
+		Status: status,
+		Detail: detail,
+		Hint:   hint,
+	})
+}
+
+func (r *doctorRun) checkSigningSecret() {
+	const check = "signing secret"
+	const hint = "copy the signing secret of the custom app in Opal into " + OpalSigningSecretEnvKey + " again"
+
+	secret, err := r.backend.SigningSecret()
+	switch {
+	case err != nil:
+		r.add(check, DoctorFail, err.Error(), "check that the secret reference is readable")
+	case secret == "":
+		r.add(check, DoctorFail, "empty", hint)
+	case strings.TrimSpace(secret) != secret:
+		r.add(check, DoctorFail, "has leading or trailing whitespace", hint)
+	case strings.Trim(secret, `"'`) != secret:
+		r.add(check, DoctorFail, "is wrapped in quotes", "remove the quotes, env files passed to Docker keep them")
+	case strings.HasPrefix(secret, "<") && strings.HasSuffix(secret, ">"):
+		r.add(check, DoctorFail, "is still the placeholder "+secret, hint)
+	case len(secret) < doctorMinSigningSecretLength:
+		r.add(check, DoctorWarn, fmt.Sprintf("only %d characters long", len(secret)), hint)
+	default:
+		r.add(check, DoctorPass, fmt.Sprintf("%d characters", len(secret)), "")
+	}
+}
+
+// checkReachable probes Authentik without credentials, which also shows whether Cloudflare Access
+// lets the connector through and what time Authentik thinks it is. It reports whether the API can be used.
+func (r *doctorRun) checkReachable() bool {
+	authentikConfig := r.backend.Authentik
+	cfConfigured := authentikConfig.CloudflareAccess.ClientID != ""
+	probeURL := authentikConfig.Scheme + "://" + authentikConfig.Host + "/api/v3/root/config/"
+
+	client, err := r.backend.httpClient()
+	if err != nil {
+		r.add("authentik reachable", DoctorFail, err.Error(), "check that the Cloudflare Access credentials and headers can be read")
+		return false
+	}
+	client.Timeout = doctorProbeTimeout
+	// A redirect to the Cloudflare Access login page means the request was not let through
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		r.add("authentik reachable", DoctorFail, err.Error(), "check authentik.host and authentik.scheme")
+		return false
+	}
+	sent := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		r.add("authentik reachable", DoctorFail, err.Error(),
+			"check "+AuthentikHostEnvKey+" and "+AuthentikSchemeEnvKey+", DNS, firewalls, the proxy settings and the trusted CAs")
+		return false
+	}
+	resp.Body.Close()
+	received := time.Now()
+
+	blockedByAccess := isCloudflareAccessBlock(resp)
+	switch {
+	case blockedByAccess && cfConfigured:
+		r.add("cloudflare access", DoctorFail, "the service token was rejected ("+resp.Status+")",
+			"check "+CFAccessClientIDEnvKey+" and "+CFAccessSecretEnvKey+" and that the Access policy has a Service Auth rule for the token")
+	case blockedByAccess:
+		r.add("cloudflare access", DoctorFail, "Authentik is behind Cloudflare Access but no service token is configured",
+			"create an Access service token and set "+CFAccessClientIDEnvKey+" and "+CFAccessSecretEnvKey)
+	case cfConfigured:
+		r.add("cloudflare access", DoctorPass, "service token accepted", "")
+	default:
+		r.add("cloudflare access", DoctorSkip, "not configured", "")
+	}
+	if blockedByAccess {
+		r.add("authentik reachable", DoctorFail, "blocked by Cloudflare Access", "see the cloudflare access check")
+		return false
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		r.add("authentik reachable", DoctorFail, probeURL+" returned "+resp.Status,
+			"check that "+AuthentikHostEnvKey+" points at Authentik itself and not at another service or path")
+		return false
+	}
+	r.add("authentik reachable", DoctorPass, fmt.Sprintf("%s responded in %s", authentikConfig.Host, received.Sub(sent).Round(time.Millisecond)), "")
+
+	r.checkClockDrift(resp, sent, received)
+	return true
+}
+
+func isCloudflareAccessBlock(resp *http.Response) bool {
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		location, err := url.Parse(resp.Header.Get("Location"))
+		return err == nil && strings.HasSuffix(location.Hostname(), ".cloudflareaccess.com")
+	}
+	return (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized) &&
+		strings.EqualFold(resp.Header.Get("Server"), "cloudflare")
+}
+
+func (r *doctorRun) checkClockDrift(resp *http.Response, sent time.Time, received time.Time) {
+	const check = "clock drift"
+	const hint = "synchronise the clocks with NTP, OAuth2 tokens and audit timestamps depend on them"
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		r.add(check, DoctorSkip, "Authentik did not send a Date header", "")
+		return
+	}
+
+	// The Date header has a resolution of a second and was set somewhere between sending and receiving
+	local := sent.Add(received.Sub(sent) / 2).Truncate(time.Second)
+	drift := local.Sub(serverTime)
+	detail := fmt.Sprintf("local clock is %s %s of Authentik", absDuration(drift), aheadOrBehind(drift))
+	switch {
+	case absDuration(drift) > doctorMaxClockDrift:
+		r.add(check, DoctorFail, detail, hint)
+	case absDuration(drift) > doctorWarnClockDrift:
+		r.add(check, DoctorWarn, detail, hint)
+	default:
+		r.add(check, DoctorPass, detail, "")
+	}
+}
+
+// checkAuthentik checks the credentials, the version and the permissions of the service account
+func (r *doctorRun) checkAuthentik() {
+	permissions := r.backend.RequiredPermissions()
+	skipPermissions := func(reason string) {
+		for _, permission := range permissions {
+			r.add("permission "+permission, DoctorSkip, reason, "")
+		}
+	}
+
+	client, err := NewAuthentikClientForBackend(r.backend)
+	if err != nil {
+		r.add("credentials", DoctorFail, err.Error(), "check that "+AuthentikTokenEnvKey+" is set and its secret reference is readable")
+		skipPermissions("no credentials")
+		return
+	}
+	ctx := client.addAuthTokenToCtx(r.ctx)
+
+	method := "an API token"
+	if r.backend.Authentik.OAuth2.Enabled() {
+		method = "OAuth2 client credentials"
+	}
+	me, resp, err := client.client.CoreApi.CoreUsersMeRetrieve(ctx).Execute()
+	if err != nil {
+		hint := "the token is invalid, expired or was deleted, run the bootstrap command or create a new API token"
+		if r.backend.Authentik.OAuth2.Enabled() {
+			hint = "check the OAuth2 client ID, the service account's app password and that the provider has the goauthentik.io/api scope mapping"
+		}
+		r.add("credentials", DoctorFail, bootstrapError(resp, "Authentik rejected "+method, err).Error(), hint)
+		skipPermissions("not authenticated")
+		return
+	}
+	user := me.User
+	r.add("credentials", DoctorPass, "authenticated as "+user.Username+" with "+method, "")
+	if !user.IsActive {
+		r.add("service account active", DoctorFail, user.Username+" is deactivated", "activate the service account in Directory → Users")
+	}
+
+	version, resp, err := client.client.AdminApi.AdminVersionRetrieve(ctx).Execute()
+	switch {
+	case err != nil && resp != nil && resp.StatusCode == http.StatusForbidden:
+		r.add("authentik version", DoctorSkip, "the service account may not read the version", "")
+	case err != nil:
+		r.add("authentik version", DoctorWarn, bootstrapError(resp, "failed to read the version", err).Error(), "")
+	case version.Outdated:
+		r.add("authentik version", DoctorWarn, version.VersionCurrent+", "+version.VersionLatest+" is available", "upgrade Authentik")
+	default:
+		r.add("authentik version", DoctorPass, version.VersionCurrent, "")
+	}
+
+	if user.IsSuperuser {
+		for _, permission := range permissions {
+			r.add("permission "+permission, DoctorPass, user.Username+" is a superuser", "")
+		}
+		return
+	}
+	held, err := client.userPermissions(ctx, user.Pk)
+	if err != nil {
+		skipPermissions(err.Error())
+		return
+	}
+	for _, permission := range permissions {
+		if held[permission] {
+			r.add("permission "+permission, DoctorPass, "assigned", "")
+		} else {
+			r.add("permission "+permission, DoctorFail, "not assigned to "+user.Username,
+				"run the bootstrap command, or assign it in Directory → Users → "+user.Username+" → Permissions (permissions granted through roles are not seen here)")
+		}
+	}
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func aheadOrBehind(d time.Duration) string {
+	if d < 0 {
+		return "behind"
+	}
+	return "ahead"
+}
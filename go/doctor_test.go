@@ -0,0 +1,105 @@
+package openapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+func doctorConfig(t *testing.T, host string, extraConfig string) *Config {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	contents := "opal_signing_secret: " + testSigningSecret + "\n" +
+		"authentik:\n  host: " + host + "\n  scheme: http\n  token: service-token\n" + extraConfig
+	if err := os.WriteFile(configPath, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	return config
+}
+
+func doctorStatuses(report *DoctorReport) map[string]string {
+	statuses := make(map[string]string)
+	for _, result := range report.Results {
+		statuses[result.Check] = result.Status
+	}
+	return statuses
+}
+
+func TestDoctorReportsMissingPermissions(t *testing.T) {
+	fake := authentiktest.NewServer(testAdminToken)
+	defer fake.Close()
+	fake.AddUser(authentiktest.User{
+		Pk:          5,
+		Username:    "opal-connector",
+		Permissions: []string{"authentik_core.view_user", "authentik_core.view_group"},
+	})
+	fake.AddToken(authentiktest.Token{Identifier: "opal", Key: "service-token", User: 5, Intent: "api"})
+
+	report := RunDoctor(context.Background(), doctorConfig(t, fake.Host(), ""))
+	statuses := doctorStatuses(report)
+
+	for check, want := range map[string]string{
+		"signing secret":                                   DoctorPass,
+		"authentik reachable":                              DoctorPass,
+		"cloudflare access":                                DoctorSkip,
+		"clock drift":                                      DoctorPass,
+		"credentials":                                      DoctorPass,
+		"authentik version":                                DoctorPass,
+		"permission authentik_core.view_user":              DoctorPass,
+		"permission authentik_core.view_group":             DoctorPass,
+		"permission authentik_core.add_user_to_group":      DoctorFail,
+		"permission authentik_core.change_group":           DoctorFail,
+		"permission authentik_core.remove_user_from_group": DoctorFail,
+	} {
+		if statuses[check] != want {
+			t.Errorf("expected %s to be %s, got %q", check, want, statuses[check])
+		}
+	}
+	if report.Failed() != 3 {
+		t.Errorf("expected 3 failed checks, got %+v", report.Results)
+	}
+}
+
+func TestDoctorReportsInvalidToken(t *testing.T) {
+	fake := authentiktest.NewServer(testAdminToken)
+	defer fake.Close()
+
+	report := RunDoctor(context.Background(), doctorConfig(t, fake.Host(), ""))
+	statuses := doctorStatuses(report)
+
+	if statuses["credentials"] != DoctorFail {
+		t.Errorf("expected the credentials check to fail, got %+v", report.Results)
+	}
+	if statuses["permission authentik_core.view_user"] != DoctorSkip {
+		t.Errorf("expected permission checks to be skipped, got %+v", report.Results)
+	}
+}
+
+func TestDoctorDetectsCloudflareAccess(t *testing.T) {
+	access := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.cloudflareaccess.com/cdn-cgi/access/login", http.StatusFound)
+	}))
+	defer access.Close()
+
+	report := RunDoctor(context.Background(), doctorConfig(t, strings.TrimPrefix(access.URL, "http://"), ""))
+	statuses := doctorStatuses(report)
+
+	if statuses["cloudflare access"] != DoctorFail || statuses["authentik reachable"] != DoctorFail {
+		t.Errorf("expected Cloudflare Access to be reported, got %+v", report.Results)
+	}
+	if _, ok := statuses["credentials"]; ok {
+		t.Errorf("expected no credential checks while Authentik is unreachable, got %+v", report.Results)
+	}
+}
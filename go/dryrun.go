@@ -0,0 +1,57 @@
+package openapi
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const DryRunEnvKey = "DRY_RUN"
+
+// Requests carrying this header are simulated like in dry-run mode. The connector sets it on the
+// responses to simulated changes.
+const DryRunHeader = "X-Opal-Dry-Run"
+
+// dryRun reports whether a membership change should only be simulated
+func (c *AuthentikClient) dryRun(options ChangeOptions) bool {
+	return c.backend.config.DryRun || options.DryRun
+}
+
+// dryRunRequested reports whether an Opal request asks for its change to be simulated. The header is
+// not covered by the signature, so a value that is neither true nor false is refused rather than guessed.
+func dryRunRequested(c *gin.Context) (bool, error) {
+	value := c.GetHeader(DryRunHeader)
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.Errorf("%s must be true or false, got %q", DryRunHeader, value)
+	}
+	return enabled, nil
+}
+
+// DryRun reports whether the client only simulates membership changes, as dry-run mode is on
+func (c *AuthentikClient) DryRun() bool {
+	return c.backend.config.DryRun
+}
+
+// simulateMembershipChange stands in for a membership change in dry-run mode and logs the change that
+// would have been made. The group, user and member group involved have been looked up already, so a
+// change that would fail because one of them does not exist fails in dry-run mode too.
+func (c *AuthentikClient) simulateMembershipChange(entry *AuditEntry) {
+	entry.DryRun = true
+
+	change := ReconcileChange{
+		Operation:       entry.Operation,
+		GroupID:         entry.GroupID,
+		GroupName:       entry.GroupName,
+		UserID:          entry.UserID,
+		UserEmail:       entry.UserEmail,
+		MemberGroupID:   entry.MemberGroupID,
+		MemberGroupName: entry.MemberGroupName,
+	}
+	log.Printf("Dry run, not applied: %s", change.Describe())
+}
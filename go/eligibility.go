@@ -0,0 +1,148 @@
+package openapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	authentik "goauthentik.io/api/v3"
+)
+
+const (
+	EligibilityRequireActiveEnvKey = "ELIGIBILITY_REQUIRE_ACTIVE"
+	EligibilityUserTypesEnvKey     = "ELIGIBILITY_USER_TYPES"
+	EligibilityRequireMFAEnvKey    = "ELIGIBILITY_REQUIRE_MFA"
+)
+
+// Permissions needed to see the authenticators users enrolled. Without them, Authentik lists no
+// authenticators rather than failing.
+var mfaDevicePermissions = []string{
+	"authentik_stages_authenticator_duo.view_duodevice",
+	"authentik_stages_authenticator_sms.view_smsdevice",
+	"authentik_stages_authenticator_totp.view_totpdevice",
+	"authentik_stages_authenticator_webauthn.view_webauthndevice",
+}
+
+// EligibilityConfig lists the conditions a user must meet in Authentik before being added to a group
+type EligibilityConfig struct {
+	RequireActive bool `yaml:"require_active"`
+	// Allowed user types: internal, external, service_account or internal_service_account. Any
+	// type is allowed when empty.
+	UserTypes []string `yaml:"user_types"`
+	// At least one confirmed authenticator, not counting static recovery codes
+	RequireMFA bool `yaml:"require_mfa"`
+	// Regular expressions that must match the whole value of the user's attributes, keyed by
+	// attribute. Nested attributes are separated by dots, e.g. "profile.department".
+	Attributes map[string]string `yaml:"attributes"`
+
+	attributes map[string]*regexp.Regexp
+}
+
+func (c *EligibilityConfig) applyEnv(configErr *ConfigError) {
+	overrideBool(&c.RequireActive, EligibilityRequireActiveEnvKey, configErr)
+	if value := os.Getenv(EligibilityUserTypesEnvKey); value != "" {
+		c.UserTypes = splitList(value)
+	}
+	overrideBool(&c.RequireMFA, EligibilityRequireMFAEnvKey, configErr)
+}
+
+func (c *EligibilityConfig) validate(configErr *ConfigError) {
+	for _, userType := range c.UserTypes {
+		if !authentik.UserTypeEnum(userType).IsValid() {
+			configErr.add("eligibility.user_types: %q is not an Authentik user type", userType)
+		}
+	}
+
+	c.attributes = make(map[string]*regexp.Regexp, len(c.Attributes))
+	for attribute, expression := range c.Attributes {
+		pattern, err := regexp.Compile("^(?:" + expression + ")$")
+		if err != nil {
+			configErr.add("eligibility.attributes.%s: %q is not a valid regular expression: %v", attribute, expression, err)
+			continue
+		}
+		c.attributes[attribute] = pattern
+	}
+}
+
+func (c *EligibilityConfig) enabled() bool {
+	return c.RequireActive || len(c.UserTypes) > 0 || c.RequireMFA || len(c.Attributes) > 0
+}
+
+// checkEligibility refuses to add a user who does not meet the configured conditions, with a 403
+// listing every condition that is not met
+func (c *AuthentikClient) checkEligibility(ctx context.Context, user *authentik.User) error {
+	conditions := &c.backend.config.Eligibility
+	if !conditions.enabled() {
+		return nil
+	}
+
+	var problems []string
+	if conditions.RequireActive && !user.GetIsActive() {
+		problems = append(problems, "the user is inactive (eligibility.require_active)")
+	}
+	if len(conditions.UserTypes) > 0 && !contains(conditions.UserTypes, string(user.GetType())) {
+		problems = append(problems, fmt.Sprintf("the user type is %s, not %s (eligibility.user_types)", user.GetType(), strings.Join(conditions.UserTypes, " or ")))
+	}
+	for _, attribute := range sortedKeys(conditions.Attributes) {
+		value, ok := lookupAttribute(user.GetAttributes(), attribute)
+		if !ok {
+			problems = append(problems, "the user has no attribute "+attribute+" (eligibility.attributes)")
+		} else if !conditions.attributes[attribute].MatchString(value) {
+			problems = append(problems, fmt.Sprintf("the attribute %s is %q, which does not match %s (eligibility.attributes)", attribute, value, conditions.Attributes[attribute]))
+		}
+	}
+	if conditions.RequireMFA {
+		devices, resp, err := c.client.AuthenticatorsApi.AuthenticatorsAdminAllList(c.addAuthTokenToCtx(ctx)).User(user.GetPk()).Execute()
+		if err != nil {
+			statusCode := 500
+			if resp != nil {
+				statusCode = resp.StatusCode
+			}
+			return &ClientError{StatusCode: statusCode, Message: "failed to list the user's authenticators in Authentik", innerError: err}
+		}
+		if !hasMFADevice(devices) {
+			problems = append(problems, "the user has no MFA authenticator enrolled (eligibility.require_mfa)")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ClientError{
+			StatusCode: http.StatusForbidden,
+			Message:    "user " + user.GetUsername() + " (" + fmt.Sprint(user.GetPk()) + ") is not eligible to be added to groups",
+			innerError: errors.New(strings.Join(problems, "; ")),
+		}
+	}
+
+	return nil
+}
+
+// hasMFADevice reports whether any confirmed device is a real authenticator. Static devices hold
+// recovery codes, which are a fallback rather than a second factor.
+func hasMFADevice(devices []authentik.Device) bool {
+	for _, device := range devices {
+		if device.Confirmed && !strings.HasSuffix(strings.ToLower(device.Type), "staticdevice") {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupAttribute returns an attribute as a string, following dots into nested attributes
+func lookupAttribute(attributes map[string]interface{}, path string) (string, bool) {
+	var value interface{} = attributes
+	for _, key := range strings.Split(path, ".") {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = nested[key]; !ok || value == nil {
+			return "", false
+		}
+	}
+
+	return fmt.Sprint(value), true
+}
@@ -0,0 +1,71 @@
+package openapi
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+const eligibilityConfig = `eligibility:
+  require_active: true
+  user_types: [internal]
+  require_mfa: true
+  attributes:
+    profile.department: "engineering|finance"
+`
+
+func TestEligibility(t *testing.T) {
+	tc := newTestConnector(t, eligibilityConfig)
+	seedGroups(tc)
+	tc.authentik.AddUser(authentiktest.User{
+		Pk:         3,
+		Username:   "carol",
+		Attributes: map[string]interface{}{"profile": map[string]interface{}{"department": "engineering"}},
+		Devices:    []authentiktest.Device{{Type: "authentik_stages_authenticator_totp.TOTPDevice", Confirmed: true}},
+	})
+	tc.authentik.AddUser(authentiktest.User{
+		Pk:         4,
+		Username:   "dave",
+		Inactive:   true,
+		Type:       "external",
+		Attributes: map[string]interface{}{"profile": map[string]interface{}{"department": "sales"}},
+		// Recovery codes alone are not a second factor
+		Devices: []authentiktest.Device{{Type: "authentik_stages_authenticator_static.StaticDevice", Confirmed: true}},
+	})
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"3","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+
+	var errResp Error
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"4","app_id":"`+testAppID+`"}`), http.StatusForbidden, &errResp)
+	for _, problem := range []string{
+		"user dave (4) is not eligible",
+		"the user is inactive",
+		"the user type is external, not internal",
+		`the attribute profile.department is "sales"`,
+		"no MFA authenticator enrolled",
+	} {
+		if !strings.Contains(errResp.Message, problem) {
+			t.Errorf("expected %q in the error, got %q", problem, errResp.Message)
+		}
+	}
+
+	// A user without the attribute is not eligible either
+	decode(t, tc.do(http.MethodPost, appPath("/groups/platform/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusForbidden, &errResp)
+	if !strings.Contains(errResp.Message, "no attribute profile.department") {
+		t.Errorf("expected the missing attribute to be reported, got %q", errResp.Message)
+	}
+
+	// Removals are never blocked
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/1"), ""), http.StatusOK, nil)
+}
+
+func TestEligibilityRejectsUnknownUserTypes(t *testing.T) {
+	configErr := &ConfigError{}
+	conditions := EligibilityConfig{UserTypes: []string{"employee"}}
+	conditions.validate(configErr)
+	if len(configErr.Problems) != 1 {
+		t.Errorf("expected the user type to be rejected, got %v", configErr.Problems)
+	}
+}
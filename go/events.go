@@ -0,0 +1,91 @@
+package openapi
+
+import (
+	"context"
+
+	authentik "goauthentik.io/api/v3"
+)
+
+const AuthentikEventsEnvKey = "AUTHENTIK_EVENTS_ENABLED"
+
+// The app label Authentik shows for events created by the connector
+const authentikEventApp = "opal-authentik-connector"
+
+// createOpalEvent creates a custom event in Authentik describing a membership change made on behalf of
+// Opal, or by the reconcile command
+func (c *AuthentikClient) createOpalEvent(ctx context.Context, entry AuditEntry, clientIP string) error {
+	source := "opal"
+	if entry.Source != "" {
+		source = entry.Source
+	}
+	// The request timestamp identifies the Opal request, its signature is left to the audit log
+	eventContext := map[string]interface{}{
+		"message":        opalEventMessage(entry),
+		"source":         source,
+		"operation":      entry.Operation,
+		"group_id":       entry.GroupID,
+		"group_name":     entry.GroupName,
+		"opal_timestamp": entry.OpalTimestamp,
+		"opal_app_id":    entry.AppID,
+	}
+	if entry.UserID != "" {
+		eventContext["user_id"] = entry.UserID
+		eventContext["user_name"] = entry.UserName
+		eventContext["user_email"] = entry.UserEmail
+	}
+	if entry.MemberGroupID != "" {
+		eventContext["member_group_id"] = entry.MemberGroupID
+		eventContext["member_group_name"] = entry.MemberGroupName
+	}
+
+	eventRequest := authentik.NewEventRequest(authentik.EVENTACTIONS_CUSTOM, authentikEventApp)
+	eventRequest.Context = eventContext
+	if clientIP != "" {
+		eventRequest.ClientIp = *authentik.NewNullableString(&clientIP)
+	}
+
+	ctxWithAuth := c.addAuthTokenToCtx(ctx)
+	_, resp, err := c.client.EventsApi.EventsEventsCreate(ctxWithAuth).EventRequest(*eventRequest).Execute()
+	if err != nil {
+		statusCode := 500
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		return &ClientError{StatusCode: statusCode, Message: "failed to create event in Authentik", innerError: err}
+	}
+
+	return nil
+}
+
+func opalEventMessage(entry AuditEntry) string {
+	groupName := entry.GroupName
+	if groupName == "" {
+		groupName = entry.GroupID
+	}
+	userName := entry.UserEmail
+	if userName == "" {
+		userName = entry.UserID
+	}
+	memberGroupName := entry.MemberGroupName
+	if memberGroupName == "" {
+		memberGroupName = entry.MemberGroupID
+	}
+
+	actor := "Opal"
+	if entry.Source == AuditSourceReconcile {
+		actor = "Membership reconciliation"
+	}
+
+	switch entry.Operation {
+	case AuditOperationAddUserToGroup:
+		return actor + " added user " + userName + " to group " + groupName
+	case AuditOperationRemoveUserFromGroup:
+		return actor + " removed user " + userName + " from group " + groupName
+	case AuditOperationAddGroupToGroup:
+		return actor + " added group " + memberGroupName + " to group " + groupName
+	case AuditOperationRemoveGroupFromGroup:
+		return actor + " removed group " + memberGroupName + " from group " + groupName
+	}
+
+	return actor + " changed group " + groupName
+}
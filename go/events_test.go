@@ -0,0 +1,58 @@
+package openapi
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+func TestMembershipChangesCreateAuthentikEvents(t *testing.T) {
+	tc := newTestConnector(t, "  events: true\n")
+	seedGroups(tc)
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/1"), ""), http.StatusOK, nil)
+
+	events := tc.authentik.Events()
+	if len(events) != 2 {
+		t.Fatalf("expected an event for the addition and the removal, got %+v", events)
+	}
+	for i, message := range []string{"Opal added user bob@example.com to group Engineering", "Opal removed user alice@example.com from group Engineering"} {
+		context, _ := events[i]["context"].(map[string]interface{})
+		if events[i]["action"] != "custom_" || events[i]["app"] != authentikEventApp || context["message"] != message {
+			t.Errorf("expected the event to read %q, got %+v", message, events[i])
+		}
+		if context["source"] != "opal" || context["opal_app_id"] != testAppID || context["opal_timestamp"] == "" {
+			t.Errorf("expected the event to identify the Opal request, got %+v", context)
+		}
+		if _, ok := context["opal_signature"]; ok {
+			t.Errorf("expected the signature to be left out of the event, got %+v", context)
+		}
+	}
+}
+
+func TestFailedChangesCreateNoAuthentikEvents(t *testing.T) {
+	tc := newTestConnector(t, "  events: true\n")
+	seedGroups(tc)
+	tc.authentik.Fail(authentiktest.Failure{Method: http.MethodPost, Path: "/api/v3/core/groups/eng/add_user/", Status: http.StatusForbidden, Times: 1})
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusForbidden, nil)
+	decode(t, tc.do(http.MethodPost, appPath("/groups/missing/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusNotFound, nil)
+	if events := tc.authentik.Events(); len(events) != 0 {
+		t.Errorf("expected no events for failed changes, got %+v", events)
+	}
+}
+
+func TestAuthentikEventsAreOptIn(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	if events := tc.authentik.Events(); len(events) != 0 {
+		t.Errorf("expected no events unless enabled, got %+v", events)
+	}
+	if len(tc.auditEntries()) != 1 {
+		t.Error("expected the change to be audited all the same")
+	}
+}
@@ -0,0 +1,236 @@
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ExportFormatJSON = "json"
+	ExportFormatCSV  = "csv"
+)
+
+const exportManifestFile = "manifest.json"
+
+// Inventory is what the connector shows Opal at one point in time: users, groups, the direct
+// members of each group and which groups are nested in which
+type Inventory struct {
+	Users       []User                `json:"users"`
+	Groups      []Group               `json:"groups"`
+	Memberships []InventoryMembership `json:"memberships"`
+	Nesting     []InventoryNesting    `json:"nesting"`
+}
+
+type InventoryMembership struct {
+	GroupId string `json:"group_id"`
+	UserId  string `json:"user_id"`
+	Email   string `json:"email,omitempty"`
+}
+
+type InventoryNesting struct {
+	GroupId       string `json:"group_id"`
+	MemberGroupId string `json:"member_group_id"`
+}
+
+// ExportManifest describes an export, so it can be attributed and checked for tampering later
+type ExportManifest struct {
+	AuthentikHost string       `json:"authentik_host"`
+	App           string       `json:"app,omitempty"`
+	StartedAt     time.Time    `json:"started_at"`
+	FinishedAt    time.Time    `json:"finished_at"`
+	Format        string       `json:"format"`
+	Files         []ExportFile `json:"files"`
+}
+
+type ExportFile struct {
+	Name    string `json:"name"`
+	SHA256  string `json:"sha256"`
+	Records int    `json:"records"`
+}
+
+// ExportInventory walks every page of users and groups, and the members and child groups of each
+// group, through the same client methods that serve Opal's requests. Hidden groups are left out.
+func (c *AuthentikClient) ExportInventory(ctx context.Context) (*Inventory, error) {
+	inventory := &Inventory{
+		Users:       make([]User, 0),
+		Groups:      make([]Group, 0),
+		Memberships: make([]InventoryMembership, 0),
+		Nesting:     make([]InventoryNesting, 0),
+	}
+
+	for cursor := ""; ; {
+		users, nextCursor, err := c.PaginatedListUsers(ctx, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for _, authentikUser := range users {
+			if user := toOpalUser(authentikUser); user != nil {
+				inventory.Users = append(inventory.Users, *user)
+			}
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	for cursor := ""; ; {
+		groups, nextCursor, err := c.PaginatedListGroups(ctx, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for i := range groups {
+			if c.backend.config.ProtectedGroups.hidden(&groups[i]) {
+				continue
+			}
+			inventory.Groups = append(inventory.Groups, *toOpalGroup(&groups[i]))
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	for _, group := range inventory.Groups {
+		members, err := c.GetGroupUsers(ctx, group.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			inventory.Memberships = append(inventory.Memberships, InventoryMembership{
+				GroupId: group.Id,
+				UserId:  strconv.Itoa(int(member.GetPk())),
+				Email:   member.GetEmail(),
+			})
+		}
+
+		children, err := c.ListChildrenGroups(ctx, group.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			if c.backend.config.ProtectedGroups.hidden(child) {
+				continue
+			}
+			inventory.Nesting = append(inventory.Nesting, InventoryNesting{GroupId: group.Id, MemberGroupId: child.GetPk()})
+		}
+	}
+
+	inventory.sort()
+	return inventory, nil
+}
+
+// sort orders everything by ID, so exports of the same state are identical
+func (inv *Inventory) sort() {
+	sort.Slice(inv.Users, func(i, j int) bool { return userIDLess(inv.Users[i].Id, inv.Users[j].Id) })
+	sort.Slice(inv.Groups, func(i, j int) bool { return inv.Groups[i].Id < inv.Groups[j].Id })
+	sort.Slice(inv.Memberships, func(i, j int) bool {
+		a, b := inv.Memberships[i], inv.Memberships[j]
+		return a.GroupId < b.GroupId || (a.GroupId == b.GroupId && userIDLess(a.UserId, b.UserId))
+	})
+	sort.Slice(inv.Nesting, func(i, j int) bool {
+		a, b := inv.Nesting[i], inv.Nesting[j]
+		return a.GroupId < b.GroupId || (a.GroupId == b.GroupId && a.MemberGroupId < b.MemberGroupId)
+	})
+}
+
+// userIDLess orders user IDs by their numeric primary key, so user 10 comes after user 2
+func userIDLess(a, b string) bool {
+	pkA, errA := strconv.Atoi(a)
+	pkB, errB := strconv.Atoi(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return pkA < pkB
+}
+
+// WriteInventory writes the inventory into dir, as inventory.json or one CSV file per table, followed
+// by manifest.json listing the checksum of every file
+func WriteInventory(dir string, inventory *Inventory, manifest *ExportManifest) error {
+	files := make(map[string][]byte)
+	records := make(map[string]int)
+
+	switch manifest.Format {
+	case ExportFormatJSON:
+		contents, err := json.MarshalIndent(inventory, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "unable to encode inventory")
+		}
+		files["inventory.json"] = append(contents, '\n')
+		records["inventory.json"] = len(inventory.Users) + len(inventory.Groups) + len(inventory.Memberships) + len(inventory.Nesting)
+	case ExportFormatCSV:
+		tables := map[string][][]string{
+			"users.csv":       {{"id", "email"}},
+			"groups.csv":      {{"id", "name", "description"}},
+			"memberships.csv": {{"group_id", "user_id", "email"}},
+			"nesting.csv":     {{"group_id", "member_group_id"}},
+		}
+		for _, user := range inventory.Users {
+			tables["users.csv"] = append(tables["users.csv"], []string{user.Id, user.Email})
+		}
+		for _, group := range inventory.Groups {
+			tables["groups.csv"] = append(tables["groups.csv"], []string{group.Id, group.Name, group.Description})
+		}
+		for _, membership := range inventory.Memberships {
+			tables["memberships.csv"] = append(tables["memberships.csv"], []string{membership.GroupId, membership.UserId, membership.Email})
+		}
+		for _, nesting := range inventory.Nesting {
+			tables["nesting.csv"] = append(tables["nesting.csv"], []string{nesting.GroupId, nesting.MemberGroupId})
+		}
+
+		for name, rows := range tables {
+			var buf bytes.Buffer
+			writer := csv.NewWriter(&buf)
+			if err := writer.WriteAll(rows); err != nil {
+				return errors.Wrapf(err, "unable to encode %s", name)
+			}
+			files[name] = buf.Bytes()
+			records[name] = len(rows) - 1
+		}
+	default:
+		return errors.Errorf("unknown export format %q, use %s or %s", manifest.Format, ExportFormatJSON, ExportFormatCSV)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return errors.Wrapf(err, "unable to create %s", dir)
+	}
+
+	manifest.Files = make([]ExportFile, 0, len(files))
+	for _, name := range sortedFileNames(files) {
+		if err := os.WriteFile(filepath.Join(dir, name), files[name], 0o644); err != nil {
+			return errors.Wrapf(err, "unable to write %s", name)
+		}
+		sum := sha256.Sum256(files[name])
+		manifest.Files = append(manifest.Files, ExportFile{Name: name, SHA256: hex.EncodeToString(sum[:]), Records: records[name]})
+	}
+
+	contents, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to encode manifest")
+	}
+	if err := os.WriteFile(filepath.Join(dir, exportManifestFile), append(contents, '\n'), 0o644); err != nil {
+		return errors.Wrapf(err, "unable to write %s", exportManifestFile)
+	}
+
+	return nil
+}
+
+func sortedFileNames(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,113 @@
+package openapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+func exportInventory(t *testing.T) *Inventory {
+	t.Helper()
+
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+	tc.authentik.AddUser(authentiktest.User{Pk: 3, Username: "no-email"})
+	tc.authentik.AddUser(authentiktest.User{Pk: 10, Username: "carol", Email: "carol@example.com"})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "sre", Name: "SRE", Parent: "platform", Users: []int32{2, 3}})
+
+	inventory, err := testClient(t).ExportInventory(context.Background())
+	if err != nil {
+		t.Fatalf("ExportInventory: %v", err)
+	}
+	return inventory
+}
+
+func TestExportInventory(t *testing.T) {
+	inventory := exportInventory(t)
+
+	// Users without an email are not shown to Opal, but their memberships are. Users are ordered
+	// by primary key
+	if want := []User{{Id: "1", Email: "alice@example.com"}, {Id: "2", Email: "bob@example.com"}, {Id: "10", Email: "carol@example.com"}}; !reflect.DeepEqual(inventory.Users, want) {
+		t.Errorf("expected users %+v, got %+v", want, inventory.Users)
+	}
+	if len(inventory.Groups) != 3 {
+		t.Errorf("expected 3 groups, got %+v", inventory.Groups)
+	}
+	wantMemberships := []InventoryMembership{
+		{GroupId: "eng", UserId: "1", Email: "alice@example.com"},
+		{GroupId: "sre", UserId: "2", Email: "bob@example.com"},
+		{GroupId: "sre", UserId: "3"},
+	}
+	if !reflect.DeepEqual(inventory.Memberships, wantMemberships) {
+		t.Errorf("expected memberships %+v, got %+v", wantMemberships, inventory.Memberships)
+	}
+	if want := []InventoryNesting{{GroupId: "platform", MemberGroupId: "sre"}}; !reflect.DeepEqual(inventory.Nesting, want) {
+		t.Errorf("expected nesting %+v, got %+v", want, inventory.Nesting)
+	}
+}
+
+func TestWriteInventory(t *testing.T) {
+	inventory := exportInventory(t)
+
+	for _, format := range []string{ExportFormatJSON, ExportFormatCSV} {
+		dir := t.TempDir()
+		if err := WriteInventory(dir, inventory, &ExportManifest{AuthentikHost: "auth.example.com", Format: format}); err != nil {
+			t.Fatalf("WriteInventory %s: %v", format, err)
+		}
+
+		contents, err := os.ReadFile(filepath.Join(dir, exportManifestFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var manifest ExportManifest
+		if err := json.Unmarshal(contents, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if manifest.AuthentikHost != "auth.example.com" || len(manifest.Files) == 0 {
+			t.Errorf("unexpected %s manifest %+v", format, manifest)
+		}
+		for _, file := range manifest.Files {
+			data, err := os.ReadFile(filepath.Join(dir, file.Name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != file.SHA256 {
+				t.Errorf("checksum of %s does not match the manifest", file.Name)
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	if err := WriteInventory(dir, inventory, &ExportManifest{Format: ExportFormatCSV}); err != nil {
+		t.Fatal(err)
+	}
+	if rows := readCSV(t, filepath.Join(dir, "memberships.csv")); len(rows) != 4 || !reflect.DeepEqual(rows[0], []string{"group_id", "user_id", "email"}) {
+		t.Errorf("unexpected memberships.csv %v", rows)
+	}
+	// Groups carry the same fields as in inventory.json
+	if rows := readCSV(t, filepath.Join(dir, "groups.csv")); len(rows) != 4 || !reflect.DeepEqual(rows[0], []string{"id", "name", "description"}) {
+		t.Errorf("unexpected groups.csv %v", rows)
+	}
+}
+
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
@@ -0,0 +1,133 @@
+package openapi
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const AdminListenAddressEnvKey = "ADMIN_LISTEN_ADDRESS"
+
+const (
+	healthCheckOK           = "ok"
+	healthCheckFailed       = "failed"
+	healthStatusOK          = "OK"
+	healthStatusUnavailable = "UNAVAILABLE"
+)
+
+// How long a backend's readiness is reused before Authentik is pinged again
+const readinessCacheTTL = 5 * time.Second
+
+// Set once shutdown starts, so load balancers stop routing new requests while in-flight ones drain
+var shuttingDown atomic.Bool
+
+// registerHealthRoutes adds the liveness and readiness endpoints. They are called by Kubernetes and
+// load balancers rather than Opal, so they must not sit behind the signature middleware.
+func registerHealthRoutes(router gin.IRoutes) {
+	router.GET("/healthz", getHealthz)
+	router.GET("/readyz", getReadyz)
+}
+
+// NewAdminRouter returns a router serving only the health endpoints and the operator routes, for a
+// separate admin port
+func NewAdminRouter(config *Config) *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	registerHealthRoutes(router)
+	registerRemovalLimitRoutes(router, config)
+	return router
+}
+
+// Get /healthz
+func getHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": healthStatusOK})
+}
+
+// Get /readyz
+func getReadyz(c *gin.Context) {
+	checks := gin.H{}
+	ready := true
+
+	if shuttingDown.Load() {
+		checks["server"] = healthCheckFailed
+		ready = false
+	}
+
+	config, err := getConfig()
+	if err != nil {
+		log.Printf("Readiness check config failed: %v", err)
+		checks["config"] = healthCheckFailed
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": healthStatusUnavailable, "checks": checks})
+		return
+	}
+	checks["config"] = healthCheckOK
+
+	for _, backend := range config.Backends() {
+		name := "authentik"
+		if len(config.Apps) > 0 {
+			name = "authentik:" + backend.Name
+		}
+
+		if backendReadiness.check(c, name, backend) {
+			checks[name] = healthCheckOK
+		} else {
+			checks[name] = healthCheckFailed
+			ready = false
+		}
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": healthStatusUnavailable, "checks": checks})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": healthStatusOK, "checks": checks})
+}
+
+type readinessResult struct {
+	ready     bool
+	checkedAt time.Time
+}
+
+// readinessCache remembers whether each backend was reachable, so frequent probes from several
+// load balancers do not each reach Authentik
+type readinessCache struct {
+	mu      sync.Mutex
+	results map[*Backend]readinessResult
+}
+
+var backendReadiness = &readinessCache{results: make(map[*Backend]readinessResult)}
+
+// check pings the backend unless it was checked within readinessCacheTTL. Failures are logged with
+// their details, which the unauthenticated endpoint does not return.
+func (r *readinessCache) check(c *gin.Context, name string, backend *Backend) bool {
+	r.mu.Lock()
+	result, ok := r.results[backend]
+	r.mu.Unlock()
+	if ok && time.Since(result.checkedAt) < readinessCacheTTL {
+		return result.ready
+	}
+
+	authentik, err := NewAuthentikClientForBackend(backend)
+	if err == nil {
+		err = authentik.Ping(c.Request.Context())
+	}
+	if err != nil {
+		log.Printf("Readiness check %s failed: %v", name, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Backends replaced by a reload are dropped, as they are never checked again
+	for cached := range r.results {
+		if time.Since(r.results[cached].checkedAt) >= readinessCacheTTL {
+			delete(r.results, cached)
+		}
+	}
+	r.results[backend] = readinessResult{ready: err == nil, checkedAt: time.Now()}
+	return err == nil
+}
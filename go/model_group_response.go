@@ -11,12 +11,5 @@ package openapi
 
 type GroupResponse struct {
 
-	// The id of the group in your system. Opal will provide this id when making requests for the group to your connector.
-	Id string `json:"id"`
-
-	// The name of the group
-	Name string `json:"name"`
-
-	// The description of the group
-	Description string `json:"description,omitempty"`
+	Group Group `json:"group"`
 }
@@ -0,0 +1,220 @@
+package openapi
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	AuthentikOAuth2TokenURLEnvKey     = "AUTHENTIK_OAUTH2_TOKEN_URL"
+	AuthentikOAuth2ClientIDEnvKey     = "AUTHENTIK_OAUTH2_CLIENT_ID"
+	AuthentikOAuth2ClientSecretEnvKey = "AUTHENTIK_OAUTH2_CLIENT_SECRET"
+	AuthentikOAuth2UsernameEnvKey     = "AUTHENTIK_OAUTH2_USERNAME"
+	AuthentikOAuth2PasswordEnvKey     = "AUTHENTIK_OAUTH2_PASSWORD"
+	AuthentikOAuth2ScopesEnvKey       = "AUTHENTIK_OAUTH2_SCOPES"
+)
+
+// Authentik only accepts JWTs on its API when they carry this scope
+const authentikAPIScope = "goauthentik.io/api"
+
+const DefaultOAuth2RefreshMargin = time.Minute
+
+const oauth2TokenTimeout = 30 * time.Second
+
+// How long a failed refresh waits before it is tried again, while the current token is still valid
+const oauth2RefreshRetryInterval = 10 * time.Second
+
+// OAuth2Config configures the client_credentials grant against an Authentik OAuth2 provider.
+// Authentik identifies the service account either by username and app password, or by the
+// provider's client secret.
+type OAuth2Config struct {
+	// Defaults to <scheme>://<host>/application/o/token/
+	TokenURL     string   `yaml:"token_url"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Username     string   `yaml:"username"`
+	Password     string   `yaml:"password"`
+	Scopes       []string `yaml:"scopes"`
+	// How long before expiry a token is replaced
+	RefreshMargin time.Duration `yaml:"refresh_margin"`
+}
+
+func (c OAuth2Config) Enabled() bool {
+	return c.ClientID != ""
+}
+
+// clientCredentialsTokenSource fetches short-lived access tokens and reuses each one until it is
+// within the refresh margin of expiring. Secrets are resolved on every fetch so rotations apply.
+// If a refresh fails, the current token is used until it expires and the refresh is retried shortly.
+type clientCredentialsTokenSource struct {
+	mu      sync.Mutex
+	backend *Backend
+	token   *oauth2.Token
+	retryAt time.Time
+}
+
+func (s *clientCredentialsTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oauth2Config := s.backend.Authentik.OAuth2
+	if s.token != nil && (s.token.Expiry.IsZero() || time.Until(s.token.Expiry) > oauth2Config.RefreshMargin) {
+		return s.token, nil
+	}
+	valid := s.token != nil && time.Now().Before(s.token.Expiry)
+	if valid && time.Now().Before(s.retryAt) {
+		return s.token, nil
+	}
+
+	token, err := s.fetch()
+	if err != nil {
+		if valid {
+			log.Printf("Unable to refresh the access token for %s, using the current one until it expires at %s: %v", s.backend.Name, s.token.Expiry.Format(time.RFC3339), err)
+			s.retryAt = time.Now().Add(oauth2RefreshRetryInterval)
+			return s.token, nil
+		}
+		return nil, err
+	}
+
+	s.token = token
+	return token, nil
+}
+
+// fetch gets a new access token from Authentik
+func (s *clientCredentialsTokenSource) fetch() (*oauth2.Token, error) {
+	oauth2Config := s.backend.Authentik.OAuth2
+	clientSecret, err := s.backend.config.ResolveSecret(oauth2Config.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	password, err := s.backend.config.ResolveSecret(oauth2Config.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	if oauth2Config.Username != "" {
+		params.Set("username", oauth2Config.Username)
+		params.Set("password", password)
+	}
+
+	credentials := clientcredentials.Config{
+		ClientID:       oauth2Config.ClientID,
+		ClientSecret:   clientSecret,
+		TokenURL:       s.backend.oauth2TokenURL(),
+		Scopes:         oauth2Config.Scopes,
+		EndpointParams: params,
+		// Authentik reads the client ID from the form body, even for public clients
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+
+	httpClient, err := s.backend.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oauth2TokenTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+
+	token, err := credentials.Token(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get an access token from Authentik")
+	}
+
+	return token, nil
+}
+
+func (b *Backend) oauth2TokenURL() string {
+	if b.Authentik.OAuth2.TokenURL != "" {
+		return b.Authentik.OAuth2.TokenURL
+	}
+
+	return b.Authentik.Scheme + "://" + b.Authentik.Host + "/application/o/token/"
+}
+
+// getTokenSource returns where the Authentik client gets its credentials from: short-lived
+// OAuth2 tokens if a client ID is configured, the static API token otherwise.
+func (b *Backend) getTokenSource() (oauth2.TokenSource, error) {
+	if b.tokenSource != nil {
+		// Shared by all clients so tokens are reused across requests
+		return b.tokenSource, nil
+	}
+
+	token, err := getToken(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), nil
+}
+
+// headerTransport adds headers to every request, for calls made outside the generated API client
+type headerTransport struct {
+	headers map[string]string
+	base    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// httpClient returns an HTTP client for calls to Authentik that do not go through the generated
+// API client, with the same default headers and TLS settings
+func (b *Backend) httpClient() (*http.Client, error) {
+	headers, err := b.defaultHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{Transport: &headerTransport{headers: headers, base: b.transport}}, nil
+}
+
+// defaultHeaders returns the headers sent with every request to Authentik: the configured
+// headers and the Cloudflare Access credentials
+func (b *Backend) defaultHeaders() (map[string]string, error) {
+	headers := make(map[string]string)
+	for key, value := range b.Authentik.Headers {
+		resolved, err := b.config.ResolveSecret(value)
+		if err != nil {
+			return nil, err
+		}
+		headers[key] = resolved
+	}
+
+	cf := b.Authentik.CloudflareAccess
+	if cf.ClientID == "" {
+		return headers, nil
+	}
+
+	clientID, err := b.config.ResolveSecret(cf.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := b.config.ResolveSecret(cf.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	headers["CF-Access-Client-Id"] = clientID
+	headers["CF-Access-Client-Secret"] = clientSecret
+	return headers, nil
+}
+
+func parseScopes(value string) []string {
+	return strings.Fields(strings.ReplaceAll(value, ",", " "))
+}
@@ -0,0 +1,84 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestOAuth2TokenRefresh(t *testing.T) {
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := fetches.Add(1)
+		if failing.Load() {
+			http.Error(w, `{"error":"server_error"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token-" + strconv.Itoa(int(n)),
+			"token_type":   "Bearer",
+			"expires_in":   300,
+		})
+	}))
+	defer tokenServer.Close()
+
+	backend := &Backend{
+		Name: DefaultBackendName,
+		Authentik: AuthentikConfig{OAuth2: OAuth2Config{
+			TokenURL:      tokenServer.URL,
+			ClientID:      "opal-connector",
+			ClientSecret:  "secret",
+			RefreshMargin: time.Minute,
+		}},
+		config:    &Config{},
+		transport: http.DefaultTransport,
+	}
+	source := &clientCredentialsTokenSource{backend: backend}
+
+	token, err := source.Token()
+	if err != nil || token.AccessToken != "token-1" {
+		t.Fatalf("expected a token, got %+v, %v", token, err)
+	}
+	if token, _ := source.Token(); token.AccessToken != "token-1" || fetches.Load() != 1 {
+		t.Errorf("expected the token to be reused, got %s after %d fetches", token.AccessToken, fetches.Load())
+	}
+
+	// Within the refresh margin a failed refresh falls back to the token, which is still valid
+	setExpiry(source, time.Now().Add(30*time.Second))
+	failing.Store(true)
+	if token, err := source.Token(); err != nil || token.AccessToken != "token-1" {
+		t.Fatalf("expected the current token while refreshing fails, got %+v, %v", token, err)
+	}
+	if _, err := source.Token(); err != nil || fetches.Load() != 2 {
+		t.Errorf("expected the refresh to be retried later rather than on every call, got %d fetches, %v", fetches.Load(), err)
+	}
+
+	failing.Store(false)
+	source.mu.Lock()
+	source.retryAt = time.Time{}
+	source.mu.Unlock()
+	if token, err := source.Token(); err != nil || token.AccessToken != "token-3" {
+		t.Errorf("expected a refreshed token, got %+v, %v", token, err)
+	}
+
+	// Once the token has expired, the failure is returned
+	setExpiry(source, time.Now().Add(-time.Second))
+	failing.Store(true)
+	if _, err := source.Token(); err == nil {
+		t.Error("expected an error without a valid token")
+	}
+}
+
+func setExpiry(source *clientCredentialsTokenSource, expiry time.Time) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	source.token = &oauth2.Token{AccessToken: source.token.AccessToken, Expiry: expiry}
+}
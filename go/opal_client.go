@@ -0,0 +1,106 @@
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// OpalClient sends requests to a connector signed the way Opal signs them, for testing and debugging
+// a deployment from the outside
+type OpalClient struct {
+	BaseURL       string
+	AppID         string
+	SigningSecret string
+	HTTPClient    *http.Client
+}
+
+// OpalResponse is a connector response read in full
+type OpalResponse struct {
+	Request    *http.Request
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Do sends a signed request, adding the app_id to the query as Opal does
+func (c *OpalClient) Do(ctx context.Context, method string, path string, query url.Values, body []byte) (*OpalResponse, error) {
+	req, err := c.NewRequest(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Send(req)
+}
+
+// NewRequest builds a signed request without sending it
+func (c *OpalClient) NewRequest(ctx context.Context, method string, path string, query url.Values, body []byte) (*http.Request, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(c.BaseURL, "/") + path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid URL for %s", path)
+	}
+
+	values := endpoint.Query()
+	for key, vals := range query {
+		values[key] = vals
+	}
+	if c.AppID != "" && values.Get("app_id") == "" {
+		values.Set("app_id", c.AppID)
+	}
+	endpoint.RawQuery = values.Encode()
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signedBody := strings.TrimSpace(string(body))
+	if signedBody == "" {
+		signedBody = "{}"
+	}
+	signature, err := GenerateSignature(c.SigningSecret, timestamp, []byte(signedBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("X-Opal-Request-Timestamp", timestamp)
+	req.Header.Set("X-Opal-Signature", signature)
+
+	return req, nil
+}
+
+// Send sends a request built by NewRequest, or any other request to the connector
+func (c *OpalClient) Send(req *http.Request) (*OpalResponse, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s failed", req.Method, req.URL.Path)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the response to %s %s", req.Method, req.URL.Path)
+	}
+
+	return &OpalResponse{
+		Request:    req,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	}, nil
+}
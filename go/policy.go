@@ -0,0 +1,491 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const PolicyPathsEnvKey = "POLICY_PATHS"
+
+// How often policy files are checked for changes
+const policyReloadCheckInterval = 10 * time.Second
+
+// Policy files in a directory end in one of these, test files in policyTestSuffix
+var policyExtensions = []string{".yaml", ".yml"}
+
+const policyTestSuffix = "_test"
+
+type PolicyConfig struct {
+	// Policy files, or directories whose YAML files are policies. Files named *_test.yaml hold
+	// tests for the policies, run by the policy test command.
+	Paths []string `yaml:"paths"`
+}
+
+// Policy is an expression deciding whether a membership change may be made. Expressions are
+// written in CEL (https://github.com/google/cel-spec) and evaluate either to a bool, true allowing
+// the change and false denying it with Reason, or to a string, empty allowing the change and
+// anything else denying it with that string as the reason.
+type Policy struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	Expression  string `yaml:"expression"`
+	Reason      string `yaml:"reason"`
+
+	program cel.Program
+}
+
+// PolicyInput is what policies see of a membership change, as the variables request, user, group,
+// member_group and now. Authentik objects are given as returned by its API, attributes included.
+type PolicyInput struct {
+	// operation, source, method, route, app_id, group_id, user_id and member_group_id
+	Request     map[string]interface{} `yaml:"request"`
+	User        map[string]interface{} `yaml:"user"`
+	Group       map[string]interface{} `yaml:"group"`
+	MemberGroup map[string]interface{} `yaml:"member_group"`
+	Now         time.Time              `yaml:"now"`
+}
+
+// PolicyDecision is the outcome of evaluating the policies. Policy and Reason are set when denied.
+type PolicyDecision struct {
+	Allowed bool
+	Policy  string
+	Reason  string
+}
+
+// PolicySet is a list of compiled policies, evaluated in order
+type PolicySet struct {
+	Policies []*Policy
+}
+
+type policyFile struct {
+	Policies []*Policy `yaml:"policies"`
+}
+
+func newPolicyEnv() (*cel.Env, error) {
+	object := cel.MapType(cel.StringType, cel.DynType)
+	return cel.NewEnv(
+		cel.Variable("request", object),
+		cel.Variable("user", object),
+		cel.Variable("group", object),
+		cel.Variable("member_group", object),
+		cel.Variable("now", cel.TimestampType),
+		ext.Strings(),
+	)
+}
+
+// LoadPolicies reads and compiles the policies in the given files and directories, reporting every
+// policy that does not compile
+func LoadPolicies(paths []string) (*PolicySet, error) {
+	files, _, err := policyFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+	env, err := newPolicyEnv()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to set up the policy language")
+	}
+
+	set := &PolicySet{}
+	policyErr := &ConfigError{}
+	names := make(map[string]string)
+	for _, file := range files {
+		var contents policyFile
+		if err := decodeYAMLFile(file, &contents); err != nil {
+			policyErr.add("%v", err)
+			continue
+		}
+
+		for i, policy := range contents.Policies {
+			if policy.Name == "" {
+				policyErr.add("%s: policies[%d].name is required", file, i)
+				continue
+			}
+			if other, ok := names[policy.Name]; ok {
+				policyErr.add("%s: policy %s is also declared in %s", file, policy.Name, other)
+			}
+			names[policy.Name] = file
+
+			ast, issues := env.Compile(policy.Expression)
+			if issues != nil && issues.Err() != nil {
+				policyErr.add("%s: policy %s: %v", file, policy.Name, issues.Err())
+				continue
+			}
+			switch ast.OutputType() {
+			case cel.BoolType, cel.StringType, cel.DynType:
+			default:
+				policyErr.add("%s: policy %s must evaluate to a bool or a string, not %s", file, policy.Name, ast.OutputType())
+				continue
+			}
+			policy.program, err = env.Program(ast)
+			if err != nil {
+				policyErr.add("%s: policy %s: %v", file, policy.Name, err)
+				continue
+			}
+			set.Policies = append(set.Policies, policy)
+		}
+	}
+	if len(policyErr.Problems) > 0 {
+		return nil, policyErr
+	}
+
+	return set, nil
+}
+
+// Evaluate runs the policies in order and returns the first denial. A policy that fails to
+// evaluate, e.g. because it reads an attribute that is not set, denies the change.
+func (s *PolicySet) Evaluate(input PolicyInput) PolicyDecision {
+	now := input.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	activation := map[string]interface{}{
+		"request":      orEmpty(input.Request),
+		"user":         orEmpty(input.User),
+		"group":        orEmpty(input.Group),
+		"member_group": orEmpty(input.MemberGroup),
+		"now":          now,
+	}
+
+	for _, policy := range s.Policies {
+		out, _, err := policy.program.Eval(activation)
+		if err != nil {
+			return PolicyDecision{Policy: policy.Name, Reason: "the policy failed to evaluate: " + err.Error()}
+		}
+
+		switch value := out.Value().(type) {
+		case bool:
+			if !value {
+				reason := policy.Reason
+				if reason == "" {
+					reason = "denied by policy " + policy.Name
+				}
+				return PolicyDecision{Policy: policy.Name, Reason: reason}
+			}
+		case string:
+			if value != "" {
+				return PolicyDecision{Policy: policy.Name, Reason: value}
+			}
+		default:
+			return PolicyDecision{Policy: policy.Name, Reason: fmt.Sprintf("the policy evaluated to %v, not a bool or a string", out)}
+		}
+	}
+
+	return PolicyDecision{Allowed: true}
+}
+
+func orEmpty(object map[string]interface{}) map[string]interface{} {
+	if object == nil {
+		return map[string]interface{}{}
+	}
+	return object
+}
+
+// PolicyTest is a membership change and the decision the policies are expected to make about it
+type PolicyTest struct {
+	Name  string      `yaml:"name"`
+	Input PolicyInput `yaml:"input"`
+	// allow or deny
+	Expect string `yaml:"expect"`
+	// When denied, the policy expected to deny the change and a substring of its reason
+	Policy string `yaml:"policy"`
+	Reason string `yaml:"reason"`
+}
+
+// PolicyTestResult is the outcome of one test. Problem explains why a test failed.
+type PolicyTestResult struct {
+	File    string
+	Name    string
+	Passed  bool
+	Problem string
+}
+
+type policyTestFile struct {
+	Tests []PolicyTest `yaml:"tests"`
+}
+
+// RunPolicyTests loads the policies in the given files and directories and runs the tests found
+// alongside them, in files named *_test.yaml
+func RunPolicyTests(paths []string) ([]PolicyTestResult, error) {
+	set, err := LoadPolicies(paths)
+	if err != nil {
+		return nil, err
+	}
+	_, testFiles, err := policyFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]PolicyTestResult, 0)
+	for _, file := range testFiles {
+		var contents policyTestFile
+		if err := decodeYAMLFile(file, &contents); err != nil {
+			return nil, err
+		}
+		for i, test := range contents.Tests {
+			name := test.Name
+			if name == "" {
+				name = fmt.Sprintf("tests[%d]", i)
+			}
+			result := PolicyTestResult{File: file, Name: name}
+			result.Problem = test.check(set.Evaluate(test.Input))
+			result.Passed = result.Problem == ""
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// check returns why the decision is not the expected one, or "" if it is
+func (t *PolicyTest) check(decision PolicyDecision) string {
+	switch t.Expect {
+	case "allow":
+		if !decision.Allowed {
+			return fmt.Sprintf("expected the change to be allowed, denied by policy %s: %s", decision.Policy, decision.Reason)
+		}
+	case "deny":
+		if decision.Allowed {
+			return "expected the change to be denied, it was allowed"
+		}
+		if t.Policy != "" && t.Policy != decision.Policy {
+			return fmt.Sprintf("expected policy %s to deny the change, denied by policy %s: %s", t.Policy, decision.Policy, decision.Reason)
+		}
+		if !strings.Contains(decision.Reason, t.Reason) {
+			return fmt.Sprintf("expected the reason to contain %q, got %q", t.Reason, decision.Reason)
+		}
+	default:
+		return fmt.Sprintf("expect must be allow or deny, not %q", t.Expect)
+	}
+
+	return ""
+}
+
+// policyEngine holds the policies loaded from files and reloads them when the files change, so
+// policies can be changed without a restart
+type policyEngine struct {
+	mu        sync.Mutex
+	paths     []string
+	checkedAt time.Time
+	modTimes  map[string]time.Time
+	set       *PolicySet
+}
+
+func newPolicyEngine(paths []string) (*policyEngine, error) {
+	engine := &policyEngine{paths: paths}
+	if err := engine.load(); err != nil {
+		return nil, err
+	}
+	engine.checkedAt = time.Now()
+
+	return engine, nil
+}
+
+func (e *policyEngine) load() error {
+	modTimes, err := policyModTimes(e.paths)
+	if err != nil {
+		return err
+	}
+	set, err := LoadPolicies(e.paths)
+	if err != nil {
+		return err
+	}
+
+	e.set = set
+	e.modTimes = modTimes
+	return nil
+}
+
+// current returns the policies, reloading them first if a file was changed, added or removed. A
+// failed reload keeps the previous policies, as the files may be mid-update.
+func (e *policyEngine) current() *PolicySet {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if time.Since(e.checkedAt) < policyReloadCheckInterval {
+		return e.set
+	}
+	e.checkedAt = time.Now()
+
+	modTimes, err := policyModTimes(e.paths)
+	if err == nil && sameModTimes(modTimes, e.modTimes) {
+		return e.set
+	}
+	if err := e.load(); err != nil {
+		log.Printf("Keeping the previous policies, reloading them failed: %v", err)
+		return e.set
+	}
+	log.Printf("Reloaded %d policies", len(e.set.Policies))
+
+	return e.set
+}
+
+func policyModTimes(paths []string) (map[string]time.Time, error) {
+	files, _, err := policyFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read policy file %s", file)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+func sameModTimes(a map[string]time.Time, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, modTime := range a {
+		if other, ok := b[file]; !ok || !other.Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// policyFiles expands directories into the policy and test files they contain, each sorted
+func policyFiles(paths []string) (policies []string, tests []string, err error) {
+	add := func(file string) {
+		name := strings.TrimSuffix(file, filepath.Ext(file))
+		if strings.HasSuffix(name, policyTestSuffix) {
+			tests = append(tests, file)
+		} else {
+			policies = append(policies, file)
+		}
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "unable to read policies from %s", path)
+		}
+		if !info.IsDir() {
+			add(path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "unable to read policies from %s", path)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && contains(policyExtensions, filepath.Ext(entry.Name())) {
+				add(filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(policies)
+	sort.Strings(tests)
+
+	return policies, tests, nil
+}
+
+func decodeYAMLFile(path string, v interface{}) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read %s", path)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(v); err != nil && err != io.EOF {
+		return errors.Wrapf(err, "unable to parse %s", path)
+	}
+
+	return nil
+}
+
+// checkPolicies refuses a membership change that a policy denies, with a 403 naming the policy
+func (c *AuthentikClient) checkPolicies(entry AuditEntry, options ChangeOptions, targets *changeTargets) error {
+	engine := c.backend.config.policies
+	if engine == nil {
+		return nil
+	}
+
+	input, err := policyInput(entry, options, targets)
+	if err != nil {
+		return err
+	}
+	decision := engine.current().Evaluate(input)
+	if decision.Allowed {
+		return nil
+	}
+
+	return &ClientError{
+		StatusCode: http.StatusForbidden,
+		Message:    "the change is denied by policy " + decision.Policy,
+		innerError: errors.New(decision.Reason),
+	}
+}
+
+// policyInput describes a membership change and the objects involved to the policies
+func policyInput(entry AuditEntry, options ChangeOptions, targets *changeTargets) (PolicyInput, error) {
+	source := entry.Source
+	if source == "" {
+		source = "opal"
+	}
+	input := PolicyInput{
+		Request: map[string]interface{}{
+			"operation":       entry.Operation,
+			"source":          source,
+			"method":          options.Method,
+			"route":           options.Route,
+			"app_id":          entry.AppID,
+			"group_id":        entry.GroupID,
+			"user_id":         entry.UserID,
+			"member_group_id": entry.MemberGroupID,
+		},
+		Now: time.Now(),
+	}
+
+	var err error
+	if input.Group, err = toPolicyObject(targets.group); err != nil {
+		return input, err
+	}
+	if targets.memberGroup != nil {
+		if input.MemberGroup, err = toPolicyObject(targets.memberGroup); err != nil {
+			return input, err
+		}
+	}
+	if targets.user != nil {
+		if input.User, err = toPolicyObject(targets.user); err != nil {
+			return input, err
+		}
+	}
+
+	return input, nil
+}
+
+// toPolicyObject converts an Authentik object to the map policies see, using its API field names
+func toPolicyObject(v interface{}) (map[string]interface{}, error) {
+	serialized, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to serialize object for policies")
+	}
+	object := make(map[string]interface{})
+	if err := json.Unmarshal(serialized, &object); err != nil {
+		return nil, errors.Wrap(err, "unable to serialize object for policies")
+	}
+	return object, nil
+}
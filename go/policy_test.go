@@ -0,0 +1,139 @@
+package openapi
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicies = `policies:
+  - name: no-bob-on-platform
+    expression: '!(group.name == "Platform" && user.username == "bob")'
+    reason: bob is not allowed on the platform team
+  - name: no-nesting-from-opal
+    expression: 'request.operation == "add_group_to_group" && request.source == "opal" ? "nest groups with reconcile" : ""'
+`
+
+func newPolicyTestConnector(t *testing.T, policies string) (*testConnector, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "membership.yaml")
+	if err := os.WriteFile(path, []byte(policies), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tc := newTestConnector(t, "policies:\n  paths: ["+dir+"]\n")
+	seedGroups(tc)
+	return tc, path
+}
+
+func TestPolicies(t *testing.T) {
+	tc, _ := newPolicyTestConnector(t, testPolicies)
+
+	var errResp Error
+	decode(t, tc.do(http.MethodPost, appPath("/groups/platform/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusForbidden, &errResp)
+	if !strings.Contains(errResp.Message, "denied by policy no-bob-on-platform") || !strings.Contains(errResp.Message, "bob is not allowed") {
+		t.Errorf("expected the policy and its reason in the error, got %q", errResp.Message)
+	}
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/member-groups"), `{"group_id":"platform","app_id":"`+testAppID+`"}`), http.StatusForbidden, &errResp)
+	if !strings.Contains(errResp.Message, "denied by policy no-nesting-from-opal") || !strings.Contains(errResp.Message, "nest groups with reconcile") {
+		t.Errorf("expected the string returned by the policy as the reason, got %q", errResp.Message)
+	}
+	if mutating := mutatingRequests(tc); len(mutating) != 0 {
+		t.Errorf("expected no changes to Authentik, got %v", mutating)
+	}
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/platform/users"), `{"user_id":"1","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+}
+
+func TestPoliciesFailClosed(t *testing.T) {
+	tc, _ := newPolicyTestConnector(t, `policies:
+  - name: needs-cost-center
+    expression: 'user.attributes.cost_center != ""'
+`)
+
+	var errResp Error
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusForbidden, &errResp)
+	if !strings.Contains(errResp.Message, "needs-cost-center") || !strings.Contains(errResp.Message, "failed to evaluate") {
+		t.Errorf("expected a policy that cannot be evaluated to deny the change, got %q", errResp.Message)
+	}
+}
+
+func TestPoliciesReload(t *testing.T) {
+	tc, path := newPolicyTestConnector(t, testPolicies)
+	engine := getTestConfig(t).policies
+
+	allowAll := "policies:\n  - name: allow-all\n    expression: 'true'\n"
+	if err := os.WriteFile(path, []byte(allowAll), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is seen even on file systems with coarse modification times
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	engine.mu.Lock()
+	engine.checkedAt = time.Time{}
+	engine.mu.Unlock()
+	decode(t, tc.do(http.MethodPost, appPath("/groups/platform/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+
+	// A broken file keeps the policies in force
+	if err := os.WriteFile(path, []byte("policies:\n  - name: broken\n    expression: 'user.'\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	engine.mu.Lock()
+	engine.checkedAt = time.Time{}
+	engine.mu.Unlock()
+	if set := engine.current(); len(set.Policies) != 1 || set.Policies[0].Name != "allow-all" {
+		t.Errorf("expected the previous policies to be kept, got %+v", set.Policies)
+	}
+}
+
+func TestInvalidPolicies(t *testing.T) {
+	dir := t.TempDir()
+	contents := `policies:
+  - name: typo
+    expression: 'user.usernme = "bob"'
+  - name: number
+    expression: '1 + 1'
+`
+	if err := os.WriteFile(filepath.Join(dir, "bad.yaml"), []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadPolicies([]string{dir})
+	if err == nil || !strings.Contains(err.Error(), "policy typo") || !strings.Contains(err.Error(), "must evaluate to a bool or a string") {
+		t.Errorf("expected both policies to be rejected, got %v", err)
+	}
+}
+
+func TestExamplePolicies(t *testing.T) {
+	results, err := RunPolicyTests([]string{"../policies.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatal("expected the example policies to have tests")
+	}
+	for _, result := range results {
+		if !result.Passed {
+			t.Errorf("%s: %s", result.Name, result.Problem)
+		}
+	}
+}
+
+func getTestConfig(t *testing.T) *Config {
+	t.Helper()
+	config, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
@@ -0,0 +1,167 @@
+package openapi
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	authentik "goauthentik.io/api/v3"
+)
+
+const (
+	ProtectedGroupsSuperuserEnvKey = "PROTECTED_GROUPS_SUPERUSER"
+	ProtectedGroupNamesEnvKey      = "PROTECTED_GROUP_NAMES"
+	ProtectedGroupIDsEnvKey        = "PROTECTED_GROUP_IDS"
+	ProtectedGroupsAttributeEnvKey = "PROTECTED_GROUPS_ATTRIBUTE"
+	ProtectedGroupsHideEnvKey      = "PROTECTED_GROUPS_HIDE"
+)
+
+// ProtectedGroupsConfig lists the groups the connector refuses to change, whoever asks
+type ProtectedGroupsConfig struct {
+	// Groups that grant superuser rights, directly or through a parent
+	Superuser bool `yaml:"superuser"`
+	// Regular expressions that must match the whole group name, e.g. "authentik Admins" or "(?i)admins-.*"
+	Names []string `yaml:"names"`
+	// Primary keys of groups
+	IDs []string `yaml:"ids"`
+	// Groups whose attributes set this key to true
+	Attribute string `yaml:"attribute"`
+	// Leave protected groups out of everything Opal reads and the export, as if they did not exist
+	Hide bool `yaml:"hide"`
+
+	names []*regexp.Regexp
+}
+
+func defaultProtectedGroupsConfig() ProtectedGroupsConfig {
+	return ProtectedGroupsConfig{
+		Superuser: true,
+	}
+}
+
+func (c *ProtectedGroupsConfig) applyEnv(configErr *ConfigError) {
+	overrideBool(&c.Superuser, ProtectedGroupsSuperuserEnvKey, configErr)
+	// Names may contain spaces, so lists are separated by commas only
+	if value := os.Getenv(ProtectedGroupNamesEnvKey); value != "" {
+		c.Names = splitList(value)
+	}
+	if value := os.Getenv(ProtectedGroupIDsEnvKey); value != "" {
+		c.IDs = splitList(value)
+	}
+	overrideString(&c.Attribute, ProtectedGroupsAttributeEnvKey)
+	overrideBool(&c.Hide, ProtectedGroupsHideEnvKey, configErr)
+}
+
+func (c *ProtectedGroupsConfig) validate(configErr *ConfigError) {
+	c.names = nil
+	for _, name := range c.Names {
+		pattern, err := regexp.Compile("^(?:" + name + ")$")
+		if err != nil {
+			configErr.add("protected_groups.names: %q is not a valid regular expression: %v", name, err)
+			continue
+		}
+		c.names = append(c.names, pattern)
+	}
+}
+
+// match returns the rule protecting the group, looking at the group alone, or "" if none does
+func (c *ProtectedGroupsConfig) match(group *authentik.Group) string {
+	if c.Superuser && group.GetIsSuperuser() {
+		return "it grants superuser rights (protected_groups.superuser)"
+	}
+	for _, id := range c.IDs {
+		if strings.EqualFold(id, group.GetPk()) {
+			return "it is listed in protected_groups.ids"
+		}
+	}
+	for i, pattern := range c.names {
+		if pattern.MatchString(group.GetName()) {
+			return "its name matches the protected_groups.names pattern " + c.Names[i]
+		}
+	}
+	if c.Attribute != "" {
+		if protected, ok := group.GetAttributes()[c.Attribute].(bool); ok && protected {
+			return "its attribute " + c.Attribute + " is true (protected_groups.attribute)"
+		}
+	}
+
+	return ""
+}
+
+// checkGroupNotProtected refuses changes to a protected group with a 403 citing the rule. Members of
+// a group inherit superuser rights from its ancestors, so those are looked up too.
+func (c *AuthentikClient) checkGroupNotProtected(ctx context.Context, group *authentik.Group) error {
+	rules := &c.backend.config.ProtectedGroups
+
+	if rule := rules.match(group); rule != "" {
+		return protectedGroupError(group, rule)
+	}
+	if !rules.Superuser {
+		return nil
+	}
+
+	seen := map[string]bool{group.GetPk(): true}
+	for parentID := group.GetParent(); parentID != "" && !seen[parentID]; {
+		parent, err := c.GetGroup(ctx, parentID)
+		if err != nil {
+			return err
+		}
+		if parent.GetIsSuperuser() {
+			return protectedGroupError(group, "it inherits superuser rights from "+parent.GetName()+" (protected_groups.superuser)")
+		}
+		seen[parentID] = true
+		parentID = parent.GetParent()
+	}
+
+	return nil
+}
+
+func protectedGroupError(group *authentik.Group, rule string) error {
+	return &ClientError{
+		StatusCode: http.StatusForbidden,
+		Message:    "refusing to change protected group " + group.GetName() + " (" + group.GetPk() + ")",
+		innerError: errors.New(rule),
+	}
+}
+
+// hidden reports whether a group should be left out of what Opal reads. Only the group itself is
+// looked at, not its ancestors.
+func (c *ProtectedGroupsConfig) hidden(group *authentik.Group) bool {
+	return c.Hide && c.match(group) != ""
+}
+
+// checkGroupVisible answers for a hidden group as Authentik does for a missing one, with a 404 and the
+// message of the read, so Opal cannot tell the group exists
+func (c *AuthentikClient) checkGroupVisible(ctx context.Context, groupID string, message string) error {
+	rules := &c.backend.config.ProtectedGroups
+	if !rules.Hide {
+		return nil
+	}
+
+	group, err := c.GetGroup(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	if rules.hidden(group) {
+		return hiddenGroupError(message)
+	}
+	return nil
+}
+
+func hiddenGroupError(message string) error {
+	return &ClientError{StatusCode: http.StatusNotFound, Message: message, innerError: errors.New("404 Not Found")}
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
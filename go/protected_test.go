@@ -0,0 +1,124 @@
+package openapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+func seedProtectedGroups(tc *testConnector) {
+	seedGroups(tc)
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "admins", Name: "authentik Admins", IsSuperuser: true})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "oncall-admins", Name: "On-call admins", Parent: "admins"})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "breakglass", Name: "Break glass"})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "payments", Name: "Payments", Attributes: map[string]interface{}{"opal_protected": true}})
+}
+
+func TestProtectedGroupsAreRefused(t *testing.T) {
+	tc := newTestConnector(t, "protected_groups:\n  names: [\"(?i)break glass\"]\n  attribute: opal_protected\n")
+	seedProtectedGroups(tc)
+
+	for _, request := range []struct {
+		method string
+		path   string
+		body   string
+		rule   string
+	}{
+		{http.MethodPost, "/groups/admins/users", `{"user_id":"2"}`, "grants superuser rights"},
+		{http.MethodPost, "/groups/oncall-admins/users", `{"user_id":"2"}`, "inherits superuser rights from authentik Admins"},
+		{http.MethodDelete, "/groups/breakglass/users/1", "", "protected_groups.names pattern (?i)break glass"},
+		{http.MethodPost, "/groups/payments/users", `{"user_id":"2"}`, "attribute opal_protected"},
+		// Nesting a group in a superuser group would make its members superusers
+		{http.MethodPost, "/groups/admins/member-groups", `{"group_id":"platform"}`, "grants superuser rights"},
+		{http.MethodPost, "/groups/eng/member-groups", `{"group_id":"payments"}`, "attribute opal_protected"},
+	} {
+		body := request.body
+		if body != "" {
+			body = strings.TrimSuffix(body, "}") + `,"app_id":"` + testAppID + `"}`
+		}
+		var errResp Error
+		decode(t, tc.do(request.method, appPath(request.path), body), http.StatusForbidden, &errResp)
+		if !strings.Contains(errResp.Message, "refusing to change protected group") || !strings.Contains(errResp.Message, request.rule) {
+			t.Errorf("%s %s: expected the error to cite %q, got %q", request.method, request.path, request.rule, errResp.Message)
+		}
+	}
+
+	if mutating := mutatingRequests(tc); len(mutating) != 0 {
+		t.Errorf("expected no changes to Authentik, got %v", mutating)
+	}
+	entries := tc.auditEntries()
+	if len(entries) != 6 || entries[0].Outcome != AuditOutcomeFailure {
+		t.Errorf("expected refusals to be audited, got %+v", entries)
+	}
+
+	// Unprotected groups are unaffected
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+}
+
+func TestProtectedGroupsByID(t *testing.T) {
+	tc := newTestConnector(t, "protected_groups:\n  superuser: false\n  ids: [eng]\n  hide: true\n")
+	seedProtectedGroups(tc)
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusForbidden, nil)
+	// Superuser groups can be changed once that rule is turned off
+	decode(t, tc.do(http.MethodPost, appPath("/groups/admins/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+
+	var resp GroupsResponse
+	decode(t, tc.do(http.MethodGet, appPath("/groups"), ""), http.StatusOK, &resp)
+	for _, group := range resp.Groups {
+		if group.Id == "eng" {
+			t.Errorf("expected the protected group to be hidden, got %+v", resp.Groups)
+		}
+	}
+	if len(resp.Groups) != 5 {
+		t.Errorf("expected the other groups to be listed, got %+v", resp.Groups)
+	}
+}
+
+func TestHiddenGroupsOnEveryReadPath(t *testing.T) {
+	tc := newTestConnector(t, "protected_groups:\n  superuser: false\n  ids: [oncall-admins]\n  hide: true\n")
+	seedProtectedGroups(tc)
+
+	// A hidden group looks exactly like a missing one
+	for _, path := range []string{"/groups/%s", "/groups/%s/users", "/groups/%s/member-groups"} {
+		var hidden, missing Error
+		decode(t, tc.do(http.MethodGet, appPath(fmt.Sprintf(path, "oncall-admins")), ""), http.StatusNotFound, &hidden)
+		decode(t, tc.do(http.MethodGet, appPath(fmt.Sprintf(path, "missing")), ""), http.StatusNotFound, &missing)
+		if hidden.Message != missing.Message {
+			t.Errorf("%s: expected the error of a missing group %q, got %q", path, missing.Message, hidden.Message)
+		}
+	}
+
+	// Nor is it listed as a member group
+	var memberGroups GroupMemberGroupsResponse
+	decode(t, tc.do(http.MethodGet, appPath("/groups/admins/member-groups"), ""), http.StatusOK, &memberGroups)
+	if len(memberGroups.Groups) != 0 {
+		t.Errorf("expected the hidden member group to be left out, got %+v", memberGroups.Groups)
+	}
+
+	inventory, err := testClient(t).ExportInventory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range inventory.Groups {
+		if group.Id == "oncall-admins" {
+			t.Errorf("expected the hidden group to be left out of the export, got %+v", inventory.Groups)
+		}
+	}
+	if len(inventory.Groups) != 5 || len(inventory.Nesting) != 0 {
+		t.Errorf("expected the other groups without the hidden nesting, got %+v and %+v", inventory.Groups, inventory.Nesting)
+	}
+}
+
+func TestInvalidProtectedGroupPattern(t *testing.T) {
+	configErr := &ConfigError{}
+	rules := ProtectedGroupsConfig{Names: []string{"admins-("}}
+	rules.validate(configErr)
+	if len(configErr.Problems) != 1 {
+		t.Errorf("expected the pattern to be rejected, got %v", configErr.Problems)
+	}
+}
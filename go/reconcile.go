@@ -0,0 +1,290 @@
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// DesiredState declares the members of groups that are managed as code rather than through Opal
+type DesiredState struct {
+	Groups []DesiredGroup `yaml:"groups"`
+}
+
+// DesiredGroup declares the direct members of one Authentik group. Leaving out users or
+// member_groups leaves that side of the group unmanaged, while an empty list removes every member.
+type DesiredGroup struct {
+	// Primary key of the group, as Opal knows it
+	Group string `yaml:"group"`
+	// User IDs, as Opal knows them, or emails
+	Users []string `yaml:"users"`
+	// Primary keys of the groups nested directly in this one
+	MemberGroups []string `yaml:"member_groups"`
+}
+
+// LoadDesiredState reads and checks a desired state file
+func LoadDesiredState(path string) (*DesiredState, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read desired state %s", path)
+	}
+
+	state := &DesiredState{}
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(state); err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "unable to parse desired state %s", path)
+	}
+
+	stateErr := &ConfigError{}
+	seen := make(map[string]bool)
+	parents := make(map[string]string)
+	for i, group := range state.Groups {
+		if group.Group == "" {
+			stateErr.add("groups[%d].group is required", i)
+			continue
+		}
+		if seen[group.Group] {
+			stateErr.add("group %s is declared more than once", group.Group)
+		}
+		seen[group.Group] = true
+		if group.Users == nil && group.MemberGroups == nil {
+			stateErr.add("group %s declares neither users nor member_groups", group.Group)
+		}
+		for _, child := range group.MemberGroups {
+			// Authentik groups have a single parent
+			if parent, ok := parents[child]; ok {
+				stateErr.add("group %s is declared as a member group of both %s and %s", child, parent, group.Group)
+			}
+			if child == group.Group {
+				stateErr.add("group %s cannot be a member group of itself", child)
+			}
+			parents[child] = group.Group
+		}
+	}
+	if len(stateErr.Problems) > 0 {
+		return nil, stateErr
+	}
+
+	return state, nil
+}
+
+// ReconcileChange is one membership change needed to reach the desired state. Operation is one of
+// the AuditOperation constants.
+type ReconcileChange struct {
+	Operation       string
+	GroupID         string
+	GroupName       string
+	UserID          string
+	UserEmail       string
+	MemberGroupID   string
+	MemberGroupName string
+	// Set when nesting a group moves it out of the group it is currently nested in
+	PreviousParent string
+}
+
+type ReconcilePlan struct {
+	Changes []ReconcileChange
+}
+
+// PlanReconcile compares the desired state with the live members of each declared group
+func (c *AuthentikClient) PlanReconcile(ctx context.Context, state *DesiredState) (*ReconcilePlan, error) {
+	emails, err := c.resolveEmails(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &ReconcilePlan{}
+	for _, desired := range state.Groups {
+		group, err := c.GetGroup(ctx, desired.Group)
+		if err != nil {
+			return nil, err
+		}
+
+		if desired.Users != nil {
+			members, err := c.GetGroupUsers(ctx, desired.Group)
+			if err != nil {
+				return nil, err
+			}
+			current := make(map[string]string, len(members))
+			for _, member := range members {
+				current[strconv.Itoa(int(member.GetPk()))] = member.GetEmail()
+			}
+
+			wanted := make(map[string]bool, len(desired.Users))
+			for _, user := range desired.Users {
+				userID := user
+				if strings.Contains(user, "@") {
+					userID = emails[strings.ToLower(user)]
+				}
+				if wanted[userID] {
+					continue
+				}
+				wanted[userID] = true
+				if _, ok := current[userID]; !ok {
+					email := user
+					if !strings.Contains(user, "@") {
+						email = ""
+					}
+					plan.add(ReconcileChange{Operation: AuditOperationAddUserToGroup, GroupID: group.GetPk(), GroupName: group.GetName(), UserID: userID, UserEmail: email})
+				}
+			}
+			for _, userID := range sortedKeys(current) {
+				if !wanted[userID] {
+					plan.add(ReconcileChange{Operation: AuditOperationRemoveUserFromGroup, GroupID: group.GetPk(), GroupName: group.GetName(), UserID: userID, UserEmail: current[userID]})
+				}
+			}
+		}
+
+		if desired.MemberGroups != nil {
+			children, err := c.ListChildrenGroups(ctx, desired.Group)
+			if err != nil {
+				return nil, err
+			}
+			current := make(map[string]string, len(children))
+			for _, child := range children {
+				current[child.GetPk()] = child.GetName()
+			}
+
+			wanted := make(map[string]bool, len(desired.MemberGroups))
+			for _, childID := range desired.MemberGroups {
+				wanted[childID] = true
+				if _, ok := current[childID]; ok {
+					continue
+				}
+				child, err := c.GetGroup(ctx, childID)
+				if err != nil {
+					return nil, err
+				}
+				plan.add(ReconcileChange{
+					Operation:       AuditOperationAddGroupToGroup,
+					GroupID:         group.GetPk(),
+					GroupName:       group.GetName(),
+					MemberGroupID:   child.GetPk(),
+					MemberGroupName: child.GetName(),
+					PreviousParent:  child.GetParentName(),
+				})
+			}
+			for _, childID := range sortedKeys(current) {
+				if !wanted[childID] {
+					plan.add(ReconcileChange{Operation: AuditOperationRemoveGroupFromGroup, GroupID: group.GetPk(), GroupName: group.GetName(), MemberGroupID: childID, MemberGroupName: current[childID]})
+				}
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+func (p *ReconcilePlan) add(change ReconcileChange) {
+	p.Changes = append(p.Changes, change)
+}
+
+// resolveEmails maps the emails used in the desired state to user IDs, walking the users only if needed
+func (c *AuthentikClient) resolveEmails(ctx context.Context, state *DesiredState) (map[string]string, error) {
+	needed := make(map[string]bool)
+	for _, group := range state.Groups {
+		for _, user := range group.Users {
+			if strings.Contains(user, "@") {
+				needed[strings.ToLower(user)] = true
+			}
+		}
+	}
+	emails := make(map[string]string)
+	if len(needed) == 0 {
+		return emails, nil
+	}
+
+	for cursor := ""; ; {
+		users, nextCursor, err := c.PaginatedListUsers(ctx, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if email := strings.ToLower(user.GetEmail()); needed[email] {
+				emails[email] = strconv.Itoa(int(user.GetPk()))
+			}
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	var unknown []string
+	for email := range needed {
+		if _, ok := emails[email]; !ok {
+			unknown = append(unknown, email)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, errors.Errorf("no Authentik user has the email %s", strings.Join(unknown, ", "))
+	}
+
+	return emails, nil
+}
+
+// ApplyReconcilePlan makes the changes of a plan through the same client methods Opal's requests use,
+// so they are audited alike. It stops at the first change that fails and reports how many were made.
+func (c *AuthentikClient) ApplyReconcilePlan(ctx context.Context, plan *ReconcilePlan) (applied int, err error) {
+	options := ChangeOptions{Source: AuditSourceReconcile}
+	for _, change := range plan.Changes {
+
+		switch change.Operation {
+		case AuditOperationAddUserToGroup:
+			err = c.AddUserToGroup(ctx, change.GroupID, change.UserID, options)
+		case AuditOperationRemoveUserFromGroup:
+			err = c.RemoveUserFromGroup(ctx, change.GroupID, change.UserID, options)
+		case AuditOperationAddGroupToGroup:
+			err = c.AddGroupToGroup(ctx, change.GroupID, change.MemberGroupID, options)
+		case AuditOperationRemoveGroupFromGroup:
+			err = c.RemoveGroupFromGroup(ctx, change.GroupID, change.MemberGroupID, options)
+		default:
+			err = errors.Errorf("unknown operation %s", change.Operation)
+		}
+		if err != nil {
+			return applied, errors.Wrapf(err, "failed to %s", change.Describe())
+		}
+		applied++
+	}
+
+	return applied, nil
+}
+
+// Describe returns a one line description of the change
+func (c ReconcileChange) Describe() string {
+	user := c.UserID
+	if c.UserEmail != "" {
+		user += " (" + c.UserEmail + ")"
+	}
+	group := c.GroupName + " (" + c.GroupID + ")"
+	memberGroup := c.MemberGroupID
+	if c.MemberGroupName != "" {
+		memberGroup = c.MemberGroupName + " (" + c.MemberGroupID + ")"
+	}
+
+	switch c.Operation {
+	case AuditOperationAddUserToGroup:
+		return "add user " + user + " to " + group
+	case AuditOperationRemoveUserFromGroup:
+		return "remove user " + user + " from " + group
+	case AuditOperationAddGroupToGroup:
+		description := "nest group " + memberGroup + " in " + group
+		if c.PreviousParent != "" {
+			description += ", moving it out of " + c.PreviousParent
+		}
+		return description
+	case AuditOperationRemoveGroupFromGroup:
+		return "unnest group " + memberGroup + " from " + group
+	}
+
+	return c.Operation + " on " + group
+}
@@ -0,0 +1,117 @@
+package openapi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+func writeDesiredState(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "state.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReconcile(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "oncall", Name: "On-call", Parent: "eng"})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "breakglass", Name: "Break glass", Users: []int32{1}})
+	client := testClient(t)
+
+	state, err := LoadDesiredState(writeDesiredState(t, `
+groups:
+  - group: breakglass
+    users: ["bob@example.com"]
+    member_groups: [oncall]
+  - group: eng
+    users: ["1", "2"]
+`))
+	if err != nil {
+		t.Fatalf("LoadDesiredState: %v", err)
+	}
+
+	plan, err := client.PlanReconcile(context.Background(), state)
+	if err != nil {
+		t.Fatalf("PlanReconcile: %v", err)
+	}
+	var described []string
+	for _, change := range plan.Changes {
+		described = append(described, change.Describe())
+	}
+	want := []string{
+		"add user 2 (bob@example.com) to Break glass (breakglass)",
+		"remove user 1 (alice@example.com) from Break glass (breakglass)",
+		"nest group On-call (oncall) in Break glass (breakglass), moving it out of Engineering",
+		"add user 2 to Engineering (eng)",
+	}
+	if !reflect.DeepEqual(described, want) {
+		t.Fatalf("expected plan\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(described, "\n"))
+	}
+
+	applied, err := client.ApplyReconcilePlan(context.Background(), plan)
+	if err != nil || applied != len(want) {
+		t.Fatalf("ApplyReconcilePlan applied %d: %v", applied, err)
+	}
+	if group, _ := tc.authentik.Group("breakglass"); !reflect.DeepEqual(group.Users, []int32{2}) {
+		t.Errorf("expected break glass to hold only bob, got %v", group.Users)
+	}
+	if group, _ := tc.authentik.Group("oncall"); group.Parent != "breakglass" {
+		t.Errorf("expected on-call to be nested in break glass, got parent %q", group.Parent)
+	}
+
+	entries := tc.auditEntries()
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d audit entries, got %+v", len(want), entries)
+	}
+	for _, entry := range entries {
+		if entry.Source != AuditSourceReconcile || entry.Outcome != AuditOutcomeSuccess {
+			t.Errorf("expected a successful reconcile entry, got %+v", entry)
+		}
+	}
+
+	plan, err = client.PlanReconcile(context.Background(), state)
+	if err != nil || len(plan.Changes) != 0 {
+		t.Errorf("expected no changes once reconciled, got %+v, %v", plan, err)
+	}
+}
+
+func TestReconcileUnknownEmail(t *testing.T) {
+	tc := newTestConnector(t, "")
+	seedGroups(tc)
+
+	state := &DesiredState{Groups: []DesiredGroup{{Group: "eng", Users: []string{"nobody@example.com"}}}}
+	if _, err := testClient(t).PlanReconcile(context.Background(), state); err == nil || !strings.Contains(err.Error(), "nobody@example.com") {
+		t.Errorf("expected an unknown email to be reported, got %v", err)
+	}
+}
+
+func TestLoadDesiredStateRejectsConflicts(t *testing.T) {
+	_, err := LoadDesiredState(writeDesiredState(t, `
+groups:
+  - group: a
+    member_groups: [c]
+  - group: b
+    member_groups: [c]
+  - group: a
+    users: []
+  - group: d
+`))
+	if err == nil {
+		t.Fatal("expected the desired state to be rejected")
+	}
+	for _, problem := range []string{"member group of both a and b", "a is declared more than once", "d declares neither"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q to be reported, got %v", problem, err)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package openapi
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	authentik "goauthentik.io/api/v3"
+)
+
+const (
+	RemovalLimitMaxEnvKey           = "REMOVAL_LIMIT_MAX"
+	RemovalLimitWindowEnvKey        = "REMOVAL_LIMIT_WINDOW"
+	RemovalLimitAlertWebhookEnvKey  = "REMOVAL_LIMIT_ALERT_WEBHOOK"
+	RemovalLimitStateFileEnvKey     = "REMOVAL_LIMIT_STATE_FILE"
+	RemovalLimitOperatorTokenEnvKey = "REMOVAL_LIMIT_OPERATOR_TOKEN"
+)
+
+const DefaultRemovalLimitWindow = 10 * time.Minute
+
+const removalLimitAlertTimeout = 10 * time.Second
+
+// Routes for operators to inspect and reset the removal limit. They are not signed by Opal, a
+// signature only proves a request came from Opal, which must not be able to resume removals.
+const (
+	removalLimitPath      = "/removal-limit"
+	removalLimitResetPath = "/removal-limit/reset"
+)
+
+// RemovalLimit is the most removals allowed within a sliding window. A Max of 0 means no limit.
+type RemovalLimit struct {
+	Max    int           `yaml:"max"`
+	Window time.Duration `yaml:"window"`
+}
+
+// RemovalLimitConfig bounds how many users and member groups can be removed from groups in a short
+// time, so a misconfigured sync cannot empty groups wholesale. Once a limit is exceeded, every
+// change, additions included, is refused until an operator resets the limit.
+type RemovalLimitConfig struct {
+	// Removals across all groups
+	RemovalLimit `yaml:",inline"`
+	// Removals from a single group, keyed by group primary key
+	Groups map[string]RemovalLimit `yaml:"groups"`
+	// File recording a tripped limit, so the halt survives restarts and applies to CLI runs
+	StateFile string `yaml:"state_file"`
+	// URL POSTed a JSON alert when changes are halted, Slack compatible. May refer to a secret.
+	AlertWebhook string `yaml:"alert_webhook"`
+	// Bearer token operators present to inspect and reset the limit. May refer to a secret. The
+	// routes refuse every request while it is unset.
+	OperatorToken string `yaml:"operator_token"`
+}
+
+func (c *RemovalLimitConfig) applyEnv(configErr *ConfigError) {
+	overrideInt(&c.Max, RemovalLimitMaxEnvKey, configErr)
+	overrideDuration(&c.Window, RemovalLimitWindowEnvKey, configErr)
+	overrideString(&c.StateFile, RemovalLimitStateFileEnvKey)
+	overrideSecret(&c.AlertWebhook, RemovalLimitAlertWebhookEnvKey)
+	overrideSecret(&c.OperatorToken, RemovalLimitOperatorTokenEnvKey)
+}
+
+func (c *RemovalLimitConfig) applyDefaults() {
+	if c.Window == 0 {
+		c.Window = DefaultRemovalLimitWindow
+	}
+	for groupID, limit := range c.Groups {
+		if limit.Window == 0 {
+			limit.Window = c.Window
+			c.Groups[groupID] = limit
+		}
+	}
+}
+
+func (c *RemovalLimitConfig) validate(configErr *ConfigError) {
+	if c.Max < 0 {
+		configErr.add("removal_limit.max (%s) must not be negative", RemovalLimitMaxEnvKey)
+	}
+	if c.Window < 0 {
+		configErr.add("removal_limit.window (%s) must be positive", RemovalLimitWindowEnvKey)
+	}
+	if c.enabled() && c.StateFile == "" {
+		configErr.add("removal_limit.state_file (%s) is required with a removal limit, so a halt survives restarts", RemovalLimitStateFileEnvKey)
+	}
+	for _, groupID := range c.groupIDs() {
+		limit := c.Groups[groupID]
+		if limit.Max <= 0 {
+			configErr.add("removal_limit.groups.%s.max must be positive", groupID)
+		}
+		if limit.Window < 0 {
+			configErr.add("removal_limit.groups.%s.window must be positive", groupID)
+		}
+	}
+}
+
+func (c *RemovalLimitConfig) enabled() bool {
+	return c.Max > 0 || len(c.Groups) > 0
+}
+
+func (c *RemovalLimitConfig) groupIDs() []string {
+	groupIDs := make([]string, 0, len(c.Groups))
+	for groupID := range c.Groups {
+		groupIDs = append(groupIDs, groupID)
+	}
+	sort.Strings(groupIDs)
+	return groupIDs
+}
+
+// RemovalLimitTrip records why changes were halted
+type RemovalLimitTrip struct {
+	Time time.Time `json:"time"`
+	// Group whose limit was exceeded, empty for the limit across all groups
+	GroupID  string `json:"group_id,omitempty"`
+	Removals int    `json:"removals"`
+	Max      int    `json:"max"`
+	Window   string `json:"window"`
+}
+
+func (t *RemovalLimitTrip) String() string {
+	scope := "across all groups"
+	if t.GroupID != "" {
+		scope = "from group " + t.GroupID
+	}
+	return fmt.Sprintf("%d removals %s within %s exceed the limit of %d", t.Removals, scope, t.Window, t.Max)
+}
+
+// removalLimiter counts the removals made through a backend. Counts are kept in memory, but a trip
+// is written to the state file shared by the server and the CLI, so only a reset resumes changes.
+// The file is read before every change, which also picks up trips and resets by other processes.
+type removalLimiter struct {
+	mu       sync.Mutex
+	path     string
+	backend  string
+	removals map[string][]time.Time
+	// Whether the last read of the state file found changes halted
+	halted bool
+}
+
+func newRemovalLimiter(path string, backend string) *removalLimiter {
+	return &removalLimiter{path: path, backend: backend, removals: make(map[string][]time.Time)}
+}
+
+// record counts a removal from the group unless changes are halted. It returns the trip halting
+// changes, if any, and whether this removal caused it.
+func (l *removalLimiter) record(config *RemovalLimitConfig, groupID string, now time.Time) (*RemovalLimitTrip, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	trips, err := l.current()
+	if err != nil {
+		return nil, false, err
+	}
+	if trip := trips[l.backend]; trip != nil {
+		return trip, false, nil
+	}
+
+	// The removal is only kept in the windows once it is allowed, a refused removal is not made
+	counted := make(map[string][]time.Time)
+	var trip *RemovalLimitTrip
+	count := func(key string, limit RemovalLimit) {
+		removals := append(append([]time.Time(nil), l.removals[key]...), now)
+		cutoff := now.Add(-limit.Window)
+		for len(removals) > 0 && !removals[0].After(cutoff) {
+			removals = removals[1:]
+		}
+		counted[key] = removals
+		if trip == nil && len(removals) > limit.Max {
+			trip = &RemovalLimitTrip{Time: now, GroupID: key, Removals: len(removals), Max: limit.Max, Window: limit.Window.String()}
+		}
+	}
+
+	if limit, ok := config.Groups[groupID]; ok {
+		count(groupID, limit)
+	}
+	// The key of the limit across groups cannot clash with a group primary key
+	if config.Max > 0 {
+		count("", config.RemovalLimit)
+	}
+	if trip == nil {
+		for key, removals := range counted {
+			l.removals[key] = removals
+		}
+		return nil, false, nil
+	}
+
+	l.halted = true
+	trips[l.backend] = trip
+	if err := l.save(trips); err != nil {
+		// The removal is refused all the same, but the halt would not survive a restart
+		log.Printf("Unable to persist the removal limit trip for %s: %v", l.backend, err)
+	}
+	return trip, true, nil
+}
+
+func (l *removalLimiter) state() (*RemovalLimitTrip, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	trips, err := l.current()
+	if err != nil {
+		return nil, err
+	}
+	return trips[l.backend], nil
+}
+
+// reset resumes changes and starts counting afresh, returning the trip that halted them, if any
+func (l *removalLimiter) reset() (*RemovalLimitTrip, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	trips, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	trip := trips[l.backend]
+	delete(trips, l.backend)
+	if err := l.save(trips); err != nil {
+		return nil, err
+	}
+	l.removals = make(map[string][]time.Time)
+	l.halted = false
+	return trip, nil
+}
+
+// current reads the trips from the state file. A halt that is gone from the file was reset by another
+// process, such as the CLI, so counting starts afresh as after a reset here.
+func (l *removalLimiter) current() (map[string]*RemovalLimitTrip, error) {
+	trips, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	halted := trips[l.backend] != nil
+	if l.halted && !halted {
+		l.removals = make(map[string][]time.Time)
+	}
+	l.halted = halted
+	return trips, nil
+}
+
+// load reads the trips of every backend from the state file, which is missing until one trips
+func (l *removalLimiter) load() (map[string]*RemovalLimitTrip, error) {
+	trips := make(map[string]*RemovalLimitTrip)
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return trips, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read the removal limit state file")
+	}
+	if err := json.Unmarshal(data, &trips); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the removal limit state file %s", l.path)
+	}
+	return trips, nil
+}
+
+// save replaces the state file, through a rename so readers never see a partial file
+func (l *removalLimiter) save(trips map[string]*RemovalLimitTrip) error {
+	data, err := json.MarshalIndent(trips, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "unable to write the removal limit state file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "unable to write the removal limit state file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "unable to write the removal limit state file")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), l.path), "unable to write the removal limit state file")
+}
+
+// RemovalLimitState returns the trip halting changes through the backend, nil while they are allowed
+func (b *Backend) RemovalLimitState() (*RemovalLimitTrip, error) {
+	if !b.config.RemovalLimit.enabled() {
+		return nil, nil
+	}
+	return b.removals.state()
+}
+
+// ResetRemovalLimit resumes changes through the backend, returning the trip that halted them, if any
+func (b *Backend) ResetRemovalLimit() (*RemovalLimitTrip, error) {
+	if !b.config.RemovalLimit.enabled() {
+		return nil, nil
+	}
+	trip, err := b.removals.reset()
+	if err == nil && trip != nil {
+		log.Printf("Changes for %s resumed by an operator, they were halted as %s", b.Name, trip)
+	}
+	return trip, err
+}
+
+// checkRemovalLimit counts a removal from the group against the configured limits. The removal that
+// exceeds a limit is refused with a 429 and fires the alert, and every change after it with a 503
+// until an operator resets the limit.
+func (c *AuthentikClient) checkRemovalLimit(groupID string) error {
+	config := &c.backend.config.RemovalLimit
+	if !config.enabled() {
+		return nil
+	}
+
+	trip, tripped, err := c.backend.removals.record(config, groupID, time.Now())
+	if err != nil {
+		return &ClientError{StatusCode: http.StatusInternalServerError, Message: "failed to check the removal limit", innerError: err}
+	}
+	if trip == nil {
+		return nil
+	}
+	if tripped {
+		log.Printf("Halting changes for %s: %s", c.backend.Name, trip)
+		go c.backend.sendRemovalLimitAlert(trip)
+		return &ClientError{
+			StatusCode: http.StatusTooManyRequests,
+			Message:    "removal limit exceeded, changes are halted until an operator resets the limit",
+			innerError: errors.New(trip.String()),
+		}
+	}
+
+	return haltedError(trip)
+}
+
+// checkUserRemovalLimit counts the removal of a user who is a member of the group. Removing a user who
+// is not, such as when Opal retries a removal whose revocation failed, changes nothing and is not
+// counted, so the retry goes through to repeat the revocation.
+func (c *AuthentikClient) checkUserRemovalLimit(group *authentik.Group, userPK int32) error {
+	if !c.backend.config.RemovalLimit.enabled() {
+		return nil
+	}
+
+	for _, pk := range group.Users {
+		if pk == userPK {
+			return c.checkRemovalLimit(group.GetPk())
+		}
+	}
+	return nil
+}
+
+// checkNotHalted refuses additions while a tripped removal limit halts changes, as a sync that
+// wrongly removes users may wrongly add them too
+func (c *AuthentikClient) checkNotHalted() error {
+	trip, err := c.backend.RemovalLimitState()
+	if err != nil {
+		return &ClientError{StatusCode: http.StatusInternalServerError, Message: "failed to check the removal limit", innerError: err}
+	}
+	if trip == nil {
+		return nil
+	}
+	return haltedError(trip)
+}
+
+func haltedError(trip *RemovalLimitTrip) error {
+	return &ClientError{
+		StatusCode: http.StatusServiceUnavailable,
+		Message:    "changes are halted since " + trip.Time.UTC().Format(time.RFC3339) + " until an operator resets the removal limit",
+		innerError: errors.New(trip.String()),
+	}
+}
+
+// sendRemovalLimitAlert POSTs the trip to the alert webhook. The text field makes it readable when
+// posted to a Slack or Mattermost incoming webhook.
+func (b *Backend) sendRemovalLimitAlert(trip *RemovalLimitTrip) {
+	webhook, err := b.config.ResolveSecret(b.config.RemovalLimit.AlertWebhook)
+	if err != nil || webhook == "" {
+		if err != nil {
+			log.Printf("Unable to send removal limit alert: %v", err)
+		}
+		return
+	}
+
+	body, err := json.Marshal(struct {
+		Text    string `json:"text"`
+		Backend string `json:"backend"`
+		*RemovalLimitTrip
+	}{
+		Text:             fmt.Sprintf("Opal Authentik connector halted changes for %s: %s. Reset the removal limit once the cause is understood.", b.Name, trip),
+		Backend:          b.Name,
+		RemovalLimitTrip: trip,
+	})
+	if err != nil {
+		log.Printf("Unable to send removal limit alert: %v", err)
+		return
+	}
+
+	client := &http.Client{Timeout: removalLimitAlertTimeout}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Unable to send removal limit alert: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Removal limit alert webhook responded with status %s", resp.Status)
+	}
+}
+
+// registerRemovalLimitRoutes adds the routes operators use to see whether changes are halted and
+// to resume changes, for the backend of the app_id query parameter. They sit on the admin listener when
+// there is one, and always require the operator token.
+func registerRemovalLimitRoutes(router gin.IRoutes, config *Config) {
+	router.GET(removalLimitPath, requireOperatorToken(config), getRemovalLimit)
+	router.POST(removalLimitResetPath, requireOperatorToken(config), resetRemovalLimit)
+}
+
+// requireOperatorToken checks the bearer token against removal_limit.operator_token before picking
+// the backend, so callers without the token learn nothing about the configured apps
+func requireOperatorToken(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		expected, err := config.ResolveSecret(config.RemovalLimit.OperatorToken)
+		if err != nil {
+			log.Printf("Unable to resolve the removal limit operator token: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, &Error{
+				Code:    http.StatusInternalServerError,
+				Message: "Unable to load operator token",
+			})
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, &Error{
+				Code:    http.StatusUnauthorized,
+				Message: "Invalid operator token",
+			})
+			return
+		}
+
+		backend, ok := config.Backend(c.Query("app_id"))
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, &Error{
+				Code:    http.StatusNotFound,
+				Message: "Unknown app_id",
+			})
+			return
+		}
+
+		c.Set(backendContextKey, backend)
+		c.Next()
+	}
+}
+
+// Get /removal-limit
+func getRemovalLimit(c *gin.Context) {
+	backend, err := backendFromCtx(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
+		return
+	}
+
+	trip, err := backend.RemovalLimitState()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"halted": trip != nil, "trip": trip})
+}
+
+// Post /removal-limit/reset
+func resetRemovalLimit(c *gin.Context) {
+	backend, err := backendFromCtx(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
+		return
+	}
+
+	trip, err := backend.ResetRemovalLimit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, buildRespFromErr(err, http.StatusInternalServerError))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"halted": false, "reset": trip})
+}
@@ -0,0 +1,208 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+func TestRemovalLimit(t *testing.T) {
+	alerts := make(chan map[string]interface{}, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("unable to decode alert: %v", err)
+		}
+		alerts <- alert
+	}))
+	defer webhook.Close()
+
+	tc := newTestConnector(t, removalLimitConfig(t, "  max: 3\n  window: 1m\n  groups:\n    eng: {max: 1}\n  alert_webhook: "+webhook.URL+"\n"))
+	tc.authentik.AddUser(authentiktest.User{Pk: 1, Username: "alice"})
+	tc.authentik.AddUser(authentiktest.User{Pk: 2, Username: "bob"})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "eng", Name: "Engineering", Users: []int32{1, 2}})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "platform", Name: "Platform", Users: []int32{1, 2}})
+
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/1"), ""), http.StatusOK, nil)
+
+	var errResp Error
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/2"), ""), http.StatusTooManyRequests, &errResp)
+	if !strings.Contains(errResp.Message, "removal limit exceeded") || !strings.Contains(errResp.Message, "2 removals from group eng within 1m0s exceed the limit of 1") {
+		t.Errorf("expected the exceeded limit in the error, got %q", errResp.Message)
+	}
+	select {
+	case alert := <-alerts:
+		if alert["group_id"] != "eng" || !strings.Contains(alert["text"].(string), "halted changes") {
+			t.Errorf("unexpected alert %v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an alert to be sent")
+	}
+
+	// Every change is refused until the limit is reset, additions included
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/platform/users/1"), ""), http.StatusServiceUnavailable, &errResp)
+	if !strings.Contains(errResp.Message, "changes are halted") {
+		t.Errorf("expected changes to be halted, got %q", errResp.Message)
+	}
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/member-groups"), `{"group_id":"platform","app_id":"`+testAppID+`"}`), http.StatusServiceUnavailable, nil)
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"1","app_id":"`+testAppID+`"}`), http.StatusServiceUnavailable, nil)
+	if mutating := mutatingRequests(tc); len(mutating) != 1 {
+		t.Errorf("expected only the first removal, got %v", mutating)
+	}
+
+	var state struct {
+		Halted bool              `json:"halted"`
+		Trip   *RemovalLimitTrip `json:"trip"`
+	}
+	decode(t, tc.operatorRequest(http.MethodGet, appPath("/removal-limit"), testOperatorToken), http.StatusOK, &state)
+	if !state.Halted || state.Trip == nil || state.Trip.GroupID != "eng" {
+		t.Errorf("expected removals to be reported as halted, got %+v", state)
+	}
+
+	decode(t, tc.operatorRequest(http.MethodPost, appPath("/removal-limit/reset"), testOperatorToken), http.StatusOK, nil)
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/platform/users/1"), ""), http.StatusOK, nil)
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/member-groups"), `{"group_id":"platform","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+}
+
+func TestRemovalLimitCountsNestedGroupsOnly(t *testing.T) {
+	tc := newTestConnector(t, removalLimitConfig(t, "  max: 1\n"))
+	seedGroups(tc)
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "sre", Name: "SRE", Parent: "platform"})
+
+	// sre is nested in platform, not eng, so removing it from eng changes and counts nothing
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/member-groups/sre"), ""), http.StatusOK, nil)
+	if group, _ := tc.authentik.Group("sre"); group.Parent != "platform" {
+		t.Errorf("expected sre to stay nested in platform, parent is %q", group.Parent)
+	}
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/platform/member-groups/sre"), ""), http.StatusOK, nil)
+	if group, _ := tc.authentik.Group("sre"); group.Parent != "" {
+		t.Errorf("expected sre to be removed from platform, parent is %q", group.Parent)
+	}
+}
+
+func TestRemovalLimitNeedsOperatorToken(t *testing.T) {
+	tc := newTestConnector(t, removalLimitConfig(t, "  max: 1\n"))
+	seedGroups(tc)
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/1"), ""), http.StatusOK, nil)
+	tc.authentik.AddUser(authentiktest.User{Pk: 3, Username: "carol"})
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"3","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/3"), ""), http.StatusTooManyRequests, nil)
+
+	// A request signed by Opal is not an operator
+	decode(t, tc.do(http.MethodPost, appPath("/removal-limit/reset"), ""), http.StatusUnauthorized, nil)
+	decode(t, tc.do(http.MethodGet, appPath("/removal-limit"), ""), http.StatusUnauthorized, nil)
+	decode(t, tc.operatorRequest(http.MethodPost, appPath("/removal-limit/reset"), "wrong"), http.StatusUnauthorized, nil)
+
+	if trip, err := testClient(t).backend.RemovalLimitState(); err != nil || trip == nil {
+		t.Error("expected removals to stay halted")
+	}
+}
+
+func TestRemovalLimitRoutesWithoutOperatorToken(t *testing.T) {
+	tc := newTestConnector(t, "removal_limit:\n  max: 1\n  state_file: "+filepath.Join(t.TempDir(), "state.json")+"\n")
+
+	decode(t, tc.operatorRequest(http.MethodPost, appPath("/removal-limit/reset"), ""), http.StatusUnauthorized, nil)
+}
+
+func TestRemovalLimitWindow(t *testing.T) {
+	config := &RemovalLimitConfig{RemovalLimit: RemovalLimit{Max: 2, Window: time.Minute}}
+	path := filepath.Join(t.TempDir(), "state.json")
+	limiter := newRemovalLimiter(path, "default")
+	start := time.Now()
+
+	for i, offset := range []time.Duration{0, 30 * time.Second, 61 * time.Second, 91 * time.Second} {
+		if trip, _, err := limiter.record(config, "eng", start.Add(offset)); trip != nil || err != nil {
+			t.Fatalf("removal %d: expected removals older than the window to be forgotten, got %s, %v", i, trip, err)
+		}
+	}
+	trip, tripped, err := limiter.record(config, "platform", start.Add(92*time.Second))
+	if err != nil || !tripped || trip.GroupID != "" || trip.Removals != 3 {
+		t.Fatalf("expected the overall limit to be exceeded, got %+v, %v", trip, err)
+	}
+	if _, tripped, _ := limiter.record(config, "platform", start.Add(time.Hour)); tripped {
+		t.Error("expected removals to stay halted without alerting again")
+	}
+
+	// The refused removal is not counted, neither against its group nor across groups
+	groups := &RemovalLimitConfig{RemovalLimit: RemovalLimit{Max: 3, Window: time.Minute}, Groups: map[string]RemovalLimit{"eng": {Max: 1, Window: time.Minute}}}
+	limiter = newRemovalLimiter(filepath.Join(t.TempDir(), "state.json"), "default")
+	limiter.record(groups, "eng", start)
+	if _, tripped, _ := limiter.record(groups, "eng", start); !tripped {
+		t.Fatal("expected the group limit to be exceeded")
+	}
+	if len(limiter.removals["eng"]) != 1 || len(limiter.removals[""]) != 1 {
+		t.Errorf("expected only the allowed removal to be counted, got %v", limiter.removals)
+	}
+}
+
+func TestRemovalLimitPersists(t *testing.T) {
+	config := &RemovalLimitConfig{RemovalLimit: RemovalLimit{Max: 1, Window: time.Minute}}
+	path := filepath.Join(t.TempDir(), "state.json")
+	now := time.Now()
+
+	server := newRemovalLimiter(path, "default")
+	other := newRemovalLimiter(path, "other")
+	server.record(config, "eng", now)
+	if _, tripped, err := server.record(config, "eng", now); !tripped || err != nil {
+		t.Fatalf("expected the limit to be exceeded, got %v", err)
+	}
+
+	// A restarted server or a reconcile run starts with no counts, yet stays halted
+	restarted := newRemovalLimiter(path, "default")
+	if trip, tripped, err := restarted.record(config, "eng", now); trip == nil || tripped || err != nil {
+		t.Fatalf("expected the trip to be loaded from the state file, got %+v, %v", trip, err)
+	}
+	if trip, err := other.state(); trip != nil || err != nil {
+		t.Errorf("expected other backends to be unaffected, got %+v, %v", trip, err)
+	}
+
+	// A reset by one process resumes changes for every process
+	if trip, err := restarted.reset(); trip == nil || err != nil {
+		t.Fatalf("expected the trip to be reset, got %+v, %v", trip, err)
+	}
+	if trip, err := server.state(); trip != nil || err != nil {
+		t.Errorf("expected the reset to be seen by the server, got %+v, %v", trip, err)
+	}
+	// The server counts afresh, as the refused removal and those before the reset are forgotten
+	if trip, _, err := server.record(config, "eng", now); trip != nil || err != nil {
+		t.Errorf("expected the server to count afresh after the reset, got %+v, %v", trip, err)
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.record(config, "eng", now); err == nil {
+		t.Error("expected an unreadable state file to refuse removals")
+	}
+}
+
+func TestRemovalLimitNeedsStateFile(t *testing.T) {
+	config := &RemovalLimitConfig{RemovalLimit: RemovalLimit{Max: 1, Window: time.Minute}}
+
+	configErr := &ConfigError{}
+	config.validate(configErr)
+	if !strings.Contains(configErr.Error(), "removal_limit.state_file") {
+		t.Errorf("expected the state file to be required, got %q", configErr.Error())
+	}
+}
+
+const testOperatorToken = "operator-token"
+
+// operatorRequest sends an unsigned request with the operator's bearer token
+func (tc *testConnector) operatorRequest(method string, path string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return tc.serve(req)
+}
+
+// removalLimitConfig returns the removal_limit section with a state file and the operator token
+func removalLimitConfig(t *testing.T, settings string) string {
+	return "removal_limit:\n" + settings + "  state_file: " + filepath.Join(t.TempDir(), "state.json") + "\n  operator_token: " + testOperatorToken + "\n"
+}
@@ -0,0 +1,146 @@
+package openapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	authentik "goauthentik.io/api/v3"
+)
+
+const (
+	RevokeSessionsEnvKey     = "REVOKE_SESSIONS"
+	RevokeAppPasswordsEnvKey = "REVOKE_APP_PASSWORDS"
+)
+
+// RevocationActions is what is revoked when a user is removed from a group, so the removal takes
+// effect immediately rather than when the user's sessions expire
+type RevocationActions struct {
+	// End the user's authenticated sessions, so they sign in again and apps see the new groups
+	Sessions bool `yaml:"sessions"`
+	// Expire the user's app password tokens
+	AppPasswords bool `yaml:"app_passwords"`
+}
+
+type RevocationConfig struct {
+	// Actions for every group
+	RevocationActions `yaml:",inline"`
+	// Actions for individual groups, keyed by group primary key, replacing the actions above
+	Groups map[string]RevocationActions `yaml:"groups"`
+}
+
+func (c *RevocationConfig) applyEnv(configErr *ConfigError) {
+	overrideBool(&c.Sessions, RevokeSessionsEnvKey, configErr)
+	overrideBool(&c.AppPasswords, RevokeAppPasswordsEnvKey, configErr)
+}
+
+// actions returns what to revoke when a user is removed from the group
+func (c *RevocationConfig) actions(groupID string) RevocationActions {
+	if actions, ok := c.Groups[groupID]; ok {
+		return actions
+	}
+	return c.RevocationActions
+}
+
+// any returns the actions taken for at least one group, to work out the permissions needed
+func (c *RevocationConfig) any() RevocationActions {
+	actions := c.RevocationActions
+	for _, group := range c.Groups {
+		actions.Sessions = actions.Sessions || group.Sessions
+		actions.AppPasswords = actions.AppPasswords || group.AppPasswords
+	}
+	return actions
+}
+
+// revokeAccess ends the sessions and expires the app passwords of a user just removed from the
+// group, as configured for the group. Failures are returned as a 502 so Opal retries the removal,
+// which repeats the revocation, whatever Authentik answered: Opal does not retry a 4xx.
+func (c *AuthentikClient) revokeAccess(ctx context.Context, groupID string, user *authentik.User, entry *AuditEntry) error {
+	actions := c.backend.config.Revocation.actions(groupID)
+	if !actions.Sessions && !actions.AppPasswords {
+		return nil
+	}
+
+	ctxWithAuth := c.addAuthTokenToCtx(ctx)
+
+	if actions.Sessions {
+		var sessions []string
+		for page := int32(1); ; page++ {
+			list, resp, err := c.client.CoreApi.CoreAuthenticatedSessionsList(ctxWithAuth).UserUsername(user.GetUsername()).Page(page).PageSize(DefaultPageSize).Execute()
+			if err != nil {
+				return revocationError(resp, "failed to list the user's sessions in Authentik", err)
+			}
+			for _, session := range list.Results {
+				sessions = append(sessions, session.GetUuid())
+			}
+			if getNextCursorFromPagination(list.Pagination) == "" {
+				break
+			}
+		}
+		// Sessions are deleted once all are listed, as deleting shifts the pages
+		for _, uuid := range sessions {
+			resp, err := c.client.CoreApi.CoreAuthenticatedSessionsDestroy(ctxWithAuth, uuid).Execute()
+			if err == nil {
+				entry.SessionsRevoked++
+			} else if resp == nil || resp.StatusCode != http.StatusNotFound {
+				// Sessions that ended meanwhile are fine
+				return revocationError(resp, "failed to end the user's sessions in Authentik", err)
+			}
+		}
+	}
+
+	if actions.AppPasswords {
+		var tokens []authentik.Token
+		for page := int32(1); ; page++ {
+			list, resp, err := c.client.CoreApi.CoreTokensList(ctxWithAuth).UserUsername(user.GetUsername()).Intent(string(authentik.INTENTENUM_APP_PASSWORD)).Page(page).PageSize(DefaultPageSize).Execute()
+			if err != nil {
+				return revocationError(resp, "failed to list the user's app passwords in Authentik", err)
+			}
+			tokens = append(tokens, list.Results...)
+			if getNextCursorFromPagination(list.Pagination) == "" {
+				break
+			}
+		}
+
+		now := time.Now()
+		for _, token := range tokens {
+			if expires := token.Expires.Get(); token.GetExpiring() && expires != nil && expires.Before(now) {
+				continue
+			}
+			expiring := true
+			_, resp, err := c.client.CoreApi.CoreTokensPartialUpdate(ctxWithAuth, token.Identifier).PatchedTokenRequest(authentik.PatchedTokenRequest{
+				Expires:  *authentik.NewNullableTime(&now),
+				Expiring: &expiring,
+			}).Execute()
+			if err != nil {
+				return revocationError(resp, "failed to expire the user's app passwords in Authentik", err)
+			}
+			entry.AppPasswordsExpired++
+		}
+	}
+
+	return nil
+}
+
+// retriesRevocation tells whether removing a user who is no longer a member of the group is Opal
+// retrying a removal whose revocation failed, in which case only the revocation is repeated
+func (c *AuthentikClient) retriesRevocation(group *authentik.Group, userPK int32) bool {
+	actions := c.backend.config.Revocation.actions(group.GetPk())
+	if !actions.Sessions && !actions.AppPasswords {
+		return false
+	}
+	for _, pk := range group.Users {
+		if pk == userPK {
+			return false
+		}
+	}
+	return true
+}
+
+func revocationError(resp *http.Response, message string, err error) error {
+	if resp != nil {
+		err = errors.Wrapf(err, "Authentik responded with %s", resp.Status)
+	}
+	return &ClientError{StatusCode: http.StatusBadGateway, Message: "the user was removed from the group, but " + message, innerError: err}
+}
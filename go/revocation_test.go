@@ -0,0 +1,118 @@
+package openapi
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+const revocationConfig = `revocation:
+  sessions: true
+  groups:
+    platform: {sessions: true, app_passwords: true}
+`
+
+func seedRevocation(tc *testConnector) {
+	tc.authentik.AddUser(authentiktest.User{Pk: 1, Username: "alice", Sessions: []string{"alice-laptop", "alice-phone"}})
+	tc.authentik.AddUser(authentiktest.User{Pk: 2, Username: "bob", Sessions: []string{"bob-laptop"}})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "eng", Name: "Engineering", Users: []int32{1, 2}})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "platform", Name: "Platform", Users: []int32{1, 2}})
+	tc.authentik.AddToken(authentiktest.Token{Identifier: "alice-git", Key: "alice-git-key", User: 1, Intent: "app_password", Expiring: true})
+	tc.authentik.AddToken(authentiktest.Token{Identifier: "bob-git", Key: "bob-git-key", User: 2, Intent: "app_password"})
+	tc.authentik.AddToken(authentiktest.Token{Identifier: "bob-api", Key: "bob-api-key", User: 2, Intent: "api"})
+}
+
+func TestRevocationOnRemoval(t *testing.T) {
+	tc := newTestConnector(t, revocationConfig)
+	seedRevocation(tc)
+
+	// The defaults only end sessions
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/1"), ""), http.StatusOK, nil)
+	if alice, _ := tc.authentik.User(1); len(alice.Sessions) != 0 {
+		t.Errorf("expected alice's sessions to be ended, got %v", alice.Sessions)
+	}
+	if bob, _ := tc.authentik.User(2); len(bob.Sessions) != 1 {
+		t.Errorf("expected bob's sessions to be kept, got %v", bob.Sessions)
+	}
+	if token, _ := tc.authentik.Token("alice-git"); !token.Expires.IsZero() {
+		t.Errorf("expected alice's app password to be kept, got %+v", token)
+	}
+
+	// The group's own actions also expire app passwords, but no other tokens
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/platform/users/2"), ""), http.StatusOK, nil)
+	if bob, _ := tc.authentik.User(2); len(bob.Sessions) != 0 {
+		t.Errorf("expected bob's sessions to be ended, got %v", bob.Sessions)
+	}
+	if token, _ := tc.authentik.Token("bob-git"); !token.Expiring || token.Expires.IsZero() {
+		t.Errorf("expected bob's app password to be expired, got %+v", token)
+	}
+	if token, _ := tc.authentik.Token("bob-api"); !token.Expires.IsZero() {
+		t.Errorf("expected bob's API token to be kept, got %+v", token)
+	}
+
+	entries := tc.auditEntries()
+	if len(entries) != 2 || entries[0].SessionsRevoked != 2 || entries[1].SessionsRevoked != 1 || entries[1].AppPasswordsExpired != 1 {
+		t.Errorf("expected revocations to be audited, got %+v", entries)
+	}
+}
+
+func TestRevocationFailure(t *testing.T) {
+	tc := newTestConnector(t, "  events: true\n"+revocationConfig+removalLimitConfig(t, "  max: 1\n"))
+	seedRevocation(tc)
+	tc.authentik.Fail(authentiktest.Failure{Method: http.MethodDelete, Path: "/api/v3/core/authenticated_sessions/", Status: http.StatusForbidden, Times: 1})
+
+	// Opal does not retry a 4xx, so Authentik's 403 is not passed on
+	var errResp Error
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/1"), ""), http.StatusBadGateway, &errResp)
+	if !strings.Contains(errResp.Message, "the user was removed from the group, but failed to end the user's sessions") {
+		t.Errorf("expected the failed revocation to be reported, got %q", errResp.Message)
+	}
+	entries := tc.auditEntries()
+	if len(entries) != 1 || entries[0].Outcome != AuditOutcomeSuccess || !strings.Contains(entries[0].RevocationError, "403") {
+		t.Errorf("expected the removal to be audited as made, with the revocation error, got %+v", entries)
+	}
+
+	// Opal retries the removal, which ends the remaining sessions without counting against the limit
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/1"), ""), http.StatusOK, nil)
+	if alice, _ := tc.authentik.User(1); len(alice.Sessions) != 0 {
+		t.Errorf("expected alice's sessions to be ended on retry, got %v", alice.Sessions)
+	}
+	if trip, _ := testClient(t).backend.RemovalLimitState(); trip != nil {
+		t.Errorf("expected the retry not to count as a removal, got %s", trip)
+	}
+	entries = tc.auditEntries()
+	if len(entries) != 2 || !entries[1].RevocationRetry || entries[1].Outcome != AuditOutcomeSuccess || entries[1].SessionsRevoked != 2 || entries[1].AuthentikStatus != 0 {
+		t.Errorf("expected the retry to be audited as a revocation only, got %+v", entries)
+	}
+	if events := tc.authentik.Events(); len(events) != 1 {
+		t.Errorf("expected a single event for the removal, got %+v", events)
+	}
+	removals := 0
+	for _, request := range tc.authentik.Requests() {
+		if request == "POST /api/v3/core/groups/eng/remove_user/" {
+			removals++
+		}
+	}
+	if removals != 1 {
+		t.Errorf("expected the retry not to remove the user again, got %d removals", removals)
+	}
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/users/2"), ""), http.StatusTooManyRequests, nil)
+}
+
+func TestRevocationPermissions(t *testing.T) {
+	newTestConnector(t, revocationConfig)
+
+	permissions := testClient(t).backend.RequiredPermissions()
+	for _, permission := range []string{
+		"authentik_core.view_authenticatedsession",
+		"authentik_core.delete_authenticatedsession",
+		"authentik_core.view_token",
+		"authentik_core.change_token",
+	} {
+		if !contains(permissions, permission) {
+			t.Errorf("expected %s to be required, got %v", permission, permissions)
+		}
+	}
+}
@@ -15,8 +15,8 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io/ioutil"
+	"log"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -42,23 +42,50 @@ func NewRouter(handleFunctions ApiHandleFunctions) *gin.Engine {
 
 // NewRouter add routes to existing gin engine.
 func NewRouterWithGinEngine(router *gin.Engine, handleFunctions ApiHandleFunctions) *gin.Engine {
-	router.Use(validateOpalSignature(os.Getenv("OPAL_SIGNING_SECRET")))
+	config, err := getConfig()
+	if err != nil {
+		log.Fatalf("Unable to load configuration: %v", err)
+	}
+
+	// Health checks and the operator routes are not signed by Opal, so they are registered outside the
+	// signature middleware, unless they are served on a separate admin port
+	if config.AdminListenAddress == "" {
+		registerHealthRoutes(router)
+		registerRemovalLimitRoutes(router, config)
+	}
+
+	doc, err := loadSpec()
+	if err != nil {
+		log.Fatalf("Unable to load OpenAPI spec: %v", err)
+	}
+
+	// Each app_id is routed to its own Authentik instance, which also determines the signing secret
+	api := router.Group("/", resolveBackend(config), validateOpalSignature(func(c *gin.Context) (string, error) {
+		backend, err := backendFromCtx(c)
+		if err != nil {
+			return "", err
+		}
+		return backend.SigningSecret()
+	}), validateOpenAPI(doc, config.Validation))
 
 	for _, route := range getRoutes(handleFunctions) {
 		if route.HandlerFunc == nil {
 			route.HandlerFunc = DefaultHandleFunc
 		}
+		if capability, ok := routeCapabilities[route.Name]; ok && !config.Capabilities.Enabled(capability) {
+			route.HandlerFunc = capabilityDisabled(capability)
+		}
 		switch route.Method {
 		case http.MethodGet:
-			router.GET(route.Pattern, route.HandlerFunc)
+			api.GET(route.Pattern, route.HandlerFunc)
 		case http.MethodPost:
-			router.POST(route.Pattern, route.HandlerFunc)
+			api.POST(route.Pattern, route.HandlerFunc)
 		case http.MethodPut:
-			router.PUT(route.Pattern, route.HandlerFunc)
+			api.PUT(route.Pattern, route.HandlerFunc)
 		case http.MethodPatch:
-			router.PATCH(route.Pattern, route.HandlerFunc)
+			api.PATCH(route.Pattern, route.HandlerFunc)
 		case http.MethodDelete:
-			router.DELETE(route.Pattern, route.HandlerFunc)
+			api.DELETE(route.Pattern, route.HandlerFunc)
 		}
 	}
 
@@ -220,8 +247,18 @@ func GenerateSignature(
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func validateOpalSignature(signingSecret string) gin.HandlerFunc {
+// The signing secret is looked up on every request so that a rotated secret takes effect without a restart
+func validateOpalSignature(getSigningSecret func(c *gin.Context) (string, error)) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		signingSecret, err := getSigningSecret(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, &Error{
+				Code:    http.StatusInternalServerError,
+				Message: "Unable to load signing secret",
+			})
+			return
+		}
+
 		opalSignature := c.GetHeader("X-Opal-Signature")
 		if opalSignature == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, &Error{
@@ -243,7 +280,6 @@ func validateOpalSignature(signingSecret string) gin.HandlerFunc {
 		// Read request body, once the request body is read, it cannot be read again
 		// so we need to save it in a variable and then reassign it to the Request.Body
 		var bodyBytes []byte
-		var err error
 		if c.Request.Body != nil {
 			bodyBytes, err = ioutil.ReadAll(c.Request.Body)
 			if err != nil {
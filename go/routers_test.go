@@ -0,0 +1,155 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+func TestGetStatus(t *testing.T) {
+	tc := newTestConnector(t, "")
+
+	var resp struct {
+		Status               string   `json:"status"`
+		DisabledCapabilities []string `json:"disabled_capabilities"`
+	}
+	decode(t, tc.do(http.MethodGet, appPath("/status"), ""), http.StatusOK, &resp)
+	if resp.Status != "OK" || resp.DisabledCapabilities == nil || len(resp.DisabledCapabilities) != 0 {
+		t.Fatalf("unexpected status %+v", resp)
+	}
+}
+
+func TestDisabledCapabilities(t *testing.T) {
+	tc := newTestConnector(t, "capabilities:\n  member_groups: false\n")
+	seedGroups(tc)
+
+	var errResp Error
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/member-groups"), `{"group_id":"platform","app_id":"`+testAppID+`"}`), http.StatusForbidden, &errResp)
+	if !strings.Contains(errResp.Message, "member_groups capability is disabled") {
+		t.Errorf("unexpected error body %+v", errResp)
+	}
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/eng/member-groups/platform"), ""), http.StatusForbidden, nil)
+	if group, _ := tc.authentik.Group("platform"); group.Parent != "" {
+		t.Errorf("expected platform to be left alone, parent is %q", group.Parent)
+	}
+
+	// Other capabilities and reads are unaffected
+	decode(t, tc.do(http.MethodGet, appPath("/groups/eng/member-groups"), ""), http.StatusOK, nil)
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+
+	var resp struct {
+		DisabledCapabilities []string `json:"disabled_capabilities"`
+	}
+	decode(t, tc.do(http.MethodGet, appPath("/status"), ""), http.StatusOK, &resp)
+	if len(resp.DisabledCapabilities) != 1 || resp.DisabledCapabilities[0] != CapabilityMemberGroups {
+		t.Errorf("expected member_groups to be reported as disabled, got %v", resp.DisabledCapabilities)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tc := newTestConnector(t, "capabilities:\n  read_only: true\n")
+	seedGroups(tc)
+
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusForbidden, nil)
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/resources"), `{"resource_id":"r1","app_id":"`+testAppID+`"}`), http.StatusForbidden, nil)
+	if len(tc.auditEntries()) != 0 {
+		t.Errorf("a disabled route must not reach Authentik")
+	}
+	if required := testClient(t).backend.RequiredPermissions(); len(required) != 2 {
+		t.Errorf("expected only view permissions to be required, got %v", required)
+	}
+}
+
+func TestRequestsMustBeSigned(t *testing.T) {
+	tc := newTestConnector(t, "")
+
+	unsigned := httptest.NewRequest(http.MethodGet, appPath("/status"), nil)
+	decode(t, tc.serve(unsigned), http.StatusUnauthorized, nil)
+
+	forged := httptest.NewRequest(http.MethodGet, appPath("/status"), nil)
+	forged.Header.Set("X-Opal-Request-Timestamp", "1700000000")
+	forged.Header.Set("X-Opal-Signature", "0000")
+	var errResp Error
+	decode(t, tc.serve(forged), http.StatusUnauthorized, &errResp)
+	if errResp.Message != "Invalid signature" {
+		t.Fatalf("unexpected error body %+v", errResp)
+	}
+}
+
+func TestRequestsNeedAnAppID(t *testing.T) {
+	tc := newTestConnector(t, "")
+
+	decode(t, tc.do(http.MethodGet, "/status", ""), http.StatusBadRequest, nil)
+}
+
+func TestResourceRoutes(t *testing.T) {
+	// Authentik has no resources, these routes answer with placeholders that do not follow the spec
+	tc := newTestConnector(t, "validation:\n  responses: false\n")
+
+	for _, request := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/resources", ""},
+		{http.MethodGet, "/resources/r1", ""},
+		{http.MethodGet, "/resources/r1/access_levels", ""},
+		{http.MethodGet, "/resources/r1/users", ""},
+		{http.MethodPost, "/resources/r1/users", `{"user_id":"1","app_id":"` + testAppID + `"}`},
+		{http.MethodPost, "/groups/eng/resources", `{"resource_id":"r1","app_id":"` + testAppID + `"}`},
+		{http.MethodDelete, "/resources/r1/users/1", ""},
+		{http.MethodDelete, "/groups/eng/resources/r1", ""},
+	} {
+		decode(t, tc.do(request.method, appPath(request.path), request.body), http.StatusOK, nil)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	tc := newTestConnector(t, "")
+
+	decode(t, tc.serve(httptest.NewRequest(http.MethodGet, "/healthz", nil)), http.StatusOK, nil)
+	decode(t, tc.serve(httptest.NewRequest(http.MethodGet, "/readyz", nil)), http.StatusOK, nil)
+
+	// Probes within the cache TTL do not reach Authentik again
+	tc.authentik.Fail(authentiktest.Failure{Status: http.StatusForbidden})
+	decode(t, tc.serve(httptest.NewRequest(http.MethodGet, "/readyz", nil)), http.StatusOK, nil)
+	pings := 0
+	for _, request := range tc.authentik.Requests() {
+		if request == "GET /api/v3/core/users/me/" {
+			pings++
+		}
+	}
+	if pings != 1 {
+		t.Errorf("expected Authentik to be pinged once, got %d", pings)
+	}
+
+	// Only pass or fail is returned, the details are logged
+	backendReadiness.mu.Lock()
+	backendReadiness.results = make(map[*Backend]readinessResult)
+	backendReadiness.mu.Unlock()
+	var resp struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	decode(t, tc.serve(httptest.NewRequest(http.MethodGet, "/readyz", nil)), http.StatusServiceUnavailable, &resp)
+	if resp.Checks["authentik"] != healthCheckFailed || resp.Checks["config"] != healthCheckOK || len(resp.Checks) != 2 {
+		t.Errorf("expected only the outcome of each check, got %v", resp.Checks)
+	}
+}
+
+func TestUnknownAppsAreRejected(t *testing.T) {
+	fake := authentiktest.NewServer(testToken)
+	defer fake.Close()
+	tc := newTestConnector(t, "apps:\n  "+testAppID+":\n    authentik:\n      host: "+fake.Host()+"\n      scheme: http\n      token: "+testToken+"\n")
+
+	decode(t, tc.do(http.MethodGet, appPath("/status"), ""), http.StatusOK, nil)
+
+	var errResp Error
+	decode(t, tc.do(http.MethodGet, "/status?app_id=other-app", ""), http.StatusNotFound, &errResp)
+	if errResp.Code != http.StatusNotFound || !strings.Contains(errResp.Message, `Unknown app_id "other-app"`) {
+		t.Errorf("expected the unknown app_id to be named, got %+v", errResp)
+	}
+}
@@ -0,0 +1,455 @@
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	SecretsRefreshIntervalEnvKey = "SECRETS_REFRESH_INTERVAL"
+	VaultAddrEnvKey              = "VAULT_ADDR"
+	VaultTokenEnvKey             = "VAULT_TOKEN"
+	VaultTokenFileEnvKey         = "VAULT_TOKEN_FILE"
+	VaultNamespaceEnvKey         = "VAULT_NAMESPACE"
+)
+
+// Suffix of the environment variables that point at a file holding the value, e.g. AUTHENTIK_TOKEN_FILE
+const secretFileEnvSuffix = "_FILE"
+
+// Prefix of a secret used as is, for secrets that would otherwise read as a reference, e.g. "literal:file:x"
+const literalSecretPrefix = "literal:"
+
+const DefaultSecretsRefreshInterval = 5 * time.Minute
+
+const (
+	secretExecTimeout  = 10 * time.Second
+	secretVaultTimeout = 10 * time.Second
+	// How soon a secret that could not be refreshed is tried again, at most the refresh interval
+	secretRetryInterval = 30 * time.Second
+)
+
+// SecretProvider fetches the secrets that secret settings refer to. A secret setting is either
+// the secret itself or a reference of the form "<provider>:<ref>":
+//
+//	file:/run/secrets/authentik_token     contents of a file, e.g. a Docker or Kubernetes secret
+//	exec:/usr/local/bin/get-secret token  standard output of a command
+//	vault:secret/data/opal#token          a key of a HashiCorp Vault KV secret (v1 or v2)
+type SecretProvider interface {
+	Fetch(ref string) (string, error)
+}
+
+type fileSecretProvider struct{}
+
+func (fileSecretProvider) Fetch(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to read secret file %s", path)
+	}
+
+	// Secret files are usually written with a trailing newline
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// Store writes the secret to a file only the current user can read, replacing it atomically
+func (fileSecretProvider) Store(path string, value string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "unable to write secret file %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(value + "\n"); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "unable to write secret file %s", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "unable to write secret file %s", path)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "unable to write secret file %s", path)
+	}
+
+	return nil
+}
+
+type execSecretProvider struct{}
+
+func (execSecretProvider) Fetch(command string) (string, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return "", errors.New("secret command is empty")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "secret command %s failed", args[0])
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// splitCommand splits an exec: reference into arguments the way a shell would, without expanding
+// anything: single quotes keep everything up to the next single quote, and a backslash escapes the
+// next character, inside double quotes only a double quote or a backslash.
+func splitCommand(command string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\\' && (quote == 0 || (i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\'))):
+			if i+1 == len(runes) {
+				return nil, errors.New("secret command ends with a backslash")
+			}
+			i++
+			arg.WriteRune(runes[i])
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.Errorf("secret command has an unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
+type VaultConfig struct {
+	Address   string `yaml:"address"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Namespace string `yaml:"namespace"`
+}
+
+type vaultSecretProvider struct {
+	config VaultConfig
+	client *http.Client
+}
+
+func (p *vaultSecretProvider) Fetch(ref string) (string, error) {
+	path, key, err := parseVaultRef(ref)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := p.read(path)
+	if err != nil {
+		return "", err
+	}
+	if data == nil {
+		return "", errors.Errorf("vault returned 404 Not Found for secret %s", path)
+	}
+
+	value, ok := data[key].(string)
+	if !ok {
+		return "", errors.Errorf("vault secret %s has no string key %q", path, key)
+	}
+
+	return value, nil
+}
+
+// Store sets one key of a KV secret, keeping its other keys. Paths containing /data/ are written
+// in the KV v2 format.
+func (p *vaultSecretProvider) Store(ref string, value string) error {
+	path, key, err := parseVaultRef(ref)
+	if err != nil {
+		return err
+	}
+
+	data, err := p.read(path)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data[key] = value
+
+	var body interface{} = data
+	if strings.Contains("/"+strings.Trim(path, "/")+"/", "/data/") {
+		body = map[string]interface{}{"data": data}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrapf(err, "unable to encode vault secret %s", path)
+	}
+
+	resp, err := p.do(http.MethodPost, path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return errors.Errorf("vault returned %s when writing secret %s", resp.Status, path)
+	}
+
+	return nil
+}
+
+func parseVaultRef(ref string) (path string, key string, err error) {
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || key == "" {
+		return "", "", errors.Errorf("vault secret %q must have the form <path>#<key>", ref)
+	}
+
+	return path, key, nil
+}
+
+// read returns the data of a KV secret, or nil if it does not exist
+func (p *vaultSecretProvider) read(path string) (map[string]interface{}, error) {
+	resp, err := p.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("vault returned %s for secret %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse vault secret %s", path)
+	}
+
+	// KV v2 nests the secret under data.data, KV v1 puts it directly under data
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	return data, nil
+}
+
+func (p *vaultSecretProvider) do(method string, path string, body io.Reader) (*http.Response, error) {
+	if p.config.Address == "" {
+		return nil, errors.Errorf("vault secret %s requested but no vault address is configured", path)
+	}
+
+	token := p.config.Token
+	if p.config.TokenFile != "" {
+		fileToken, err := fileSecretProvider{}.Fetch(p.config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = fileToken
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(p.config.Address, "/")+"/v1/"+strings.TrimLeft(path, "/"), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to build vault request")
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if p.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.config.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to reach vault for secret %s", path)
+	}
+
+	return resp, nil
+}
+
+type cachedSecret struct {
+	value     string
+	refreshAt time.Time
+}
+
+// secretFetch is a fetch in progress, which callers without a cached value wait for
+type secretFetch struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+// SecretResolver turns secret settings into their values. Referenced secrets are cached and
+// re-read once they are older than the refresh interval, so a rotated secret is picked up
+// without restarting the connector.
+type SecretResolver struct {
+	mu              sync.Mutex
+	providers       map[string]SecretProvider
+	refreshInterval time.Duration
+	cache           map[string]cachedSecret
+	fetching        map[string]*secretFetch
+}
+
+// SecretSink stores secrets, for commands that create them. The file and vault providers are also sinks.
+type SecretSink interface {
+	Store(ref string, value string) error
+}
+
+// StoreSecret writes a secret to a "file:<path>" or "vault:<path>#<key>" reference
+func StoreSecret(config SecretsConfig, target string, value string) error {
+	providerName, ref, _ := strings.Cut(target, ":")
+	var sink SecretSink
+	switch providerName {
+	case "file":
+		sink = fileSecretProvider{}
+	case "vault":
+		sink = &vaultSecretProvider{config: config.Vault, client: &http.Client{Timeout: secretVaultTimeout}}
+	default:
+		return errors.Errorf("secrets can only be written to file: or vault: references, got %q", target)
+	}
+	if ref == "" {
+		return errors.Errorf("secret reference %q has no path", target)
+	}
+
+	return sink.Store(ref, value)
+}
+
+func NewSecretResolver(config SecretsConfig) *SecretResolver {
+	return &SecretResolver{
+		providers: map[string]SecretProvider{
+			"file":  fileSecretProvider{},
+			"exec":  execSecretProvider{},
+			"vault": &vaultSecretProvider{config: config.Vault, client: &http.Client{Timeout: secretVaultTimeout}},
+		},
+		refreshInterval: config.RefreshInterval,
+		cache:           make(map[string]cachedSecret),
+		fetching:        make(map[string]*secretFetch),
+	}
+}
+
+// isSecretRef reports whether a secret setting refers to a provider rather than holding the secret itself
+func isSecretRef(value string) bool {
+	provider, _, ok := strings.Cut(value, ":")
+	if !ok {
+		return false
+	}
+
+	switch provider {
+	case "file", "exec", "vault":
+		return true
+	}
+	return false
+}
+
+// redactSecretRef keeps only the command of an exec: reference, as its arguments may hold credentials
+func redactSecretRef(value string) string {
+	if !strings.HasPrefix(value, "exec:") {
+		return value
+	}
+	args, err := splitCommand(strings.TrimPrefix(value, "exec:"))
+	if err != nil {
+		return "exec:" + redactedValue
+	}
+	if len(args) <= 1 {
+		return value
+	}
+
+	return "exec:" + args[0] + " " + redactedValue
+}
+
+// Resolve returns the value of a secret setting. If a referenced secret cannot be re-read but an
+// earlier value is cached, the earlier value is used so a provider outage does not take the connector
+// down, and the secret is tried again after a short delay. Fetches run outside the lock, one per
+// secret at a time; callers with a cached value do not wait for them.
+func (r *SecretResolver) Resolve(value string) (string, error) {
+	if strings.HasPrefix(value, literalSecretPrefix) {
+		return strings.TrimPrefix(value, literalSecretPrefix), nil
+	}
+	if !isSecretRef(value) {
+		return value, nil
+	}
+
+	r.mu.Lock()
+	cached, hasCached := r.cache[value]
+	if hasCached && time.Now().Before(cached.refreshAt) {
+		r.mu.Unlock()
+		return cached.value, nil
+	}
+	if fetch, ok := r.fetching[value]; ok {
+		r.mu.Unlock()
+		if hasCached {
+			return cached.value, nil
+		}
+		<-fetch.done
+		return fetch.value, fetch.err
+	}
+	fetch := &secretFetch{done: make(chan struct{})}
+	r.fetching[value] = fetch
+	r.mu.Unlock()
+
+	providerName, ref, _ := strings.Cut(value, ":")
+	fetch.value, fetch.err = r.providers[providerName].Fetch(ref)
+
+	r.mu.Lock()
+	delete(r.fetching, value)
+	now := time.Now()
+	if fetch.err == nil {
+		r.cache[value] = cachedSecret{value: fetch.value, refreshAt: now.Add(r.refreshInterval)}
+	} else if hasCached {
+		log.Printf("Unable to refresh %s secret, using the cached value: %v", providerName, fetch.err)
+		retry := secretRetryInterval
+		if r.refreshInterval < retry {
+			retry = r.refreshInterval
+		}
+		r.cache[value] = cachedSecret{value: cached.value, refreshAt: now.Add(retry)}
+		fetch.value, fetch.err = cached.value, nil
+	}
+	r.mu.Unlock()
+	close(fetch.done)
+
+	return fetch.value, fetch.err
+}
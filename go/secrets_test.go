@@ -0,0 +1,307 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeSecretProvider returns value, or err when set, after waiting for release when set
+type fakeSecretProvider struct {
+	mu      sync.Mutex
+	value   string
+	err     error
+	release chan struct{}
+	fetches atomic.Int32
+}
+
+func (p *fakeSecretProvider) Fetch(ref string) (string, error) {
+	p.fetches.Add(1)
+	p.mu.Lock()
+	release := p.release
+	p.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.value, p.err
+}
+
+func (p *fakeSecretProvider) set(value string, err error, release chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.value, p.err, p.release = value, err, release
+}
+
+func newFakeSecretResolver(refreshInterval time.Duration) (*SecretResolver, *fakeSecretProvider) {
+	provider := &fakeSecretProvider{value: "first"}
+	resolver := NewSecretResolver(SecretsConfig{RefreshInterval: refreshInterval})
+	resolver.providers["file"] = provider
+	return resolver, provider
+}
+
+func TestSecretResolverFetchesOncePerSecret(t *testing.T) {
+	resolver, provider := newFakeSecretResolver(time.Minute)
+	release := make(chan struct{})
+	provider.set("first", nil, release)
+
+	var wg sync.WaitGroup
+	values := make([]string, 5)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i], _ = resolver.Resolve("file:/run/secrets/token")
+		}(i)
+	}
+	// Give every caller the chance to find the fetch in progress
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, value := range values {
+		if value != "first" {
+			t.Errorf("caller %d: expected the fetched value, got %q", i, value)
+		}
+	}
+	if fetches := provider.fetches.Load(); fetches != 1 {
+		t.Errorf("expected concurrent callers to share one fetch, got %d", fetches)
+	}
+
+	// Plain values are not fetched
+	if value, _ := resolver.Resolve("not-a-reference"); value != "not-a-reference" {
+		t.Errorf("expected a plain value to be returned as is, got %q", value)
+	}
+}
+
+func TestSecretResolverRefresh(t *testing.T) {
+	resolver, provider := newFakeSecretResolver(time.Hour)
+	if value, err := resolver.Resolve("file:/run/secrets/token"); value != "first" || err != nil {
+		t.Fatalf("unexpected secret %q, %v", value, err)
+	}
+
+	// Cached until the refresh interval passes
+	provider.set("second", nil, nil)
+	if value, _ := resolver.Resolve("file:/run/secrets/token"); value != "first" {
+		t.Errorf("expected the cached value, got %q", value)
+	}
+	expire(resolver, "file:/run/secrets/token")
+	if value, _ := resolver.Resolve("file:/run/secrets/token"); value != "second" {
+		t.Errorf("expected the refreshed value, got %q", value)
+	}
+
+	// A slow refresh does not hold up callers with a cached value
+	release := make(chan struct{})
+	provider.set("third", nil, release)
+	expire(resolver, "file:/run/secrets/token")
+	done := make(chan string)
+	go func() {
+		value, _ := resolver.Resolve("file:/run/secrets/token")
+		done <- value
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if value, _ := resolver.Resolve("file:/run/secrets/token"); value != "second" || time.Since(start) > time.Second {
+		t.Errorf("expected the cached value without waiting, got %q", value)
+	}
+	close(release)
+	if value := <-done; value != "third" {
+		t.Errorf("expected the refreshing caller to get the new value, got %q", value)
+	}
+}
+
+func TestSecretResolverFailedRefresh(t *testing.T) {
+	resolver, provider := newFakeSecretResolver(time.Hour)
+	if _, err := resolver.Resolve("file:/run/secrets/token"); err != nil {
+		t.Fatal(err)
+	}
+
+	provider.set("", errors.New("vault is sealed"), nil)
+	expire(resolver, "file:/run/secrets/token")
+	for i := 0; i < 3; i++ {
+		if value, err := resolver.Resolve("file:/run/secrets/token"); value != "first" || err != nil {
+			t.Errorf("expected the cached value during the outage, got %q, %v", value, err)
+		}
+	}
+	if fetches := provider.fetches.Load(); fetches != 2 {
+		t.Errorf("expected the failed refresh to be retried later rather than on every call, got %d fetches", fetches)
+	}
+	resolver.mu.Lock()
+	refreshAt := resolver.cache["file:/run/secrets/token"].refreshAt
+	resolver.mu.Unlock()
+	if wait := time.Until(refreshAt); wait <= 0 || wait > secretRetryInterval {
+		t.Errorf("expected a retry within %s, got %s", secretRetryInterval, wait)
+	}
+
+	// Without a cached value the error is returned
+	if _, err := resolver.Resolve("file:/run/secrets/other"); err == nil {
+		t.Error("expected an error for a secret that was never fetched")
+	}
+}
+
+// expire makes the cached secret due for a refresh
+func expire(resolver *SecretResolver, value string) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	cached := resolver.cache[value]
+	cached.refreshAt = time.Now()
+	resolver.cache[value] = cached
+}
+
+func TestSecretProviders(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := NewSecretResolver(SecretsConfig{RefreshInterval: time.Minute})
+	for _, test := range []struct {
+		value string
+		want  string
+		fails bool
+	}{
+		{"file:" + tokenFile, "from-file", false},
+		{"file:" + filepath.Join(dir, "missing"), "", true},
+		{"exec:echo  from-exec ", "from-exec", false},
+		{"exec:false", "", true},
+		{"exec:", "", true},
+		// Arguments are quoted as in a shell
+		{`exec:printf '%s %s' "from exec" 'with spaces'`, "from exec with spaces", false},
+		{`exec:echo "it's \"quoted\""`, `it's "quoted"`, false},
+		{`exec:echo escaped\ space`, "escaped space", false},
+		{`exec:echo 'unterminated`, "", true},
+		// Only known providers are references, so a secret containing a colon is used as is
+		{"s3cr3t:with-colon", "s3cr3t:with-colon", false},
+		// Secrets that look like a reference are escaped with literal:
+		{"literal:file:" + tokenFile, "file:" + tokenFile, false},
+		{"literal:exec:false", "exec:false", false},
+		{"literal:literal:x", "literal:x", false},
+	} {
+		value, err := resolver.Resolve(test.value)
+		if (err != nil) != test.fails || value != test.want {
+			t.Errorf("%s: expected %q (fails: %t), got %q, %v", test.value, test.want, test.fails, value, err)
+		}
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	for _, test := range []struct {
+		command string
+		want    []string
+		fails   bool
+	}{
+		{"get-secret  signing ", []string{"get-secret", "signing"}, false},
+		{`get-secret --password 'hunter 2' "a \"b\" \c"`, []string{"get-secret", "--password", "hunter 2", `a "b" \c`}, false},
+		{`get-secret 'it''s' "" x\'y`, []string{"get-secret", "its", "", "x'y"}, false},
+		{"", nil, false},
+		{`get-secret "open`, nil, true},
+		{`get-secret trailing\`, nil, true},
+	} {
+		args, err := splitCommand(test.command)
+		if (err != nil) != test.fails || !reflect.DeepEqual(args, test.want) {
+			t.Errorf("%s: expected %q (fails: %t), got %q, %v", test.command, test.want, test.fails, args, err)
+		}
+	}
+}
+
+func TestRedactSecretRef(t *testing.T) {
+	for value, want := range map[string]string{
+		"plain-secret":                          redactedValue,
+		"literal:exec:get-secret hunter2":       redactedValue,
+		"file:/run/secrets/token":               "file:/run/secrets/token",
+		"exec:get-token":                        "exec:get-token",
+		`exec:get-secret --password 'hunter 2'`: "exec:get-secret " + redactedValue,
+		`exec:get-secret 'hunter 2`:             "exec:" + redactedValue,
+	} {
+		redacted := value
+		redactString(&redacted)
+		if redacted != want {
+			t.Errorf("%s: expected %q, got %q", value, want, redacted)
+		}
+	}
+}
+
+func TestVaultSecretProvider(t *testing.T) {
+	secrets := map[string]map[string]interface{}{
+		// KV v2 nests the secret under data.data
+		"/v1/secret/data/opal": {"data": map[string]interface{}{"token": "from-v2"}},
+		"/v1/kv/opal":          {"token": "from-v1"},
+	}
+	var mu sync.Mutex
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" || r.Header.Get("X-Vault-Namespace") != "team" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := secrets[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+		case http.MethodPost:
+			var data map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&data)
+			secrets[r.URL.Path] = data
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer vault.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "vault-token")
+	if err := os.WriteFile(tokenFile, []byte("vault-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := SecretsConfig{RefreshInterval: time.Minute, Vault: VaultConfig{Address: vault.URL, TokenFile: tokenFile, Namespace: "team"}}
+	resolver := NewSecretResolver(config)
+	for _, test := range []struct {
+		value string
+		want  string
+		fails bool
+	}{
+		{"vault:secret/data/opal#token", "from-v2", false},
+		{"vault:kv/opal#token", "from-v1", false},
+		{"vault:kv/opal#other", "", true},
+		{"vault:kv/missing#token", "", true},
+		{"vault:kv/opal", "", true},
+	} {
+		value, err := resolver.Resolve(test.value)
+		if (err != nil) != test.fails || value != test.want {
+			t.Errorf("%s: expected %q (fails: %t), got %q, %v", test.value, test.want, test.fails, value, err)
+		}
+	}
+
+	// Storing a key keeps the other keys of the secret
+	if err := StoreSecret(config, "vault:secret/data/opal#signing", "new"); err != nil {
+		t.Fatal(err)
+	}
+	stored := NewSecretResolver(config)
+	for ref, want := range map[string]string{"vault:secret/data/opal#token": "from-v2", "vault:secret/data/opal#signing": "new"} {
+		if value, err := stored.Resolve(ref); err != nil || value != want {
+			t.Errorf("%s: expected %q, got %q, %v", ref, want, value, err)
+		}
+	}
+
+	// Without access the error is returned
+	config.Vault.TokenFile = ""
+	if _, err := NewSecretResolver(config).Resolve("vault:kv/opal#token"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected vault's refusal to be returned, got %v", err)
+	}
+}
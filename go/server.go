@@ -0,0 +1,159 @@
+package openapi
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ServerTLSCertFileEnvKey     = "SERVER_TLS_CERT_FILE"
+	ServerTLSKeyFileEnvKey      = "SERVER_TLS_KEY_FILE"
+	ServerTLSClientCAFileEnvKey = "SERVER_TLS_CLIENT_CA_FILE"
+	ServerTLSMinVersionEnvKey   = "SERVER_TLS_MIN_VERSION"
+	ServerReadTimeoutEnvKey     = "SERVER_READ_TIMEOUT"
+	ServerWriteTimeoutEnvKey    = "SERVER_WRITE_TIMEOUT"
+	ServerIdleTimeoutEnvKey     = "SERVER_IDLE_TIMEOUT"
+	ServerShutdownTimeoutEnvKey = "SERVER_SHUTDOWN_TIMEOUT"
+)
+
+type ServerConfig struct {
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// How long to wait for in-flight requests to finish on SIGTERM before exiting anyway
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// cert_file and key_file enable HTTPS. Setting ca_file as well requires Opal to present a client
+	// certificate signed by one of those CAs.
+	TLS TLSConfig `yaml:"tls"`
+}
+
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadTimeout:     30 * time.Second,
+		WriteTimeout:    60 * time.Second,
+		IdleTimeout:     120 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		TLS: TLSConfig{
+			MinVersion: "1.2",
+		},
+	}
+}
+
+func (c ServerConfig) validate(configErr *ConfigError) {
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 || c.ShutdownTimeout < 0 {
+		configErr.add("server timeouts must not be negative")
+	}
+	c.TLS.validate("server.tls", configErr)
+	if c.TLS.CAFile != "" && c.TLS.CertFile == "" {
+		configErr.add("server.tls.ca_file needs cert_file and key_file, client certificates can only be verified over TLS")
+	}
+}
+
+// serverTLSConfig builds the TLS configuration for the listener. The server certificate and the client
+// CA bundle are looked up on every handshake so that renewed files are picked up.
+func (r *certReloader) serverTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion: tlsVersions[r.config.MinVersion],
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.certificate(), nil
+		},
+	}
+
+	if r.config.CAFile != "" {
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			clientConfig := tlsConfig.Clone()
+			clientConfig.GetConfigForClient = nil
+			clientConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			clientConfig.ClientCAs = r.caPool()
+			return clientConfig, nil
+		}
+	}
+
+	return tlsConfig
+}
+
+// Serve runs the connector until it receives SIGINT or SIGTERM, then stops accepting connections
+// and waits for in-flight requests to finish, so a deploy does not cut off a membership change
+// halfway through.
+func Serve(config *Config, handler http.Handler) error {
+	server := &http.Server{
+		Addr:              config.ListenAddress,
+		Handler:           handler,
+		ReadTimeout:       config.Server.ReadTimeout,
+		ReadHeaderTimeout: config.Server.ReadTimeout,
+		WriteTimeout:      config.Server.WriteTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
+	}
+
+	useTLS := config.Server.TLS.CertFile != ""
+	if useTLS {
+		reloader, err := newCertReloader(config.Server.TLS)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = reloader.serverTLSConfig()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Both listeners may fail, so neither send can block once Serve has returned
+	serveErr := make(chan error, 2)
+	go func() {
+		if useTLS {
+			// The certificate comes from TLSConfig, so no files are passed here
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	// The admin port stays plain HTTP, it is meant for probes and operators inside the cluster
+	var adminServer *http.Server
+	if config.AdminListenAddress != "" {
+		adminServer = &http.Server{
+			Addr:              config.AdminListenAddress,
+			Handler:           NewAdminRouter(config),
+			ReadTimeout:       config.Server.ReadTimeout,
+			ReadHeaderTimeout: config.Server.ReadTimeout,
+			WriteTimeout:      config.Server.WriteTimeout,
+			IdleTimeout:       config.Server.IdleTimeout,
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				serveErr <- errors.Wrap(err, "admin server failed")
+			}
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shuttingDown.Store(true)
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", config.Server.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return errors.Wrap(err, "in-flight requests did not finish before the shutdown timeout")
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			return errors.Wrap(err, "admin requests did not finish before the shutdown timeout")
+		}
+	}
+
+	log.Printf("Server stopped")
+	return nil
+}
@@ -0,0 +1,333 @@
+package openapi
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	authentik "goauthentik.io/api/v3"
+)
+
+// SeparationOfDutiesRule is a toxic combination of groups: nobody may be a member of more than one
+// of them, directly or through a nested group
+type SeparationOfDutiesRule struct {
+	Name string `yaml:"name"`
+	// Group names or primary keys
+	Groups []string `yaml:"groups"`
+}
+
+// SeparationOfDutiesViolation is a user who is a member of several groups of a rule
+type SeparationOfDutiesViolation struct {
+	Rule      string
+	UserID    string
+	UserName  string
+	UserEmail string
+	// Names of the groups of the rule the user is a member of, in the order of the rule
+	Groups []string
+}
+
+func validateSeparationOfDuties(rules []SeparationOfDutiesRule, configErr *ConfigError) {
+	seen := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.Name == "" {
+			configErr.add("separation_of_duties[%d].name is required", i)
+		} else if seen[rule.Name] {
+			configErr.add("separation_of_duties rule %s is declared more than once", rule.Name)
+		}
+		seen[rule.Name] = true
+		if len(rule.Groups) < 2 {
+			configErr.add("separation_of_duties[%d].groups needs at least two groups", i)
+		}
+	}
+}
+
+// groupGraph is the nesting and direct members of every group, enough to work out who is a member
+// of a group through nested groups without asking Authentik group by group
+type groupGraph struct {
+	names  map[string]string
+	parent map[string]string
+	users  map[string][]int32
+}
+
+func newGroupGraph() *groupGraph {
+	return &groupGraph{
+		names:  make(map[string]string),
+		parent: make(map[string]string),
+		users:  make(map[string][]int32),
+	}
+}
+
+func (g *groupGraph) add(group *authentik.Group) {
+	g.names[group.GetPk()] = group.GetName()
+	g.parent[group.GetPk()] = group.GetParent()
+	g.users[group.GetPk()] = group.GetUsers()
+}
+
+// loadGroupGraph loads every group, for reports on the whole instance
+func (c *AuthentikClient) loadGroupGraph(ctx context.Context) (*groupGraph, error) {
+	graph := newGroupGraph()
+
+	for cursor := ""; ; {
+		groups, nextCursor, err := c.PaginatedListGroups(ctx, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for i := range groups {
+			graph.add(&groups[i])
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	return graph, nil
+}
+
+// loadAffectedGroupGraph loads the part of the group graph a membership change can affect: the groups
+// the given users are direct members of and the given groups, with all their ancestors. That is every
+// group those users are a member of, directly or through nesting, before and after the change.
+func (c *AuthentikClient) loadAffectedGroupGraph(ctx context.Context, users []int32, groups ...*authentik.Group) (*groupGraph, error) {
+	graph := newGroupGraph()
+	pending := append([]*authentik.Group(nil), groups...)
+
+	if len(users) > 0 {
+		ctxWithAuth := c.addAuthTokenToCtx(ctx)
+		for page := int32(1); ; page++ {
+			list, resp, err := c.client.CoreApi.CoreGroupsList(ctxWithAuth).MembersByPk(users).Page(page).PageSize(DefaultPageSize).Execute()
+			if err != nil {
+				statusCode := 500
+				if resp != nil {
+					statusCode = resp.StatusCode
+				}
+				return nil, &ClientError{StatusCode: statusCode, Message: "failed to list groups from Authentik", innerError: err}
+			}
+			for i := range list.Results {
+				pending = append(pending, &list.Results[i])
+			}
+			if getNextCursorFromPagination(list.Pagination) == "" {
+				break
+			}
+		}
+	}
+
+	for len(pending) > 0 {
+		group := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := graph.names[group.GetPk()]; ok {
+			continue
+		}
+		graph.add(group)
+
+		if parentID := group.GetParent(); parentID != "" {
+			if _, ok := graph.names[parentID]; !ok {
+				parent, err := c.GetGroup(ctx, parentID)
+				if err != nil {
+					return nil, err
+				}
+				pending = append(pending, parent)
+			}
+		}
+	}
+
+	return graph, nil
+}
+
+// subtreeUsers returns the direct members of a group and of the groups nested in it, at any depth
+func (c *AuthentikClient) subtreeUsers(ctx context.Context, group *authentik.Group) ([]int32, error) {
+	users := make([]int32, 0)
+	seen := make(map[string]bool)
+	pending := []*authentik.Group{group}
+	for len(pending) > 0 {
+		group := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[group.GetPk()] {
+			continue
+		}
+		seen[group.GetPk()] = true
+		users = append(users, group.Users...)
+
+		children, err := c.ListChildrenGroups(ctx, group.GetPk())
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, children...)
+	}
+
+	return users, nil
+}
+
+// resolve finds a group by primary key or, failing that, by name
+func (g *groupGraph) resolve(group string) (string, bool) {
+	if _, ok := g.names[group]; ok {
+		return group, true
+	}
+	for pk, name := range g.names {
+		if name == group {
+			return pk, true
+		}
+	}
+	return "", false
+}
+
+// members returns the users of a group and of the groups nested in it, at any depth
+func (g *groupGraph) members(pk string) map[int32]bool {
+	children := make(map[string][]string)
+	for child, parent := range g.parent {
+		children[parent] = append(children[parent], child)
+	}
+
+	members := make(map[int32]bool)
+	seen := make(map[string]bool)
+	pending := []string{pk}
+	for len(pending) > 0 {
+		group := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+		for _, user := range g.users[group] {
+			members[user] = true
+		}
+		pending = append(pending, children[group]...)
+	}
+
+	return members
+}
+
+// violations returns the users in more than one group of a rule, keyed by rule name and user.
+// Groups of a rule that do not exist are ignored.
+func (g *groupGraph) violations(rules []SeparationOfDutiesRule) map[string]*SeparationOfDutiesViolation {
+	violations := make(map[string]*SeparationOfDutiesViolation)
+	for _, rule := range rules {
+		groupsOfUser := make(map[int32][]string)
+		for _, group := range rule.Groups {
+			pk, ok := g.resolve(group)
+			if !ok {
+				continue
+			}
+			for user := range g.members(pk) {
+				groupsOfUser[user] = append(groupsOfUser[user], g.names[pk])
+			}
+		}
+
+		for user, groups := range groupsOfUser {
+			if len(groups) < 2 {
+				continue
+			}
+			userID := strconv.Itoa(int(user))
+			violations[rule.Name+"/"+userID] = &SeparationOfDutiesViolation{Rule: rule.Name, UserID: userID, Groups: groups}
+		}
+	}
+
+	return violations
+}
+
+// checkUserSeparationOfDuties refuses to add a user to a group if that would put them in more than
+// one group of a rule
+func (c *AuthentikClient) checkUserSeparationOfDuties(ctx context.Context, group *authentik.Group, userPK int32) error {
+	if len(c.backend.config.SeparationOfDuties) == 0 {
+		return nil
+	}
+
+	graph, err := c.loadAffectedGroupGraph(ctx, []int32{userPK}, group)
+	if err != nil {
+		return err
+	}
+	return c.checkSeparationOfDuties(graph, func(graph *groupGraph) {
+		graph.users[group.GetPk()] = append(graph.users[group.GetPk()], userPK)
+	})
+}
+
+// checkNestingSeparationOfDuties refuses to nest a group if that would put any of its members, or the
+// members of the groups nested in it, in more than one group of a rule
+func (c *AuthentikClient) checkNestingSeparationOfDuties(ctx context.Context, containingGroup *authentik.Group, memberGroup *authentik.Group) error {
+	if len(c.backend.config.SeparationOfDuties) == 0 {
+		return nil
+	}
+
+	users, err := c.subtreeUsers(ctx, memberGroup)
+	if err != nil {
+		return err
+	}
+	graph, err := c.loadAffectedGroupGraph(ctx, users, containingGroup, memberGroup)
+	if err != nil {
+		return err
+	}
+	// Members of the member group, and of the groups nested in it, become members of the containing group
+	return c.checkSeparationOfDuties(graph, func(graph *groupGraph) {
+		graph.parent[memberGroup.GetPk()] = containingGroup.GetPk()
+	})
+}
+
+// checkSeparationOfDuties refuses a membership change, described by how it changes the group graph,
+// that would put a user in more than one group of a rule. Users already in violation may keep
+// their memberships, but may not join further groups of the rule. The graph must hold every group
+// the users affected by the change are a member of.
+func (c *AuthentikClient) checkSeparationOfDuties(graph *groupGraph, change func(graph *groupGraph)) error {
+	rules := c.backend.config.SeparationOfDuties
+	before := graph.violations(rules)
+	change(graph)
+	after := graph.violations(rules)
+
+	keys := make([]string, 0, len(after))
+	for key := range after {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		violation := after[key]
+		existing := make(map[string]bool)
+		if previous, ok := before[key]; ok {
+			for _, group := range previous.Groups {
+				existing[group] = true
+			}
+		}
+		for _, group := range violation.Groups {
+			if !existing[group] {
+				return &ClientError{
+					StatusCode: http.StatusForbidden,
+					Message:    "refusing to change membership as user " + violation.UserID + " would be a member of conflicting groups",
+					innerError: errors.Errorf("separation of duties rule %s forbids membership of both %s", violation.Rule, strings.Join(violation.Groups, " and ")),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// SeparationOfDutiesReport lists the users who already are members of more than one group of a
+// configured rule, sorted by rule and user
+func (c *AuthentikClient) SeparationOfDutiesReport(ctx context.Context) ([]SeparationOfDutiesViolation, error) {
+	graph, err := c.loadGroupGraph(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := make([]SeparationOfDutiesViolation, 0)
+	for _, violation := range graph.violations(c.backend.config.SeparationOfDuties) {
+		// Names are resolved on a best effort basis, the ID is enough to act on the violation
+		if userPK, convErr := strconv.Atoi(violation.UserID); convErr == nil {
+			if user, lookupErr := c.GetUser(ctx, int32(userPK)); lookupErr == nil {
+				violation.UserName = user.GetUsername()
+				violation.UserEmail = user.GetEmail()
+			}
+		}
+		report = append(report, *violation)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Rule != report[j].Rule {
+			return report[i].Rule < report[j].Rule
+		}
+		a, _ := strconv.Atoi(report[i].UserID)
+		b, _ := strconv.Atoi(report[j].UserID)
+		return a < b
+	})
+
+	return report, nil
+}
@@ -0,0 +1,96 @@
+package openapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/go/authentiktest"
+)
+
+const sodConfig = `separation_of_duties:
+  - name: payments
+    groups: [approvers, Payments submitters]
+`
+
+// seedPaymentGroups adds approvers with alice and submitters with bob, plus a team nested in
+// submitters and a contractors group holding both
+func seedPaymentGroups(tc *testConnector) {
+	seedGroups(tc)
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "approvers", Name: "Payments approvers", Users: []int32{1}})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "submitters", Name: "Payments submitters", Users: []int32{2}})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "ap-team", Name: "AP team", Parent: "submitters"})
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "contractors", Name: "Contractors", Users: []int32{1}})
+}
+
+func TestSeparationOfDuties(t *testing.T) {
+	tc := newTestConnector(t, sodConfig)
+	seedPaymentGroups(tc)
+
+	var errResp Error
+	decode(t, tc.do(http.MethodPost, appPath("/groups/submitters/users"), `{"user_id":"1","app_id":"`+testAppID+`"}`), http.StatusForbidden, &errResp)
+	if !strings.Contains(errResp.Message, "rule payments forbids membership of both Payments approvers and Payments submitters") {
+		t.Errorf("expected the error to name the conflicting groups, got %q", errResp.Message)
+	}
+
+	// Joining a group nested in submitters makes alice a member of submitters too
+	decode(t, tc.do(http.MethodPost, appPath("/groups/ap-team/users"), `{"user_id":"1","app_id":"`+testAppID+`"}`), http.StatusForbidden, nil)
+
+	// So does nesting a group she is in
+	decode(t, tc.do(http.MethodPost, appPath("/groups/submitters/member-groups"), `{"group_id":"contractors","app_id":"`+testAppID+`"}`), http.StatusForbidden, nil)
+	if group, _ := tc.authentik.Group("contractors"); group.Parent != "" {
+		t.Errorf("expected contractors to stay top level, parent is %q", group.Parent)
+	}
+
+	// Unrelated changes go through
+	decode(t, tc.do(http.MethodPost, appPath("/groups/approvers/users"), `{"user_id":"1","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+}
+
+func TestSeparationOfDutiesLoadsAffectedGroups(t *testing.T) {
+	tc := newTestConnector(t, sodConfig)
+	seedPaymentGroups(tc)
+	for i := 0; i < 2*DefaultPageSize; i++ {
+		tc.authentik.AddGroup(authentiktest.Group{Pk: fmt.Sprintf("team-%d", i), Name: fmt.Sprintf("Team %d", i)})
+	}
+
+	// Only the groups bob is in are listed, in a single page, rather than every group
+	decode(t, tc.do(http.MethodPost, appPath("/groups/eng/users"), `{"user_id":"2","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	lists := 0
+	for _, request := range tc.authentik.Requests() {
+		if request == "GET /api/v3/core/groups/" {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Errorf("expected one filtered list of groups, got %d", lists)
+	}
+}
+
+func TestSeparationOfDutiesReport(t *testing.T) {
+	tc := newTestConnector(t, sodConfig)
+	seedPaymentGroups(tc)
+	tc.authentik.AddGroup(authentiktest.Group{Pk: "ap-team", Name: "AP team", Parent: "submitters", Users: []int32{1}})
+
+	report, err := testClient(t).SeparationOfDutiesReport(context.Background())
+	if err != nil {
+		t.Fatalf("SeparationOfDutiesReport: %v", err)
+	}
+	want := []SeparationOfDutiesViolation{{
+		Rule:      "payments",
+		UserID:    "1",
+		UserName:  "alice",
+		UserEmail: "alice@example.com",
+		Groups:    []string{"Payments approvers", "Payments submitters"},
+	}}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("expected %+v, got %+v", want, report)
+	}
+
+	// An existing conflict does not block changes that add no further conflicting group
+	decode(t, tc.do(http.MethodPost, appPath("/groups/platform/users"), `{"user_id":"1","app_id":"`+testAppID+`"}`), http.StatusOK, nil)
+	decode(t, tc.do(http.MethodDelete, appPath("/groups/approvers/users/1"), ""), http.StatusOK, nil)
+}
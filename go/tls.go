@@ -0,0 +1,210 @@
+package openapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	AuthentikCAFileEnvKey        = "AUTHENTIK_CA_FILE"
+	AuthentikClientCertEnvKey    = "AUTHENTIK_CLIENT_CERT_FILE"
+	AuthentikClientKeyEnvKey     = "AUTHENTIK_CLIENT_KEY_FILE"
+	AuthentikTLSMinVersionEnvKey = "AUTHENTIK_TLS_MIN_VERSION"
+	AuthentikProxyEnvKey         = "AUTHENTIK_PROXY_URL"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Certificate files are checked for changes at most this often
+const tlsReloadCheckInterval = 10 * time.Second
+
+type TLSConfig struct {
+	// PEM bundle of CAs to trust, instead of the system roots
+	CAFile string `yaml:"ca_file"`
+	// Certificate and key presented to the peer for mutual TLS
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	MinVersion string `yaml:"min_version"`
+}
+
+func (c TLSConfig) validate(name string, configErr *ConfigError) {
+	if _, ok := tlsVersions[c.MinVersion]; !ok && c.MinVersion != "" {
+		configErr.add("%s.min_version must be one of 1.0, 1.1, 1.2 or 1.3, got %q", name, c.MinVersion)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		configErr.add("%s needs both cert_file and key_file, or neither", name)
+	}
+}
+
+// certReloader holds a certificate and CA pool loaded from files and reloads them when the files
+// change, so renewed certificates are used without a restart
+type certReloader struct {
+	mu        sync.Mutex
+	config    TLSConfig
+	checkedAt time.Time
+	modTimes  map[string]time.Time
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+}
+
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	reloader := &certReloader{config: config, modTimes: make(map[string]time.Time)}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	reloader.checkedAt = time.Now()
+
+	return reloader, nil
+}
+
+func (r *certReloader) load() error {
+	if r.config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+		if err != nil {
+			return errors.Wrapf(err, "unable to load certificate %s", r.config.CertFile)
+		}
+		r.cert = &cert
+	}
+
+	if r.config.CAFile != "" {
+		contents, err := os.ReadFile(r.config.CAFile)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read CA bundle %s", r.config.CAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(contents) {
+			return errors.Errorf("CA bundle %s contains no PEM certificates", r.config.CAFile)
+		}
+		r.pool = pool
+	}
+
+	for _, path := range []string{r.config.CertFile, r.config.KeyFile, r.config.CAFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			r.modTimes[path] = info.ModTime()
+		}
+	}
+
+	return nil
+}
+
+// refresh reloads the files if any of them changed. A failed reload keeps the previous
+// certificates, as the files may be mid-update.
+func (r *certReloader) refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) < tlsReloadCheckInterval {
+		return
+	}
+	r.checkedAt = time.Now()
+
+	changed := false
+	for path, modTime := range r.modTimes {
+		if info, err := os.Stat(path); err == nil && !info.ModTime().Equal(modTime) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	cert, pool := r.cert, r.pool
+	if err := r.load(); err != nil {
+		r.cert, r.pool = cert, pool
+	}
+}
+
+func (r *certReloader) certificate() *tls.Certificate {
+	r.refresh()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert
+}
+
+func (r *certReloader) caPool() *x509.CertPool {
+	r.refresh()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pool
+}
+
+// clientTLSConfig builds the TLS configuration for outbound connections
+func (r *certReloader) clientTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion: tlsVersions[r.config.MinVersion],
+	}
+
+	if r.config.CertFile != "" {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate(), nil
+		}
+	}
+
+	if pool := r.caPool(); pool != nil {
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig
+}
+
+// reloadingTransport rebuilds its transport when the CA bundle changes, as the trusted roots of an
+// http.Transport cannot be swapped in place
+type reloadingTransport struct {
+	mu        sync.Mutex
+	reloader  *certReloader
+	base      *http.Transport
+	pool      *x509.CertPool
+	transport *http.Transport
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	if pool := t.reloader.caPool(); t.transport == nil || pool != t.pool {
+		if t.transport != nil {
+			t.transport.CloseIdleConnections()
+		}
+		t.transport = t.base.Clone()
+		t.transport.TLSClientConfig = t.reloader.clientTLSConfig()
+		t.pool = pool
+	}
+	transport := t.transport
+	t.mu.Unlock()
+
+	return transport.RoundTrip(req)
+}
+
+// newAuthentikTransport builds the transport shared by every outbound call to Authentik
+func newAuthentikTransport(config AuthentikConfig) (http.RoundTripper, error) {
+	reloader, err := newCertReloader(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid proxy URL %s", config.ProxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &reloadingTransport{reloader: reloader, base: transport}, nil
+}
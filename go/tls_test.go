@@ -0,0 +1,267 @@
+package openapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate for name signed by parent, or a self-signed CA if parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// write stores the certificate and key, dating the files after the previous write so the change is noticed
+func (c *testCert) write(t *testing.T, certFile string, keyFile string, modTime time.Time) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTLSFile(t, certFile, c.certPEM(), modTime)
+	writeTLSFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), modTime)
+}
+
+func writeTLSFile(t *testing.T, path string, contents []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, contents, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkNow makes the reloader look at the files on the next handshake
+func checkNow(reloader *certReloader) {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloader.checkedAt = time.Time{}
+}
+
+func TestAuthentikTransport(t *testing.T) {
+	dir := t.TempDir()
+	config := TLSConfig{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+	}
+	serverCA, clientCA := newTestCert(t, "server CA", nil), newTestCert(t, "client CA", nil)
+	modTime := time.Now().Add(-time.Hour)
+	writeTLSFile(t, config.CAFile, serverCA.certPEM(), modTime)
+	newTestCert(t, "connector", clientCA).write(t, config.CertFile, config.KeyFile, modTime)
+
+	// Authentik only accepts the connector's client certificate, and its own certificate can be swapped
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+	var serverCert atomic.Value
+	serverCert.Store(newTestCert(t, "authentik", serverCA).tlsCertificate())
+	authentik := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	// The config is returned per connection, as httptest would otherwise serve its own certificate
+	authentik.TLS = &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{
+			Certificates: []tls.Certificate{serverCert.Load().(tls.Certificate)},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		}, nil
+	}}
+	authentik.Config.ErrorLog = log.New(io.Discard, "", 0)
+	authentik.StartTLS()
+	defer authentik.Close()
+
+	transport, err := newAuthentikTransport(AuthentikConfig{TLS: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+	get := func() (string, error) {
+		resp, err := client.Get(authentik.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if name, err := get(); err != nil || name != "connector" {
+		t.Fatalf("expected the client certificate to be presented, got %q, %v", name, err)
+	}
+
+	// Authentik moves to a certificate from another CA, the connector follows once the bundle is updated
+	newServerCA := newTestCert(t, "new server CA", nil)
+	serverCert.Store(newTestCert(t, "authentik", newServerCA).tlsCertificate())
+	authentik.CloseClientConnections()
+	if _, err := get(); err == nil {
+		t.Error("expected a certificate from an untrusted CA to be rejected")
+	}
+	modTime = modTime.Add(time.Minute)
+	writeTLSFile(t, config.CAFile, newServerCA.certPEM(), modTime)
+	checkNow(transport.(*reloadingTransport).reloader)
+	if _, err := get(); err != nil {
+		t.Errorf("expected the new CA bundle to be used, got %v", err)
+	}
+}
+
+func TestAuthentikProxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+	}))
+	defer proxy.Close()
+
+	transport, err := newAuthentikTransport(AuthentikConfig{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://authentik.internal/api/v3/core/users/me/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if url := <-proxied; url != "http://authentik.internal/api/v3/core/users/me/" {
+		t.Errorf("expected the request to go through the proxy, got %s", url)
+	}
+}
+
+func TestServerTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	config := TLSConfig{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+		CAFile:   filepath.Join(dir, "clients.pem"),
+	}
+	serverCA, clientCA := newTestCert(t, "server CA", nil), newTestCert(t, "client CA", nil)
+	modTime := time.Now().Add(-time.Hour)
+	newTestCert(t, "first", serverCA).write(t, config.CertFile, config.KeyFile, modTime)
+	writeTLSFile(t, config.CAFile, clientCA.certPEM(), modTime)
+
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = reloader.serverTLSConfig()
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	// request connects with a client certificate issued by ca, returning the name of the server certificate
+	request := func(ca *testCert) (string, error) {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{newTestCert(t, "opal", ca).tlsCertificate()},
+		}}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	if name, err := request(clientCA); err != nil || name != "first" {
+		t.Fatalf("expected the first certificate, got %q, %v", name, err)
+	}
+	if _, err := request(serverCA); err == nil {
+		t.Error("expected a client certificate from another CA to be rejected")
+	}
+
+	// Renewed files are only looked at once the check interval has passed
+	modTime = modTime.Add(time.Minute)
+	newTestCert(t, "second", serverCA).write(t, config.CertFile, config.KeyFile, modTime)
+	if name, _ := request(clientCA); name != "first" {
+		t.Errorf("expected the files not to be checked before the interval, got %q", name)
+	}
+	checkNow(reloader)
+	if name, err := request(clientCA); err != nil || name != "second" {
+		t.Errorf("expected the renewed certificate, got %q, %v", name, err)
+	}
+
+	// A rotated client CA replaces the old one
+	newClientCA := newTestCert(t, "new client CA", nil)
+	modTime = modTime.Add(time.Minute)
+	writeTLSFile(t, config.CAFile, newClientCA.certPEM(), modTime)
+	checkNow(reloader)
+	if _, err := request(newClientCA); err != nil {
+		t.Errorf("expected a client certificate from the new CA to be accepted, got %v", err)
+	}
+	if _, err := request(clientCA); err == nil {
+		t.Error("expected a client certificate from the old CA to be rejected")
+	}
+
+	// A file caught mid-update keeps the previous certificate
+	modTime = modTime.Add(time.Minute)
+	writeTLSFile(t, config.CertFile, []byte("not a certificate"), modTime)
+	checkNow(reloader)
+	if name, err := request(newClientCA); err != nil || name != "second" {
+		t.Errorf("expected the previous certificate after a failed reload, got %q, %v", name, err)
+	}
+}
@@ -0,0 +1,214 @@
+package openapi
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/GIT_USER_ID/GIT_REPO_ID/api"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	ValidateRequestsEnvKey  = "VALIDATE_REQUESTS"
+	ValidateResponsesEnvKey = "VALIDATE_RESPONSES"
+)
+
+type ValidationConfig struct {
+	// Reject requests that do not match api/openapi.yaml with 400
+	Requests bool `yaml:"requests"`
+	// Replace responses to GET requests that do not match api/openapi.yaml with 500, so schema drift
+	// shows up in tests. Responses to changes are only logged, as the change has been made.
+	Responses bool `yaml:"responses"`
+}
+
+func defaultValidationConfig() ValidationConfig {
+	return ValidationConfig{
+		Requests: true,
+	}
+}
+
+var (
+	specOnce sync.Once
+	spec     *openapi3.T
+	specErr  error
+)
+
+// loadSpec parses the embedded OpenAPI spec once
+func loadSpec() (*openapi3.T, error) {
+	specOnce.Do(func() {
+		doc, err := openapi3.NewLoader().LoadFromData(api.Spec)
+		if err != nil {
+			specErr = errors.Wrap(err, "unable to load the OpenAPI spec")
+			return
+		}
+
+		// The spec declares a bearer token, but Opal signs its requests instead and
+		// validateOpalSignature has already checked that signature
+		doc.Security = nil
+		for _, pathItem := range doc.Paths {
+			for _, operation := range pathItem.Operations() {
+				operation.Security = &openapi3.SecurityRequirements{}
+			}
+		}
+
+		spec = doc
+	})
+
+	return spec, specErr
+}
+
+var specPathParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+// specRoutes indexes the operations of the spec by method and gin route pattern,
+// e.g. "GET /groups/:group_id"
+func specRoutes(doc *openapi3.T) map[string]*routers.Route {
+	routes := make(map[string]*routers.Route)
+	for path, pathItem := range doc.Paths {
+		pattern := specPathParam.ReplaceAllString(path, ":$1")
+		for method, operation := range pathItem.Operations() {
+			routes[method+" "+pattern] = &routers.Route{
+				Spec:      doc,
+				Path:      path,
+				PathItem:  pathItem,
+				Method:    method,
+				Operation: operation,
+			}
+		}
+	}
+
+	return routes
+}
+
+// schemaErrorMessage keeps validation errors to one line, instead of dumping the whole schema
+func schemaErrorMessage(err *openapi3.SchemaError) string {
+	if pointer := err.JSONPointer(); len(pointer) > 0 {
+		return "/" + strings.Join(pointer, "/") + ": " + err.Reason
+	}
+	return err.Reason
+}
+
+func specValidationOptions() *openapi3filter.Options {
+	options := &openapi3filter.Options{
+		AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+		// Handlers read the body as Opal sent it
+		SkipSettingDefaults: true,
+	}
+	options.WithCustomSchemaErrorFunc(schemaErrorMessage)
+
+	return options
+}
+
+// validateOpenAPI checks requests, and optionally responses, against the spec of the route they
+// were matched to. Routes the spec does not describe are passed through unchecked.
+func validateOpenAPI(doc *openapi3.T, config ValidationConfig) gin.HandlerFunc {
+	routes := specRoutes(doc)
+	options := specValidationOptions()
+
+	return func(c *gin.Context) {
+		route, ok := routes[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			c.Next()
+			return
+		}
+
+		pathParams := make(map[string]string, len(c.Params))
+		for _, param := range c.Params {
+			pathParams[param.Key] = param.Value
+		}
+		requestInput := &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    options,
+		}
+
+		if config.Requests {
+			if err := openapi3filter.ValidateRequest(c.Request.Context(), requestInput); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, &Error{
+					Code:    http.StatusBadRequest,
+					Message: err.Error(),
+				})
+				return
+			}
+		}
+
+		if !config.Responses {
+			c.Next()
+			return
+		}
+
+		writer := &bufferedResponseWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		err := openapi3filter.ValidateResponse(c.Request.Context(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: requestInput,
+			Status:                 writer.status,
+			Header:                 writer.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(writer.body.Bytes())),
+			Options:                options,
+		})
+		if err != nil && c.Request.Method != http.MethodGet {
+			// Replacing the response would hide from Opal that the change was made
+			log.Printf("Response to %s %s does not match the OpenAPI spec, passing it through: %v", c.Request.Method, c.FullPath(), err)
+		} else if err != nil {
+			log.Printf("Response to %s %s does not match the OpenAPI spec: %v", c.Request.Method, c.FullPath(), err)
+			c.JSON(http.StatusInternalServerError, &Error{
+				Code:    http.StatusInternalServerError,
+				Message: "Response does not match the OpenAPI spec: " + err.Error(),
+			})
+			return
+		}
+
+		writer.flush()
+	}
+}
+
+// bufferedResponseWriter holds back the response until it has been validated
+type bufferedResponseWriter struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *bufferedResponseWriter) WriteHeaderNow() {}
+
+func (w *bufferedResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *bufferedResponseWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func (w *bufferedResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *bufferedResponseWriter) Size() int {
+	return w.body.Len()
+}
+
+func (w *bufferedResponseWriter) Written() bool {
+	return w.body.Len() > 0
+}
+
+func (w *bufferedResponseWriter) flush() {
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.WriteHeaderNow()
+	w.ResponseWriter.Write(w.body.Bytes())
+}
@@ -0,0 +1,110 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newValidationRouter serves a few spec routes with canned responses behind validateOpenAPI
+func newValidationRouter(t *testing.T, config ValidationConfig, groups string) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	doc, err := loadSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	api := router.Group("/", validateOpenAPI(doc, config))
+	api.GET("/groups", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", []byte(groups))
+	})
+	api.POST("/groups/:group_id/users", func(c *gin.Context) {
+		if c.Param("group_id") == "drifted" {
+			// Not an Error body
+			c.Data(http.StatusNotFound, "application/json", []byte(`{"detail":"not found"}`))
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	api.GET("/not-in-spec", func(c *gin.Context) {
+		c.String(http.StatusOK, "unchecked")
+	})
+
+	return router
+}
+
+func serveValidation(router *gin.Engine, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestRequestValidation(t *testing.T) {
+	router := newValidationRouter(t, defaultValidationConfig(), `{"groups":[]}`)
+
+	for _, test := range []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		status  int
+		message string
+	}{
+		{"valid", http.MethodPost, "/groups/eng/users", `{"user_id":"1","app_id":"app"}`, http.StatusOK, ""},
+		{"missing body property", http.MethodPost, "/groups/eng/users", `{"app_id":"app"}`, http.StatusBadRequest, "user_id"},
+		{"wrong type", http.MethodPost, "/groups/eng/users", `{"user_id":1,"app_id":"app"}`, http.StatusBadRequest, "/user_id"},
+		{"missing query parameter", http.MethodGet, "/groups", "", http.StatusBadRequest, "app_id"},
+		{"route not in the spec", http.MethodGet, "/not-in-spec", "", http.StatusOK, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := serveValidation(router, test.method, test.path, test.body)
+			if recorder.Code != test.status || !strings.Contains(recorder.Body.String(), test.message) {
+				t.Errorf("expected %d mentioning %q, got %d: %s", test.status, test.message, recorder.Code, recorder.Body)
+			}
+		})
+	}
+
+	// Request validation can be turned off
+	router = newValidationRouter(t, ValidationConfig{}, `{"groups":[]}`)
+	if recorder := serveValidation(router, http.MethodPost, "/groups/eng/users", `{}`); recorder.Code != http.StatusOK {
+		t.Errorf("expected the request to pass without validation, got %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestResponseValidation(t *testing.T) {
+	valid := `{"groups":[{"id":"eng","name":"Engineering"}]}`
+	invalid := `{"groups":[{"name":"Engineering"}]}`
+
+	router := newValidationRouter(t, ValidationConfig{Responses: true}, valid)
+	if recorder := serveValidation(router, http.MethodGet, "/groups?app_id=app", ""); recorder.Code != http.StatusOK || recorder.Body.String() != valid {
+		t.Errorf("expected the response to be passed through, got %d: %s", recorder.Code, recorder.Body)
+	}
+
+	router = newValidationRouter(t, ValidationConfig{Responses: true}, invalid)
+	if recorder := serveValidation(router, http.MethodGet, "/groups?app_id=app", ""); recorder.Code != http.StatusInternalServerError || !strings.Contains(recorder.Body.String(), "id") {
+		t.Errorf("expected the invalid response to be replaced with 500, got %d: %s", recorder.Code, recorder.Body)
+	}
+
+	// Responses to changes are passed through, as the change has been made
+	if recorder := serveValidation(router, http.MethodPost, "/groups/eng/users", `{"user_id":"1","app_id":"app"}`); recorder.Code != http.StatusOK {
+		t.Errorf("expected the change to succeed, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if recorder := serveValidation(router, http.MethodPost, "/groups/drifted/users", `{"user_id":"1","app_id":"app"}`); recorder.Code != http.StatusNotFound || recorder.Body.String() != `{"detail":"not found"}` {
+		t.Errorf("expected the invalid response to a change to be passed through, got %d: %s", recorder.Code, recorder.Body)
+	}
+
+	// Responses are not checked unless enabled
+	router = newValidationRouter(t, defaultValidationConfig(), invalid)
+	if recorder := serveValidation(router, http.MethodGet, "/groups?app_id=app", ""); recorder.Code != http.StatusOK || recorder.Body.String() != invalid {
+		t.Errorf("expected the response to be passed through unchecked, got %d: %s", recorder.Code, recorder.Body)
+	}
+}
@@ -10,7 +10,10 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
+	"strings"
 
 	// WARNING!
 	// Pass --git-repo-id and --git-user-id properties when generating the code
@@ -19,11 +22,51 @@ import (
 )
 
 func main() {
-	routes := sw.ApiHandleFunctions{}
+	// Without a subcommand the binary runs the connector, as it always has
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	os.Exit(runServe(os.Args[1:]))
+}
 
-	log.Printf("Server started")
+func runServe(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := configFlag(flags)
+	flags.Parse(args)
+
+	config, err := sw.LoadConfig(*configPath)
+	if err != nil {
+		log.Printf("Refusing to start: %v", err)
+		return 1
+	}
+	sw.SetConfig(config)
+
+	auditLogger, err := sw.NewAuditLoggerFromConfig(config)
+	if err != nil {
+		log.Printf("Refusing to start: %v", err)
+		return 1
+	}
+	sw.SetAuditLogger(auditLogger)
+	if auditLogger != nil {
+		defer auditLogger.Close()
+	}
+
+	routes := sw.ApiHandleFunctions{}
 
 	router := sw.NewRouter(routes)
 
-	log.Fatal(router.Run(":8080"))
+	log.Printf("Server started on %s", config.ListenAddress)
+
+	if err := sw.Serve(config, router); err != nil {
+		log.Printf("Server stopped: %v", err)
+		return 1
+	}
+
+	return 0
+}
+
+// configFlag registers the -config flag, which defaults to the CONNECTOR_CONFIG environment variable
+func configFlag(flags *flag.FlagSet) *string {
+	return flags.String("config", os.Getenv(sw.ConfigFileEnvKey), "path to the YAML config file")
 }